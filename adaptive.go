@@ -0,0 +1,70 @@
+package nuvolari
+
+import (
+	"time"
+
+	"github.com/bassosimone/nuvolari/stats"
+)
+
+// The following constants tune the adaptive termination of the download.
+const (
+	// adaptiveMinDuration is the minimum duration of an adaptive download.
+	adaptiveMinDuration = 2 * time.Second
+
+	// adaptiveBBRGrowth is the relative growth of the BBR bandwidth below
+	// which we consider the bandwidth not to be growing anymore.
+	adaptiveBBRGrowth = 0.25
+
+	// adaptiveBBRRounds is the number of consecutive server measurements
+	// without significant bandwidth growth after which the pipe is full.
+	adaptiveBBRRounds = 3
+
+	// adaptiveWindow is the number of consecutive client measurements in
+	// which the mean throughput must be stable.
+	adaptiveWindow = 8
+
+	// adaptiveTolerance is the maximum relative deviation of the mean
+	// throughput of the measurements in the window from their average.
+	adaptiveTolerance = 0.03
+)
+
+// convergence detects whether the download speed has converged, using the
+// same criterion as BBR to detect that the pipe is full, when the server
+// provides BBR information, or otherwise the stability of the mean
+// throughput measured by the client, which is what the test reports.
+type convergence struct {
+	fullBW      float64
+	rounds      int
+	throughputs []float64
+}
+
+// addServer processes a server measurement.
+func (c *convergence) addServer(m Measurement) {
+	if m.BBRInfo == nil || m.BBRInfo.MaxBandwidth <= 0 {
+		return
+	}
+	if m.BBRInfo.MaxBandwidth >= c.fullBW*(1+adaptiveBBRGrowth) {
+		c.fullBW, c.rounds = m.BBRInfo.MaxBandwidth, 0
+		return
+	}
+	c.rounds++
+}
+
+// addClient processes the mean throughput of a client measurement.
+func (c *convergence) addClient(throughput float64) {
+	c.throughputs = append(c.throughputs, throughput)
+	if len(c.throughputs) > adaptiveWindow {
+		c.throughputs = c.throughputs[1:]
+	}
+}
+
+// converged tells whether the speed has converged after elapsed time.
+func (c *convergence) converged(elapsed time.Duration) bool {
+	if elapsed < adaptiveMinDuration {
+		return false
+	}
+	if c.rounds >= adaptiveBBRRounds {
+		return true
+	}
+	return stats.Converged(c.throughputs, adaptiveWindow, adaptiveTolerance)
+}
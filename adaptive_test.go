@@ -0,0 +1,71 @@
+package nuvolari
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConvergence(t *testing.T) {
+	stable := func(c *convergence) {
+		for i := 0; i < adaptiveWindow; i++ {
+			c.addClient(100 + float64(i%2))
+		}
+	}
+	tests := []struct {
+		name      string
+		fill      func(*convergence)
+		elapsed   time.Duration
+		converged bool
+	}{{
+		name:      "stable throughput",
+		fill:      stable,
+		elapsed:   adaptiveMinDuration,
+		converged: true,
+	}, {
+		name:    "stable throughput too early",
+		fill:    stable,
+		elapsed: adaptiveMinDuration - time.Millisecond,
+	}, {
+		name: "growing throughput",
+		fill: func(c *convergence) {
+			for i := 0; i < adaptiveWindow; i++ {
+				c.addClient(float64(10 * (i + 1)))
+			}
+		},
+		elapsed: adaptiveMinDuration,
+	}, {
+		name: "too few measurements",
+		fill: func(c *convergence) {
+			c.addClient(100)
+		},
+		elapsed: adaptiveMinDuration,
+	}, {
+		name: "growing throughput that stabilizes",
+		fill: func(c *convergence) {
+			for i := 0; i < adaptiveWindow; i++ {
+				c.addClient(float64(10 * (i + 1)))
+			}
+			stable(c)
+		},
+		elapsed:   adaptiveMinDuration,
+		converged: true,
+	}, {
+		name: "full pipe according to BBR",
+		fill: func(c *convergence) {
+			for i := 0; i <= adaptiveBBRRounds; i++ {
+				c.addServer(Measurement{BBRInfo: &BBRInfo{MaxBandwidth: 1e6}})
+			}
+		},
+		elapsed:   adaptiveMinDuration,
+		converged: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &convergence{}
+			tt.fill(c)
+			if got := c.converged(tt.elapsed); got != tt.converged {
+				t.Fatalf("expected %v, got %v", tt.converged, got)
+			}
+		})
+	}
+}
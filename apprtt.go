@@ -0,0 +1,74 @@
+package nuvolari
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pinger sends WebSocket pings and collects the application-level RTT
+// samples computed from the pongs. Each ping contains the time when we
+// sent it, relative to t0, so we do not need to track pending pings.
+type pinger struct {
+	interval time.Duration
+	timeout  time.Duration
+	t0       time.Time
+	tLast    time.Time
+	mu       sync.Mutex
+	samples  []float64
+}
+
+// newPinger returns a pinger for conn, or nil if interval is not positive.
+// The timeout applies to writing each ping. It replaces the pong handler
+// of conn, which runs in the goroutine that reads from conn, hence the
+// pinger is safe for concurrent use.
+func newPinger(conn *websocket.Conn, interval, timeout time.Duration) *pinger {
+	if interval <= 0 {
+		return nil
+	}
+	p := &pinger{interval: interval, timeout: timeout, t0: time.Now()}
+	conn.SetPongHandler(p.onPong)
+	return p
+}
+
+// maybePing sends a ping if interval has elapsed since the previous one.
+// We ignore errors, since the test will notice if the connection fails.
+func (p *pinger) maybePing(conn *websocket.Conn, now time.Time) {
+	if p == nil || now.Sub(p.tLast) < p.interval {
+		return
+	}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(now.Sub(p.t0)))
+	conn.WriteControl(websocket.PingMessage, payload, now.Add(p.timeout))
+	p.tLast = now
+}
+
+// onPong computes an RTT sample from the payload of a pong.
+func (p *pinger) onPong(data string) error {
+	if len(data) != 8 {
+		return nil // Not one of our pings
+	}
+	sent := time.Duration(binary.BigEndian.Uint64([]byte(data)))
+	rtt := time.Now().Sub(p.t0) - sent
+	if sent < 0 || rtt < 0 {
+		return nil
+	}
+	p.mu.Lock()
+	p.samples = append(p.samples, float64(rtt)/float64(time.Millisecond))
+	p.mu.Unlock()
+	return nil
+}
+
+// takeSamples returns and forgets the RTT samples collected so far.
+func (p *pinger) takeSamples() []float64 {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	samples := p.samples
+	p.samples = nil
+	return samples
+}
@@ -0,0 +1,197 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// BidirectionalError is returned when either direction of a bidirectional
+// test fails. Both errors.Is and errors.As inspect both errors.
+type BidirectionalError struct {
+	// Download is the error of the download, if any.
+	Download error
+
+	// Upload is the error of the upload, if any.
+	Upload error
+}
+
+func (e *BidirectionalError) Error() string {
+	return errors.Join(e.Download, e.Upload).Error()
+}
+
+// Unwrap returns the errors that occurred.
+func (e *BidirectionalError) Unwrap() []error {
+	var errs []error
+	for _, err := range []error{e.Download, e.Upload} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// directionHandler is the Handler of a direction of a bidirectional test.
+// Like streamHandler, it posts the events to the goroutine running the
+// test, which delivers them to the Handler of the Client.
+type directionHandler struct {
+	test   string
+	events chan<- func(Client)
+}
+
+func (dh directionHandler) OnLogInfo(m LogMessage) {
+	if _, found := m.Params["test"]; !found {
+		params := map[string]string{"test": dh.test}
+		for key, value := range m.Params {
+			params[key] = value
+		}
+		m.Params = params
+	}
+	dh.events <- func(cl Client) {
+		if cl.wants(EventLog) {
+			cl.Handler.OnLogInfo(m)
+		}
+	}
+}
+
+func (dh directionHandler) OnServerDownloadMeasurement(m Measurement) {
+	dh.events <- func(cl Client) { cl.serverDownloadMeasurement(m) }
+}
+
+func (dh directionHandler) OnClientDownloadMeasurement(m Measurement) {
+	dh.events <- func(cl Client) { cl.clientDownloadMeasurement(m) }
+}
+
+func (dh directionHandler) OnServerUploadMeasurement(m Measurement) {
+	dh.events <- func(cl Client) { cl.serverUploadMeasurement(m) }
+}
+
+func (dh directionHandler) OnClientUploadMeasurement(m Measurement) {
+	dh.events <- func(cl Client) { cl.clientUploadMeasurement(m) }
+}
+
+func (dh directionHandler) OnFinding(f Finding) {
+	dh.events <- func(cl Client) { cl.finding(f) }
+}
+
+// OnProgress ignores the progress of the direction, since the goroutine
+// running the test emits the progress of the whole test.
+func (dh directionHandler) OnProgress(Progress) {}
+
+// RunBidirectional runs a ndt7 download and a ndt7 upload concurrently, on
+// two connections, to measure the performance under full-duplex load. The
+// events of each direction are delivered using the corresponding Handler
+// methods, and logs have the "test" param set. If either direction fails,
+// it returns a *BidirectionalError; the other direction keeps running.
+func (cl Client) RunBidirectional(ctx context.Context) error {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	cl.Settings = cl.Settings.clone()
+	if cl.Handler != nil {
+		cl.Handler = uniqueFindings{Handler: cl.Handler, seen: make(map[Finding]bool)}
+	}
+	events := make(chan func(Client))
+	start := func(test string, run func(Client, context.Context) error) <-chan error {
+		direction := cl
+		// We apply the EventMask when delivering the events
+		direction.Settings.EventMask = EventAll
+		direction.Handler = directionHandler{test: test, events: events}
+		out := make(chan error, 1)
+		go func() {
+			out <- run(direction, ctx)
+		}()
+		return out
+	}
+	downloadErrs := start("download", Client.RunDownload)
+	uploadErrs := start("upload", Client.RunUpload)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	t0 := time.Now()
+	var downloadErr, uploadErr error
+	for downloadErrs != nil || uploadErrs != nil {
+		select {
+		case deliver := <-events:
+			deliver(cl)
+		case downloadErr = <-downloadErrs:
+			downloadErrs = nil
+		case uploadErr = <-uploadErrs:
+			uploadErrs = nil
+		case now := <-ticker.C:
+			cl.progress(PhaseBidirectional, now.Sub(t0))
+		}
+	}
+	if downloadErr != nil || uploadErr != nil {
+		return &BidirectionalError{Download: downloadErr, Upload: uploadErr}
+	}
+	cl.progress(PhaseFinalizing, cl.Settings.duration())
+	return nil
+}
+
+// BidirectionalResults summarizes a bidirectional test.
+type BidirectionalResults struct {
+	// Download summarizes the download.
+	Download *Results `json:"download"`
+
+	// Upload summarizes the upload.
+	Upload *Results `json:"upload"`
+}
+
+// bidirectionalRecorder is a Handler that collects the measurements of
+// each direction of a bidirectional test using a resultsRecorder.
+type bidirectionalRecorder struct {
+	download, upload resultsRecorder
+}
+
+func (br *bidirectionalRecorder) OnLogInfo(m LogMessage) {
+	switch m.Params["test"] {
+	case "download":
+		br.download.OnLogInfo(m)
+	case "upload":
+		br.upload.OnLogInfo(m)
+	}
+}
+
+func (br *bidirectionalRecorder) OnServerDownloadMeasurement(m Measurement) {
+	br.download.OnServerDownloadMeasurement(m)
+}
+
+func (br *bidirectionalRecorder) OnClientDownloadMeasurement(m Measurement) {
+	br.download.OnClientDownloadMeasurement(m)
+}
+
+func (br *bidirectionalRecorder) OnServerUploadMeasurement(m Measurement) {
+	br.upload.OnServerUploadMeasurement(m)
+}
+
+func (br *bidirectionalRecorder) OnClientUploadMeasurement(m Measurement) {
+	br.upload.OnClientUploadMeasurement(m)
+}
+
+func (br *bidirectionalRecorder) OnFinding(Finding) {}
+
+func (br *bidirectionalRecorder) OnProgress(Progress) {}
+
+// RunBidirectionalWithResults is like RunBidirectional but also returns the
+// BidirectionalResults, where each direction records its own failure.
+func (cl Client) RunBidirectionalWithResults(ctx context.Context) (*BidirectionalResults, error) {
+	br := &bidirectionalRecorder{}
+	br.download.warmUp = cl.Settings.warmUp()
+	br.upload.warmUp = cl.Settings.warmUp()
+	cl, closeSink := cl.withRecorder(br)
+	defer closeSink()
+	err := cl.RunBidirectional(ctx)
+	downloadErr, uploadErr := err, err
+	var be *BidirectionalError
+	if errors.As(err, &be) {
+		downloadErr, uploadErr = be.Download, be.Upload
+	}
+	err = cl.redactError(err)
+	downloadErr, uploadErr = cl.redactError(downloadErr), cl.redactError(uploadErr)
+	results := &BidirectionalResults{
+		Download: br.download.results("download", downloadErr),
+		Upload:   br.upload.results("upload", uploadErr),
+	}
+	results.Download.Diagnoses = Diagnose(results.Download)
+	results.Upload.Diagnoses = Diagnose(results.Upload)
+	return results, err
+}
@@ -0,0 +1,337 @@
+package nuvolari
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// Event is an event emitted by the channel based API. It is one of
+// LogEvent, MeasurementEvent, FindingEvent, ProgressEvent,
+// ConnectionSetupEvent, FailureEvent, DiagnosisEvent and SummaryEvent.
+type Event interface {
+	isEvent()
+}
+
+// LogEvent is emitted for each log message.
+type LogEvent struct {
+	LogMessage
+}
+
+// Measurement origins.
+const (
+	OriginClient = spec.OriginClient
+	OriginServer = spec.OriginServer
+)
+
+// MeasurementEvent is emitted for each measurement.
+type MeasurementEvent struct {
+	// Origin is either OriginClient or OriginServer.
+	Origin string
+
+	// Test is either "download" or "upload".
+	Test string
+
+	// Measurement is the measurement.
+	Measurement Measurement
+}
+
+// FindingEvent is emitted for each sign of middlebox interference.
+type FindingEvent struct {
+	Finding
+}
+
+// ProgressEvent is emitted to report the progress of the test.
+type ProgressEvent struct {
+	Progress
+}
+
+// ConnectionSetupEvent is emitted when we establish a connection, after
+// the LogEvent with code LogConnectionSetup carrying the same information.
+type ConnectionSetupEvent struct {
+	ConnectionSetup
+}
+
+// FailureEvent is emitted when the test fails, before closing the channel.
+type FailureEvent struct {
+	// Err is the error that occurred.
+	Err error
+}
+
+// DiagnosisEvent is emitted, when the test is over, for each sign of
+// traffic shaping or proxying in the measurements, before SummaryEvent.
+type DiagnosisEvent struct {
+	Diagnosis
+}
+
+// SummaryEvent is the last event, emitted when the test is over. The
+// channel returned by All has a SummaryEvent for each test.
+type SummaryEvent struct {
+	*Results
+}
+
+func (LogEvent) isEvent()             {}
+func (MeasurementEvent) isEvent()     {}
+func (FindingEvent) isEvent()         {}
+func (ProgressEvent) isEvent()        {}
+func (ConnectionSetupEvent) isEvent() {}
+func (FailureEvent) isEvent()         {}
+func (DiagnosisEvent) isEvent()       {}
+func (SummaryEvent) isEvent()         {}
+
+// maxPendingEvents is the number of queued events above which the
+// eventQueue drops log events and coalesces progress events.
+const maxPendingEvents = 256
+
+// eventQueue decouples the goroutine running the test, which pushes the
+// events without blocking, so that a slow consumer does not stall the I/O
+// and corrupt the measurement, from the goroutine delivering them.
+type eventQueue struct {
+	mu     sync.Mutex
+	events []Event
+	closed bool
+	wakeup chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{wakeup: make(chan struct{}, 1)}
+}
+
+// push queues ev. If the consumer falls behind, we drop log events and
+// replace the pending progress event, if any; we keep all other events.
+func (q *eventQueue) push(ev Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) >= maxPendingEvents {
+		switch ev.(type) {
+		case LogEvent:
+			return
+		case ProgressEvent:
+			for idx := len(q.events) - 1; idx >= 0; idx-- {
+				if _, ok := q.events[idx].(ProgressEvent); ok {
+					q.events[idx] = ev
+					return
+				}
+			}
+		}
+	}
+	q.events = append(q.events, ev)
+	q.signal()
+}
+
+// close tells the dispatcher that no more events will be pushed.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// abandonTimeout is how long, after ctx is done, we wait for the consumer
+// to read an event before assuming that it abandoned the channel.
+const abandonTimeout = time.Second
+
+// dispatch delivers the events on out and closes out after the queue has
+// been closed. When ctx is done, the consumer may be slow to drain out,
+// hence we drop the log and progress events that do not fit in the buffer
+// of out, and we wait up to abandonTimeout for the consumer to read each
+// other event, so that it knows how the test ended. If it does not read,
+// it abandoned the channel, hence we discard the remaining events.
+func (q *eventQueue) dispatch(ctx context.Context, out chan<- Event) {
+	defer close(out)
+	abandoned := false
+	for {
+		q.mu.Lock()
+		events, closed := q.events, q.closed
+		q.events = nil
+		q.mu.Unlock()
+		for _, ev := range events {
+			abandoned = abandoned || !deliver(ctx, out, ev)
+		}
+		if closed {
+			return
+		}
+		<-q.wakeup
+	}
+}
+
+// deliver posts ev on out and returns false if the consumer did not read
+// it within abandonTimeout after ctx is done.
+func deliver(ctx context.Context, out chan<- Event, ev Event) bool {
+	select {
+	case out <- ev:
+		return true
+	case <-ctx.Done():
+	}
+	switch ev.(type) {
+	case LogEvent, ProgressEvent:
+		select {
+		case out <- ev:
+		default:
+		}
+		return true
+	}
+	timer := time.NewTimer(abandonTimeout)
+	defer timer.Stop()
+	select {
+	case out <- ev:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// chanHandler is a Handler that converts the events and posts them using
+// send, e.g. on an eventQueue.
+type chanHandler struct {
+	send func(Event)
+}
+
+func (ch chanHandler) OnLogInfo(m LogMessage) {
+	ch.send(LogEvent{m})
+	if cs := ConnectionSetupOf(m); cs != nil {
+		ch.send(ConnectionSetupEvent{*cs})
+	}
+}
+
+func (ch chanHandler) OnServerDownloadMeasurement(m Measurement) {
+	ch.send(MeasurementEvent{Origin: OriginServer, Test: "download", Measurement: m})
+}
+
+func (ch chanHandler) OnClientDownloadMeasurement(m Measurement) {
+	ch.send(MeasurementEvent{Origin: OriginClient, Test: "download", Measurement: m})
+}
+
+func (ch chanHandler) OnServerUploadMeasurement(m Measurement) {
+	ch.send(MeasurementEvent{Origin: OriginServer, Test: "upload", Measurement: m})
+}
+
+func (ch chanHandler) OnClientUploadMeasurement(m Measurement) {
+	ch.send(MeasurementEvent{Origin: OriginClient, Test: "upload", Measurement: m})
+}
+
+func (ch chanHandler) OnFinding(f Finding) {
+	ch.send(FindingEvent{f})
+}
+
+func (ch chanHandler) OnProgress(p Progress) {
+	ch.send(ProgressEvent{p})
+}
+
+// summarize posts the events describing the outcome of a test.
+func (ch chanHandler) summarize(results *Results, err error) {
+	if err != nil {
+		ch.send(FailureEvent{Err: err})
+	}
+	if results != nil {
+		for _, d := range results.Diagnoses {
+			ch.send(DiagnosisEvent{d})
+		}
+	}
+	ch.send(SummaryEvent{results})
+}
+
+// runWithChannel runs the test using a chanHandler and returns the channel
+// where events are posted. The channel is closed when the test is over.
+func (cl Client) runWithChannel(ctx context.Context,
+	run func(Client, context.Context) (*Results, error)) <-chan Event {
+	out := make(chan Event, max(cl.Settings.EventBuffer, 0))
+	queue := newEventQueue()
+	handler := chanHandler{send: queue.push}
+	cl.Handler = handler
+	go queue.dispatch(ctx, out)
+	go func() {
+		defer queue.close()
+		results, err := run(cl, ctx)
+		handler.summarize(results, err)
+	}()
+	return out
+}
+
+// Download is like RunDownload except that it runs in the background and
+// posts the events on the returned channel, which is closed when the test
+// is over, instead of using the Handler. The caller must drain the channel
+// until it is closed, or cancel ctx to stop the test. After cancelling,
+// the caller may keep draining, to learn how the test ended, or abandon
+// the channel, in which case we close it shortly.
+func (cl Client) Download(ctx context.Context) <-chan Event {
+	return cl.runWithChannel(ctx, Client.RunDownloadWithResults)
+}
+
+// Upload is like Download but runs an upload test.
+func (cl Client) Upload(ctx context.Context) <-chan Event {
+	return cl.runWithChannel(ctx, Client.RunUploadWithResults)
+}
+
+// All is like Download but runs the tests of RunAll. When each test is
+// over, it posts a FailureEvent, if the test failed, and a SummaryEvent.
+func (cl Client) All(ctx context.Context) <-chan Event {
+	out := make(chan Event, max(cl.Settings.EventBuffer, 0))
+	queue := newEventQueue()
+	handler := chanHandler{send: queue.push}
+	cl.Handler = handler
+	go queue.dispatch(ctx, out)
+	go func() {
+		defer queue.close()
+		cl.runAll(ctx, handler.summarize)
+	}()
+	return out
+}
+
+// HandlerFromChannel returns a Handler that posts the events on ch, so
+// that code written for the channel based API (e.g. a user interface
+// updater) can consume the events of RunDownload and RunUpload. Posting
+// an event blocks until ch accepts it.
+func HandlerFromChannel(ch chan<- Event) Handler {
+	return chanHandler{send: func(ev Event) { ch <- ev }}
+}
+
+// ChannelFromHandler returns a channel on which one can post the events
+// of the channel based API (e.g. the ones of Download) to deliver them to
+// h, so that code written for the Handler can consume them. A background
+// goroutine delivers the events in order, until the channel is closed,
+// and then closes done. We ignore FailureEvent, DiagnosisEvent and
+// SummaryEvent, which have no Handler counterpart, and
+// ConnectionSetupEvent, which duplicates a LogEvent.
+func ChannelFromHandler(h Handler) (events chan<- Event, done <-chan struct{}) {
+	ch, finished := make(chan Event), make(chan struct{})
+	go func() {
+		defer close(finished)
+		for ev := range ch {
+			deliverEvent(h, ev)
+		}
+	}()
+	return ch, finished
+}
+
+// deliverEvent delivers ev using the corresponding method of h.
+func deliverEvent(h Handler, ev Event) {
+	switch ev := ev.(type) {
+	case LogEvent:
+		h.OnLogInfo(ev.LogMessage)
+	case MeasurementEvent:
+		switch {
+		case ev.Origin == OriginServer && ev.Test == "download":
+			h.OnServerDownloadMeasurement(ev.Measurement)
+		case ev.Origin == OriginClient && ev.Test == "download":
+			h.OnClientDownloadMeasurement(ev.Measurement)
+		case ev.Origin == OriginServer && ev.Test == "upload":
+			h.OnServerUploadMeasurement(ev.Measurement)
+		case ev.Origin == OriginClient && ev.Test == "upload":
+			h.OnClientUploadMeasurement(ev.Measurement)
+		}
+	case FindingEvent:
+		h.OnFinding(ev.Finding)
+	case ProgressEvent:
+		h.OnProgress(ev.Progress)
+	}
+}
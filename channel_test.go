@@ -0,0 +1,50 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDownloadCanceledDeliversOutcome(t *testing.T) {
+	cl := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var failure *FailureEvent
+	var summary *SummaryEvent
+	for ev := range cl.Download(ctx) {
+		switch ev := ev.(type) {
+		case MeasurementEvent:
+			cancel()
+		case FailureEvent:
+			failure = &ev
+		case SummaryEvent:
+			summary = &ev
+		}
+	}
+	if failure == nil || !errors.Is(failure.Err, ErrInterrupted) {
+		t.Fatalf("expected a FailureEvent with ErrInterrupted, got %+v", failure)
+	}
+	if summary == nil || summary.Results == nil {
+		t.Fatal("expected a SummaryEvent with the partial Results")
+	}
+}
+
+func TestAbandonedChannelDoesNotLeak(t *testing.T) {
+	cl := newTestClient(t)
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		<-cl.Download(ctx)
+		cancel()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Fatalf("goroutines leaked: %d => %d", baseline, n)
+	}
+}
@@ -0,0 +1,47 @@
+package nuvolari
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseError is returned when the server closes the connection using a
+// status code other than normal closure, e.g. 1011 (internal error) or
+// 1013 (try again later).
+type CloseError struct {
+	// Code is the WebSocket close status code.
+	Code int
+
+	// Reason is the reason sent by the server, if any.
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("Server closed the connection with status %d", e.Code)
+	}
+	return fmt.Sprintf("Server closed the connection with status %d: %s", e.Code, e.Reason)
+}
+
+// closeError maps err, returned when reading from a connection, to nil if
+// the server closed the connection normally and to a *CloseError if the
+// server closed the connection using another status code.
+func closeError(err error) error {
+	if ce, ok := err.(*websocket.CloseError); ok {
+		if ce.Code == websocket.CloseNormalClosure {
+			return nil
+		}
+		return &CloseError{Code: ce.Code, Reason: ce.Text}
+	}
+	return err
+}
+
+// closeNormally starts the closing handshake by sending a Close frame with
+// the normal closure status. The server will reply with its Close frame.
+func (cl Client) closeNormally(conn *websocket.Conn) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	deadline := time.Now().Add(timeout(cl.Settings.WriteTimeout))
+	return conn.WriteControl(websocket.CloseMessage, msg, deadline)
+}
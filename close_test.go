@@ -0,0 +1,142 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// newCloseTestClient starts a server that runs serve on the connection of
+// each test and returns a Client that runs one second long tests against it.
+func newCloseTestClient(t *testing.T, serve func(*websocket.Conn)) Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := http.Header{}
+		headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, headers)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Client{Settings: Settings{
+		Hostname: host,
+		Port:     port,
+		Scheme:   "ws",
+		Duration: time.Second,
+		WarmUp:   -1,
+	}}
+}
+
+// readClose reads until the peer closes the connection and returns the
+// close status code, or zero if the peer did not send a Close frame.
+func readClose(conn *websocket.Conn) int {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			return ce.Code
+		}
+		if err != nil {
+			return 0
+		}
+	}
+}
+
+func TestDownloadServerCloseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		code   ErrorCode
+	}{
+		{name: "normal closure", status: websocket.CloseNormalClosure},
+		{name: "try again later", status: websocket.CloseTryAgainLater, code: ErrorCodeServer},
+		{name: "policy violation", status: websocket.ClosePolicyViolation, code: ErrorCodeProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := newCloseTestClient(t, func(conn *websocket.Conn) {
+				msg := websocket.FormatCloseMessage(tt.status, "reason")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				readClose(conn)
+			})
+			err := cl.RunDownload(context.Background())
+			if tt.status == websocket.CloseNormalClosure {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var ce *CloseError
+			if !errors.As(err, &ce) || ce.Code != tt.status || ce.Reason != "reason" {
+				t.Fatalf("expected a CloseError with status %d, got %v", tt.status, err)
+			}
+			if code := ErrorCodeOf(err); code != tt.code {
+				t.Fatalf("expected error code %s, got %s", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestUploadSendsNormalClosure(t *testing.T) {
+	statuses := make(chan int, 1)
+	cl := newCloseTestClient(t, func(conn *websocket.Conn) {
+		statuses <- readClose(conn)
+	})
+	if err := cl.RunUpload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-statuses; status != websocket.CloseNormalClosure {
+		t.Fatalf("expected the client to send status %d, got %d",
+			websocket.CloseNormalClosure, status)
+	}
+}
+
+func TestInterruptedDownloadSendsNormalClosure(t *testing.T) {
+	statuses := make(chan int, 1)
+	cl := newCloseTestClient(t, func(conn *websocket.Conn) {
+		// Keep sending, so that the client notices the interruption
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1024)) != nil {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		statuses <- readClose(conn)
+		conn.Close()
+		<-done
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := cl.RunDownload(ctx); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+	if status := <-statuses; status != websocket.CloseNormalClosure {
+		t.Fatalf("expected the client to send status %d, got %d",
+			websocket.CloseNormalClosure, status)
+	}
+}
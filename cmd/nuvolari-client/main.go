@@ -1,14 +1,13 @@
+// Command nuvolari-client has been replaced by the nuvolari command, which
+// runs both download and upload tests with consistent flags. This command
+// only exists to tell users how to invoke nuvolari instead.
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
 	"os"
-	"os/signal"
-	"runtime"
-	"syscall"
+	"strings"
 
 	"github.com/bassosimone/nuvolari"
 )
@@ -16,52 +15,23 @@ import (
 var hostname = flag.String("hostname", "localhost", "Host to connect to")
 var port = flag.String("port", "", "Port to connect to")
 var skipTLSVerify = flag.Bool("skip-tls-verify", false, "Skip TLS verify")
-
-type myHandler struct {
-}
-
-func (myHandler) printMeasurement(s string, m nuvolari.Measurement) {
-	data, err := json.Marshal(m)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Printf("%s: %s\n", s, string(data))
-}
-
-func (myHandler) OnLogInfo(m string) {
-	log.Println(m)
-}
-
-func (mh myHandler) OnServerDownloadMeasurement(m nuvolari.Measurement) {
-	mh.printMeasurement("Server measurement", m)
-}
-
-func (mh myHandler) OnClientDownloadMeasurement(m nuvolari.Measurement) {
-	mh.printMeasurement("Client measurement", m)
-}
+var showVersion = flag.Bool("version", false, "Print the version and exit")
 
 func main() {
 	flag.Parse()
-	settings := nuvolari.Settings{}
-	settings.Hostname = *hostname
-	settings.Port = *port
-	settings.SkipTLSVerify = *skipTLSVerify
-	clnt := nuvolari.Client{
-		Settings: settings,
-		Handler: myHandler{},
+	if *showVersion {
+		fmt.Printf("nuvolari-client %s\n", nuvolari.Version())
+		return
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	sigs := make(chan os.Signal, 1)
-	defer close(sigs)
-	if runtime.GOOS != "windows" {
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		go func() {
-			<-sigs   // Wait for a signal to appear
-			cancel() // Cancel pending download
-		}()
+	args := []string{"nuvolari", "download", "-hostname", *hostname}
+	if *port != "" {
+		args = append(args, "-port", *port)
 	}
-	err := clnt.RunDownload(ctx)
-	if err != nil {
-		log.Fatal(err)
+	if *skipTLSVerify {
+		args = append(args, "-skip-tls-verify")
 	}
+	fmt.Fprintf(os.Stderr, "nuvolari-client: this command has been replaced by nuvolari\n")
+	fmt.Fprintf(os.Stderr, "nuvolari-client: please run instead: %s\n", strings.Join(args, " "))
+	fmt.Fprintf(os.Stderr, "nuvolari-client: see `nuvolari -help` for more options\n")
+	os.Exit(1)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+var (
+	activeRequests = expvar.NewMap("active_requests")
+	totalRequests  = expvar.NewMap("total_requests")
+)
+
+// otherRequests is the key under which we count the requests for paths
+// other than the ndt7 ones.
+const otherRequests = "other"
+
+// requestKey returns the key under which we count a request for path. We
+// only use the ndt7 paths as keys, so that clients requesting arbitrary
+// paths cannot grow the maps without bounds.
+func requestKey(path string) string {
+	switch path {
+	case spec.DownloadURLPath, spec.UploadURLPath:
+		return path
+	default:
+		return otherRequests
+	}
+}
+
+// countRequests wraps h to count total and active requests by path.
+func countRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r.URL.Path)
+		totalRequests.Add(key, 1)
+		activeRequests.Add(key, 1)
+		defer activeRequests.Add(key, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// errAdminNotLoopback indicates that the admin address is not loopback.
+var errAdminNotLoopback = errors.New("Admin address must be a loopback address")
+
+// startAdminServer exposes pprof and expvar on address, which must be a
+// loopback address, so operators can debug a long running process.
+func startAdminServer(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errAdminNotLoopback
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin endpoints listening on: %s", listener.Addr().String())
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bassosimone/nuvolari/server"
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+func TestCountRequestsUsesKnownPaths(t *testing.T) {
+	srv := httptest.NewServer(countRequests(server.NewServeMux()))
+	defer srv.Close()
+	before := requestCount(otherRequests)
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(fmt.Sprintf("%s/random/%d", srv.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// A plain GET is not a WebSocket upgrade, so the server refuses it,
+	// but we still count it under the ndt7 path.
+	resp, err := http.Get(srv.URL + spec.DownloadURLPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var keys []string
+	totalRequests.Do(func(kv expvar.KeyValue) {
+		keys = append(keys, kv.Key)
+	})
+	for _, key := range keys {
+		if key != otherRequests && key != spec.DownloadURLPath && key != spec.UploadURLPath {
+			t.Errorf("unexpected key %q", key)
+		}
+	}
+	if count := requestCount(otherRequests) - before; count != 10 {
+		t.Errorf("expected 10 other requests, got %d", count)
+	}
+}
+
+// requestCount returns the total number of requests counted under key.
+func requestCount(key string) int64 {
+	if v, ok := totalRequests.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
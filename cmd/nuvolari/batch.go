@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+)
+
+// planEntry is a test to run in batch mode.
+type planEntry struct {
+	// Hostname is the optional hostname of the server. If empty, we use
+	// the value of the -hostname flag.
+	Hostname string `json:"hostname"`
+
+	// Port is the optional port of the server.
+	Port string `json:"port"`
+
+	// Test is the test to run: "download", "upload", "both" or
+	// "bidirectional".
+	Test string `json:"test"`
+
+	// Duration is the optional duration of each test (e.g. "5s").
+	Duration string `json:"duration"`
+
+	// Tags are copied into the results, to identify them.
+	Tags map[string]string `json:"tags"`
+}
+
+// readPlan reads a test plan from r. The plan is either a JSON array of
+// entries or a sequence of entries, e.g. one per line (JSONL).
+func readPlan(r io.Reader) ([]planEntry, error) {
+	var plan []planEntry
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return plan, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var entries []planEntry
+			if err := json.Unmarshal(raw, &entries); err != nil {
+				return nil, err
+			}
+			plan = append(plan, entries...)
+			continue
+		}
+		var entry planEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, err
+		}
+		plan = append(plan, entry)
+	}
+}
+
+// tests returns the names of the tests of the entry.
+func (e planEntry) tests() ([]string, error) {
+	switch e.Test {
+	case "download", "upload", "bidirectional":
+		return []string{e.Test}, nil
+	case "both":
+		return []string{"download", "upload"}, nil
+	}
+	return nil, fmt.Errorf("batch: invalid test: %q", e.Test)
+}
+
+// runEntryTest runs a test of entry using settings as a template.
+func runEntryTest(ctx context.Context, settings nuvolari.Settings, session string,
+	entry planEntry, test string, run int) ([]testResult, error) {
+	if entry.Hostname != "" {
+		settings.Hostname = entry.Hostname
+	}
+	if entry.Port != "" {
+		settings.Port = entry.Port
+	}
+	if entry.Duration != "" {
+		duration, err := time.ParseDuration(entry.Duration)
+		if err != nil {
+			return nil, err
+		}
+		settings.Duration = duration
+	}
+	results, err := runTest(ctx, settings, session, test, run, nil)
+	for idx := range results {
+		results[idx].Tags = entry.Tags
+	}
+	return results, err
+}
+
+// runBatch runs the tests of a plan read from a file or stdin in sequence
+// and prints a JSON summary where the results contain the tags of the
+// corresponding entries.
+func runBatch(args []string) error {
+	fs := newFlagSet("batch")
+	settings := addClientFlags(fs)
+	planFile := fs.String("plan", "-", "File containing the test plan (- for stdin)")
+	sessionFlag := fs.String("session-id", "", "Session ID grouping the results (default: random)")
+	parseClientFlags(fs, args, settings)
+	r := os.Stdin
+	if *planFile != "-" {
+		fp, err := os.Open(*planFile)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	plan, err := readPlan(r)
+	if err != nil {
+		return err
+	}
+	for _, entry := range plan {
+		if _, err := entry.tests(); err != nil {
+			return err
+		}
+	}
+	session, err := sessionID(*sessionFlag)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	var results []testResult
+	failures := 0
+	for idx, entry := range plan {
+		tests, _ := entry.tests()
+		for _, test := range tests {
+			entryResults, err := runEntryTest(ctx, *settings, session, entry, test, idx+1)
+			if err != nil {
+				failures++
+			}
+			for _, result := range entryResults {
+				saveHistory(result)
+			}
+			results = append(results, entryResults...)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	data, err := json.Marshal(summary{Version: nuvolari.Version(), Results: results})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(data))
+	if failures > 0 {
+		return fmt.Errorf("batch: %d tests failed", failures)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bassosimone/nuvolari/units"
+)
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// isTerminal tells whether fp is a terminal.
+func isTerminal(fp *os.File) bool {
+	info, err := fp.Stat()
+	return err == nil && (info.Mode()&os.ModeCharDevice) != 0
+}
+
+// useColor tells whether we should colorize the human output, which is
+// written on stderr. See https://no-color.org/ for NO_COLOR.
+func useColor() bool {
+	_, found := os.LookupEnv("NO_COLOR")
+	return !*noColor && !found && *format == "human" && isTerminal(os.Stderr)
+}
+
+// colorize wraps s with the specified color, if colors are enabled.
+func colorize(color, s string) string {
+	if !useColor() {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// bitrateFlag is a flag containing a bit-rate, e.g. "50Mbit".
+type bitrateFlag float64
+
+func (bf *bitrateFlag) String() string {
+	return units.FormatBitrate(float64(*bf))
+}
+
+func (bf *bitrateFlag) Set(s string) error {
+	value, err := units.ParseBitrate(s)
+	if err != nil {
+		return err
+	}
+	*bf = bitrateFlag(value)
+	return nil
+}
+
+var slowThreshold = bitrateFlag(10e06)
+var fastThreshold = bitrateFlag(50e06)
+
+func init() {
+	flag.Var(&slowThreshold, "slow-threshold", "Speeds below this bit-rate are shown in red")
+	flag.Var(&fastThreshold, "fast-threshold", "Speeds above this bit-rate are shown in green")
+}
+
+// throughputColor returns the color to use for the speed in bit/s.
+func throughputColor(speed float64) string {
+	switch {
+	case speed < float64(slowThreshold):
+		return colorRed
+	case speed < float64(fastThreshold):
+		return colorYellow
+	default:
+		return colorGreen
+	}
+}
+
+// warnf logs a warning.
+func warnf(format string, v ...interface{}) {
+	log.Print(colorize(colorYellow, "warning: "+fmt.Sprintf(format, v...)))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+
+	"github.com/bassosimone/nuvolari"
+)
+
+// errorReport is emitted on stderr when failing in machine formats mode.
+type errorReport struct {
+	// Class is the class of the error (e.g. "dns", "timeout").
+	Class string `json:"class"`
+
+	// Code is the stable numeric code of the error (see nuvolari.ErrorCode).
+	Code int `json:"code"`
+
+	// Message is the error message.
+	Message string `json:"message"`
+
+	// Retryable indicates whether running again may succeed.
+	Retryable bool `json:"retryable"`
+}
+
+// classifyError maps err to its class and tells whether it is retryable.
+func classifyError(err error) (string, bool) {
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return "dns", !dnsError.IsNotFound
+	}
+	code := nuvolari.ErrorCodeOf(err)
+	return code.String(), code.Retryable()
+}
+
+// machineFormat indicates whether the output must be machine readable.
+func machineFormat() bool {
+	return *format == "json" || *summaryOnly
+}
+
+// errorMessage returns the message of err, redacted in privacy mode.
+func errorMessage(err error) string {
+	if *privacy {
+		return nuvolari.RedactAddresses(err.Error())
+	}
+	return err.Error()
+}
+
+// fatal reports err and exits. In machine formats mode, err is reported
+// as a single JSON object on stderr; otherwise we just log it.
+func fatal(err error) {
+	if !machineFormat() {
+		log.Fatal(colorize(colorRed, errorMessage(err)))
+	}
+	class, retryable := classifyError(err)
+	data, merr := json.Marshal(errorReport{
+		Class:     class,
+		Code:      int(nuvolari.ErrorCodeOf(err)),
+		Message:   errorMessage(err),
+		Retryable: retryable,
+	})
+	if merr != nil {
+		log.Fatal(err)
+	}
+	os.Stderr.Write(append(data, '\n'))
+	os.Exit(1)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+	"github.com/bassosimone/nuvolari/stats"
+	"github.com/bassosimone/nuvolari/units"
+)
+
+// outputEvent is an event emitted when using the json format.
+type outputEvent struct {
+	// Session identifies the session to which the event belongs.
+	Session string `json:"session,omitempty"`
+
+	// Type is the type of the event.
+	Type string `json:"type"`
+
+	// Message is the message of log events.
+	Message string `json:"message,omitempty"`
+
+	// Code is the code of log events.
+	Code string `json:"code,omitempty"`
+
+	// Params contains the params of log events.
+	Params map[string]string `json:"params,omitempty"`
+
+	// Measurement is the measurement of measurement events.
+	Measurement *nuvolari.Measurement `json:"measurement,omitempty"`
+
+	// Finding is the finding of finding events.
+	Finding *nuvolari.Finding `json:"finding,omitempty"`
+
+	// Progress is the progress of progress events.
+	Progress *nuvolari.Progress `json:"progress,omitempty"`
+
+	// TestID identifies the test of log events.
+	TestID string `json:"test_id,omitempty"`
+}
+
+type myHandler struct {
+	// result is where we save the latest measurements.
+	result *testResult
+
+	// tui is the optional terminal user interface.
+	tui *tui
+}
+
+func (mh myHandler) emit(ev outputEvent) {
+	ev.Session = mh.result.Session
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", string(data))
+}
+
+func (mh myHandler) printMeasurement(s string, m nuvolari.Measurement) {
+	if *summaryOnly {
+		return
+	}
+	if *format == "json" {
+		mh.emit(outputEvent{Type: s, Measurement: &m})
+		return
+	}
+	if m.Stream != 0 {
+		s = fmt.Sprintf("%s[%d]", s, m.Stream)
+	}
+	if ci := m.ConnectionInfo; ci != nil {
+		log.Printf("%s: client=%s server=%s mss=%d sndbuf=%d rcvbuf=%d\n", s, ci.Client,
+			ci.Server, ci.MSS, ci.SendBufferSize, ci.ReceiveBufferSize)
+		if ci.UUID != "" {
+			log.Printf("%s: uuid=%s\n", s, ci.UUID)
+		}
+		if ci.CongestionControl != "" {
+			log.Printf("%s: congestion_control=%s\n", s, ci.CongestionControl)
+		}
+		if ci.TLSVersion != "" {
+			log.Printf("%s: tls_version=%s cipher_suite=%s alpn=%q tls_resumed=%v\n", s,
+				ci.TLSVersion, ci.CipherSuite, ci.ALPN, ci.TLSResumed)
+		}
+	}
+	if len(m.AppRTT) > 0 {
+		log.Printf("%s: app_rtt=%.2f ms (%d samples)\n", s, stats.Min(m.AppRTT), len(m.AppRTT))
+	}
+	if m.BBRInfo != nil {
+		bw := m.BBRInfo.MaxBandwidth
+		log.Printf("%s: elapsed=%.2f s max_bandwidth=%s min_rtt=%.2f ms\n", s, m.Elapsed,
+			colorize(throughputColor(bw), units.FormatBitrate(bw)), m.BBRInfo.MinRTT)
+		return
+	}
+	if s == "client-upload-measurement" && m.NumBytes > 0 && m.Elapsed > 0 &&
+		m.TCPInfo != nil && m.TCPInfo.BytesAcked > 0 {
+		speed := float64(m.TCPInfo.BytesAcked) * 8 / m.Elapsed
+		log.Printf("%s: elapsed=%.2f s num_bytes=%s delivered=%s speed=%s\n", s, m.Elapsed,
+			units.FormatBytes(m.NumBytes), units.FormatBytes(m.TCPInfo.BytesAcked),
+			colorize(throughputColor(speed), units.FormatBitrate(speed)))
+		return
+	}
+	if m.NumBytes > 0 && m.Elapsed > 0 {
+		speed := float64(m.NumBytes) * 8 / m.Elapsed
+		log.Printf("%s: elapsed=%.2f s num_bytes=%s speed=%s\n", s, m.Elapsed,
+			units.FormatBytes(m.NumBytes), colorize(throughputColor(speed), units.FormatBitrate(speed)))
+		return
+	}
+	log.Printf("%s: elapsed=%.2f s\n", s, m.Elapsed)
+}
+
+func (mh myHandler) OnLogInfo(m nuvolari.LogMessage) {
+	mh.result.setConnection(m)
+	if *summaryOnly {
+		return
+	}
+	if mh.tui != nil {
+		mh.tui.Log(m.Message)
+		return
+	}
+	if *format == "json" {
+		mh.emit(outputEvent{Type: "log", Message: m.Message, Code: m.Code, Params: m.Params,
+			TestID: m.TestID})
+		return
+	}
+	log.Println(m.Message)
+}
+
+func (mh myHandler) OnServerDownloadMeasurement(m nuvolari.Measurement) {
+	mh.result.setTestID(m.TestID)
+	mh.result.ServerMeasurement = &m
+	if mh.tui != nil {
+		mh.tui.OnServerMeasurement(m)
+		return
+	}
+	mh.printMeasurement("server-download-measurement", m)
+}
+
+func (mh myHandler) OnClientDownloadMeasurement(m nuvolari.Measurement) {
+	mh.result.setTestID(m.TestID)
+	if m.ConnectionInfo != nil {
+		mh.result.ConnectionInfo = m.ConnectionInfo
+	}
+	// The measurements aggregating multiple streams lack TCP_INFO
+	if m.TCPInfo != nil {
+		mh.result.numIntervals++
+		if m.RwndLimited {
+			mh.result.numRwndLimited++
+		}
+	}
+	if m.Stream != 0 {
+		mh.result.addStream(m)
+		mh.printMeasurement("client-download-measurement", m)
+		return
+	}
+	mh.result.ClientMeasurement = &m
+	if mh.tui != nil {
+		mh.tui.OnClientMeasurement(m)
+		return
+	}
+	mh.printMeasurement("client-download-measurement", m)
+}
+
+func (mh myHandler) OnServerUploadMeasurement(m nuvolari.Measurement) {
+	mh.result.setTestID(m.TestID)
+	mh.result.ServerMeasurement = &m
+	if mh.tui != nil {
+		mh.tui.OnServerMeasurement(m)
+		return
+	}
+	mh.printMeasurement("server-upload-measurement", m)
+}
+
+func (mh myHandler) OnClientUploadMeasurement(m nuvolari.Measurement) {
+	mh.result.setTestID(m.TestID)
+	if m.ConnectionInfo != nil {
+		mh.result.ConnectionInfo = m.ConnectionInfo
+	}
+	if m.Stream != 0 {
+		mh.result.addStream(m)
+		mh.printMeasurement("client-upload-measurement", m)
+		return
+	}
+	mh.result.ClientMeasurement = &m
+	if mh.tui != nil {
+		mh.tui.OnClientMeasurement(m)
+		return
+	}
+	mh.printMeasurement("client-upload-measurement", m)
+}
+
+func (mh myHandler) OnFinding(f nuvolari.Finding) {
+	mh.result.Findings = append(mh.result.Findings, f)
+	if *summaryOnly {
+		return
+	}
+	if mh.tui != nil {
+		mh.tui.Log("warning: possible interference: " + f.Code + ": " + f.Detail)
+		return
+	}
+	if *format == "json" {
+		mh.emit(outputEvent{Type: "finding", Finding: &f})
+		return
+	}
+	warnf("possible interference: %s: %s", f.Code, f.Detail)
+}
+
+func (mh myHandler) OnProgress(p nuvolari.Progress) {
+	if mh.tui != nil {
+		mh.tui.OnProgress(p)
+		return
+	}
+	if *format == "json" && !*summaryOnly {
+		mh.emit(outputEvent{Type: "progress", Progress: &p})
+	}
+}
+
+// bidirectionalHandler routes the events of a bidirectional test to the
+// handler of the corresponding test. Logs, findings and progress concern
+// the whole test, hence we print them once using the download handler.
+type bidirectionalHandler struct {
+	download, upload myHandler
+}
+
+func (bh bidirectionalHandler) OnLogInfo(m nuvolari.LogMessage) {
+	bh.upload.result.setConnection(m)
+	bh.download.OnLogInfo(m)
+}
+
+func (bh bidirectionalHandler) OnServerDownloadMeasurement(m nuvolari.Measurement) {
+	bh.download.OnServerDownloadMeasurement(m)
+}
+
+func (bh bidirectionalHandler) OnClientDownloadMeasurement(m nuvolari.Measurement) {
+	bh.download.OnClientDownloadMeasurement(m)
+}
+
+func (bh bidirectionalHandler) OnServerUploadMeasurement(m nuvolari.Measurement) {
+	bh.upload.OnServerUploadMeasurement(m)
+}
+
+func (bh bidirectionalHandler) OnClientUploadMeasurement(m nuvolari.Measurement) {
+	bh.upload.OnClientUploadMeasurement(m)
+}
+
+func (bh bidirectionalHandler) OnFinding(f nuvolari.Finding) {
+	bh.upload.result.Findings = append(bh.upload.result.Findings, f)
+	bh.download.OnFinding(f)
+}
+
+func (bh bidirectionalHandler) OnProgress(p nuvolari.Progress) {
+	bh.download.OnProgress(p)
+}
+
+// sequentialHandler routes the events of tests running one after the other,
+// like the uploads of -check-compression, to the handler of each test. We
+// move to the next handler when the TestID of the events changes, which is
+// also when the previous test ended and the next one started.
+type sequentialHandler struct {
+	handlers []myHandler
+
+	mu      sync.Mutex
+	current int
+	testID  string
+}
+
+// route returns the handler of the test with the given TestID.
+func (sh *sequentialHandler) route(testID string) myHandler {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if testID != "" && testID != sh.testID {
+		if sh.testID != "" && sh.current < len(sh.handlers)-1 {
+			now := time.Now()
+			previous := sh.handlers[sh.current].result
+			previous.Elapsed = now.Sub(previous.Time).Seconds()
+			sh.current++
+			sh.handlers[sh.current].result.Time = now
+		}
+		sh.testID = testID
+	}
+	return sh.handlers[sh.current]
+}
+
+func (sh *sequentialHandler) OnLogInfo(m nuvolari.LogMessage) {
+	sh.route(m.TestID).OnLogInfo(m)
+}
+
+func (sh *sequentialHandler) OnServerDownloadMeasurement(m nuvolari.Measurement) {
+	sh.route(m.TestID).OnServerDownloadMeasurement(m)
+}
+
+func (sh *sequentialHandler) OnClientDownloadMeasurement(m nuvolari.Measurement) {
+	sh.route(m.TestID).OnClientDownloadMeasurement(m)
+}
+
+func (sh *sequentialHandler) OnServerUploadMeasurement(m nuvolari.Measurement) {
+	sh.route(m.TestID).OnServerUploadMeasurement(m)
+}
+
+func (sh *sequentialHandler) OnClientUploadMeasurement(m nuvolari.Measurement) {
+	sh.route(m.TestID).OnClientUploadMeasurement(m)
+}
+
+func (sh *sequentialHandler) OnFinding(f nuvolari.Finding) {
+	sh.route(f.TestID).OnFinding(f)
+}
+
+func (sh *sequentialHandler) OnProgress(p nuvolari.Progress) {
+	sh.route(p.TestID).OnProgress(p)
+}
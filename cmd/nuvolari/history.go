@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func defaultHistoryFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "nuvolari", "history.jsonl")
+}
+
+// saveHistory appends a new entry to the history file. Failing to save
+// the history is not fatal, hence we just log the error.
+func saveHistory(entry testResult) {
+	if *historyFile == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		warnf("cannot marshal history entry: %s", err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(*historyFile), 0755); err != nil {
+		warnf("cannot create history directory: %s", err.Error())
+		return
+	}
+	fp, err := os.OpenFile(*historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		warnf("cannot open history file: %s", err.Error())
+		return
+	}
+	defer fp.Close()
+	if _, err := fp.Write(append(data, '\n')); err != nil {
+		warnf("cannot write history file: %s", err.Error())
+	}
+}
+
+func readHistory() ([]testResult, error) {
+	fp, err := os.Open(*historyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var entries []testResult
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var entry testResult
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func runHistory(args []string) error {
+	fs := newFlagSet("history")
+	count := fs.Int("n", 10, "Number of entries to show (0 for all)")
+	fs.Parse(args)
+	if *historyFile == "" {
+		return fmt.Errorf("history is disabled")
+	}
+	entries, err := readHistory()
+	if err != nil {
+		return err
+	}
+	if *count > 0 && len(entries) > *count {
+		entries = entries[len(entries)-*count:]
+	}
+	for _, entry := range entries {
+		if *format == "json" {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", string(data))
+			continue
+		}
+		status := "ok"
+		if entry.Error != "" {
+			status = entry.Error
+		}
+		fmt.Printf("%s  %-8s  %s  %6.2f s  %s\n", entry.Time.Format(time.RFC3339),
+			entry.Test, entry.Hostname, entry.Elapsed, status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/bassosimone/nuvolari/locate"
+)
+
+// locateEntry is a server printed by the locate subcommand.
+type locateEntry struct {
+	locate.Result
+
+	// Session identifies the session, to pass to -session-id.
+	Session string `json:"session"`
+
+	// Hostname is the hostname to pass to -hostname.
+	Hostname string `json:"hostname"`
+
+	// Metro is the metro code of the server.
+	Metro string `json:"metro"`
+
+	// ConnectRTT is the TCP connect time in milliseconds.
+	ConnectRTT float64 `json:"connect_rtt,omitempty"`
+
+	// Error is the error that occurred when connecting, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// measureConnectRTT measures how much time it takes to establish a TCP
+// connection with hostname, which is a rough estimate of the RTT.
+func measureConnectRTT(ctx context.Context, hostname string) (time.Duration, error) {
+	var dialer net.Dialer
+	t0 := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(hostname, "443"))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Now().Sub(t0)
+	conn.Close()
+	return rtt, nil
+}
+
+func runLocate(args []string) error {
+	fs := newFlagSet("locate")
+	locateURL := fs.String("url", locate.DefaultURL, "Locate API URL")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for each operation")
+	sessionFlag := fs.String("session-id", "", "Session ID grouping the results (default: random)")
+	fs.Parse(args)
+	session, err := sessionID(*sessionFlag)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	queryCtx, queryCancel := context.WithTimeout(ctx, *timeout)
+	defer queryCancel()
+	results, err := locate.Client{URL: *locateURL}.Nearest(queryCtx)
+	if err != nil {
+		return err
+	}
+	var entries []locateEntry
+	for _, r := range results {
+		entry := locateEntry{Result: r, Session: session, Hostname: r.Hostname(), Metro: r.Metro()}
+		dialCtx, dialCancel := context.WithTimeout(ctx, *timeout)
+		rtt, err := measureConnectRTT(dialCtx, entry.Hostname)
+		dialCancel()
+		if err != nil {
+			entry.Error = errorMessage(err)
+		} else {
+			entry.ConnectRTT = float64(rtt) / float64(time.Millisecond)
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Error != "" || entries[j].Error != "" {
+			return entries[i].Error == ""
+		}
+		return entries[i].ConnectRTT < entries[j].ConnectRTT
+	})
+	if *format != "json" {
+		fmt.Printf("session: %s (pass it to -session-id)\n", session)
+	}
+	for _, entry := range entries {
+		if *format == "json" {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", string(data))
+			continue
+		}
+		where := ""
+		if entry.Location != nil {
+			where = entry.Location.City + ", " + entry.Location.Country
+		}
+		rtt := fmt.Sprintf("%8.2f ms", entry.ConnectRTT)
+		if entry.Error != "" {
+			rtt = "  unreachable"
+		}
+		fmt.Printf("%-4s %s %s (%s)\n", entry.Metro, rtt, entry.Hostname, where)
+		var templates []string
+		for template := range entry.URLs {
+			templates = append(templates, template)
+		}
+		sort.Strings(templates)
+		for _, template := range templates {
+			fmt.Printf("     %s => %s\n", template, entry.URLs[template])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Command nuvolari is a ndt7 client. It is organized in subcommands, each
+// with its own flags, sharing a small set of global options.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bassosimone/nuvolari"
+)
+
+// command is a nuvolari subcommand.
+type command struct {
+	// name is the name of the subcommand.
+	name string
+
+	// description is a one-line description of the subcommand.
+	description string
+
+	// run runs the subcommand with the specified arguments.
+	run func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"download", "Run a ndt7 download test", runDownload},
+		{"upload", "Run a ndt7 upload test", runUpload},
+		{"both", "Run a ndt7 download test followed by an upload test", runBoth},
+		{"bidirectional", "Run a ndt7 download and upload test concurrently", runBidirectional},
+		{"batch", "Run the tests of a JSON test plan", runBatch},
+		{"locate", "List the ndt7 servers closest to you", runLocate},
+		{"serve", "Run a local ndt7 server for testing", runServe},
+		{"selftest", "Run end-to-end checks against a server", runSelftest},
+		{"history", "Show the results of previous tests", runHistory},
+	}
+}
+
+var format = flag.String("format", "human", "Output format: human, json or tui")
+var summaryOnly = flag.Bool("summary-only", false, "Only print a JSON summary at the end")
+var noColor = flag.Bool("no-color", false, "Disable colors in human output")
+var privacy = flag.Bool("privacy", false, "Truncate client addresses in the output and history")
+var showVersion = flag.Bool("version", false, "Print the version and exit")
+var historyFile = flag.String("history-file", defaultHistoryFile(), "File where to save results (empty to disable)")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: nuvolari [global flags] <command> [command flags]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nglobal flags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nrun `nuvolari <command> -help` for the command flags\n")
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: nuvolari [global flags] %s [flags]\n\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *format != "human" && *format != "json" && *format != "tui" {
+		fmt.Fprintf(os.Stderr, "nuvolari: invalid format: %s\n", *format)
+		os.Exit(2)
+	}
+	if *showVersion {
+		vi := nuvolari.Version()
+		fmt.Printf("nuvolari %s (ndt7 spec: %s)\n", vi, vi.Spec)
+		return
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			if err := c.run(flag.Args()[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "nuvolari: unknown command: %s\n\n", flag.Arg(0))
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+	"github.com/bassosimone/nuvolari/stats"
+	"github.com/bassosimone/nuvolari/units"
+)
+
+// testResult is the result of a test.
+type testResult struct {
+	// Session identifies the session to which the test belongs.
+	Session string `json:"session"`
+
+	// Time is the time when the test started.
+	Time time.Time `json:"time"`
+
+	// Run is the run number when repeating tests.
+	Run int `json:"run,omitempty"`
+
+	// Test is the name of the test (e.g. "download").
+	Test string `json:"test"`
+
+	// TestID identifies the test in the events and in the server archives.
+	TestID string `json:"test_id,omitempty"`
+
+	// Bidirectional indicates that the download and the upload ran
+	// concurrently, in which case the summary contains both results.
+	Bidirectional bool `json:"bidirectional,omitempty"`
+
+	// Hostname is the hostname of the server.
+	Hostname string `json:"hostname"`
+
+	// Port is the port of the server.
+	Port string `json:"port,omitempty"`
+
+	// Elapsed is the number of seconds the test lasted.
+	Elapsed float64 `json:"elapsed"`
+
+	// Error is the error that occurred, if any.
+	Error string `json:"error,omitempty"`
+
+	// ErrorCode is the stable name of the class of the error, if any.
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// ConnectionInfo is the client view of the connection, if known.
+	ConnectionInfo *nuvolari.ConnectionInfo `json:"connection_info,omitempty"`
+
+	// TLS describes the TLS connection, if any.
+	TLS *nuvolari.TLSInfo `json:"tls,omitempty"`
+
+	// ConnectionSetup breaks down the time to establish the connection.
+	ConnectionSetup *nuvolari.ConnectionSetup `json:"connection_setup,omitempty"`
+
+	// ServerMeasurement is the last server-side measurement, if any.
+	ServerMeasurement *nuvolari.Measurement `json:"server_measurement,omitempty"`
+
+	// ClientMeasurement is the last client-side measurement, if any. For
+	// multi-stream tests, it aggregates all the connections.
+	ClientMeasurement *nuvolari.Measurement `json:"client_measurement,omitempty"`
+
+	// Streams contains the results of each connection of multi-stream
+	// tests, according to the client-side measurements.
+	Streams []nuvolari.StreamResults `json:"streams,omitempty"`
+
+	// Tags are the tags of the batch mode entry, if any.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Findings contains signs of middlebox interference, if any.
+	Findings []nuvolari.Finding `json:"findings,omitempty"`
+
+	// RwndLimited is the fraction of the download intervals where the
+	// client receive window limited the throughput.
+	RwndLimited float64 `json:"rwnd_limited,omitempty"`
+
+	// Compressible indicates an upload using compressible data, which
+	// we run with -check-compression after the regular upload.
+	Compressible bool `json:"compressible,omitempty"`
+
+	// Diagnoses contains signs of traffic shaping or proxying, if any.
+	Diagnoses []nuvolari.Diagnosis `json:"diagnoses,omitempty"`
+
+	numIntervals, numRwndLimited int
+}
+
+// setTestID sets the TestID, unless already set.
+func (r *testResult) setTestID(id string) {
+	if r.TestID == "" {
+		r.TestID = id
+	}
+}
+
+// setConnection records the TLSInfo and the ConnectionSetup carried by m,
+// if any and if they concern the test, unless already set.
+func (r *testResult) setConnection(m nuvolari.LogMessage) {
+	if test := m.Params["test"]; test != "" && test != r.Test {
+		return
+	}
+	if info := nuvolari.TLSInfoOf(m); info != nil && r.TLS == nil {
+		r.TLS = info
+	}
+	if cs := nuvolari.ConnectionSetupOf(m); cs != nil && r.ConnectionSetup == nil {
+		r.ConnectionSetup = cs
+	}
+}
+
+// addStream records the client-side measurement m of a stream.
+func (r *testResult) addStream(m nuvolari.Measurement) {
+	for len(r.Streams) < m.Stream {
+		r.Streams = append(r.Streams, nuvolari.StreamResults{Stream: len(r.Streams) + 1})
+	}
+	sr := &r.Streams[m.Stream-1]
+	sr.NumBytes, sr.Elapsed = m.NumBytes, m.Elapsed
+	if sr.Elapsed > 0 {
+		sr.MeanThroughput = float64(sr.NumBytes) * 8 / sr.Elapsed
+	}
+}
+
+// metrics returns the metrics of the result, keyed by name. Speeds are in
+// bit/s, RTTs in milliseconds and times in seconds.
+func (r testResult) metrics() map[string]float64 {
+	metrics := map[string]float64{"elapsed": r.Elapsed}
+	if m := r.ClientMeasurement; m != nil && m.NumBytes > 0 && m.Elapsed > 0 {
+		metrics["speed"] = float64(m.NumBytes) * 8 / m.Elapsed
+	}
+	if m := r.ClientMeasurement; r.Test == "upload" && m != nil && m.TCPInfo != nil &&
+		m.TCPInfo.BytesAcked > 0 && m.Elapsed > 0 {
+		metrics["delivered_speed"] = float64(m.TCPInfo.BytesAcked) * 8 / m.Elapsed
+	}
+	if m := r.ServerMeasurement; m != nil && m.BBRInfo != nil {
+		metrics["max_bandwidth"] = m.BBRInfo.MaxBandwidth
+		metrics["min_rtt"] = m.BBRInfo.MinRTT
+	}
+	return metrics
+}
+
+// metricNames contains the names of the metrics in display order.
+var metricNames = []string{"elapsed", "speed", "delivered_speed", "max_bandwidth", "min_rtt"}
+
+// aggregate contains statistics of a metric across repeated runs.
+type aggregate struct {
+	// Test is the name of the test (e.g. "download").
+	Test string `json:"test"`
+
+	// Metric is the name of the metric (e.g. "speed").
+	Metric string `json:"metric"`
+
+	// Count is the number of runs where the metric was available.
+	Count int `json:"count"`
+
+	// Min is the minimum value.
+	Min float64 `json:"min"`
+
+	// Median is the median value.
+	Median float64 `json:"median"`
+
+	// Max is the maximum value.
+	Max float64 `json:"max"`
+}
+
+// aggregateResults computes the statistics of each metric of each test.
+func aggregateResults(results []testResult) []aggregate {
+	var tests []string
+	values := make(map[string]map[string][]float64)
+	for _, r := range results {
+		if r.Compressible {
+			continue // Not comparable with the other uploads
+		}
+		if values[r.Test] == nil {
+			tests = append(tests, r.Test)
+			values[r.Test] = make(map[string][]float64)
+		}
+		for name, value := range r.metrics() {
+			values[r.Test][name] = append(values[r.Test][name], value)
+		}
+	}
+	var aggregates []aggregate
+	for _, test := range tests {
+		for _, name := range metricNames {
+			v := values[test][name]
+			if len(v) <= 0 {
+				continue
+			}
+			aggregates = append(aggregates, aggregate{
+				Test:   test,
+				Metric: name,
+				Count:  len(v),
+				Min:    stats.Min(v),
+				Median: stats.Median(v),
+				Max:    stats.Max(v),
+			})
+		}
+	}
+	return aggregates
+}
+
+// formatMetric formats value of the named metric for humans.
+func formatMetric(name string, value float64) string {
+	switch name {
+	case "speed", "delivered_speed", "max_bandwidth":
+		return units.FormatBitrate(value)
+	case "min_rtt":
+		return fmt.Sprintf("%.2f ms", value)
+	default:
+		return fmt.Sprintf("%.2f s", value)
+	}
+}
+
+// printStatistics prints the table of per-run results and statistics.
+func printStatistics(results []testResult, aggregates []aggregate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "run\ttest\t%s\terror\n", strings.Join(metricNames, "\t"))
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s", r.Run, r.Test)
+		metrics := r.metrics()
+		for _, name := range metricNames {
+			if value, ok := metrics[name]; ok {
+				fmt.Fprintf(w, "\t%s", formatMetric(name, value))
+			} else {
+				fmt.Fprintf(w, "\t-")
+			}
+		}
+		fmt.Fprintf(w, "\t%s\n", r.Error)
+	}
+	w.Flush()
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "test\tmetric\tcount\tmin\tmedian\tmax\n")
+	for _, a := range aggregates {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", a.Test, a.Metric, a.Count,
+			formatMetric(a.Metric, a.Min), formatMetric(a.Metric, a.Median),
+			formatMetric(a.Metric, a.Max))
+	}
+	w.Flush()
+}
+
+// summary is printed at the end when using -summary-only.
+type summary struct {
+	// Version identifies the client that produced the results.
+	Version nuvolari.VersionInfo `json:"version"`
+
+	// Results contains the results of each test that was run.
+	Results []testResult `json:"results"`
+
+	// Aggregates contains statistics when repeating tests.
+	Aggregates []aggregate `json:"aggregates,omitempty"`
+}
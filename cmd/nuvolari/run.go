@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+	"github.com/bassosimone/nuvolari/collector"
+	"github.com/bassosimone/nuvolari/doh"
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// addClientFlags adds to fs the flags shared by all the test subcommands
+// and returns the settings that will be filled when parsing.
+func addClientFlags(fs *flag.FlagSet) *nuvolari.Settings {
+	settings := &nuvolari.Settings{
+		Metadata: nuvolari.MetadataSettings{
+			ClientName:    "nuvolari-cmd",
+			ClientVersion: nuvolari.Version().Version,
+		},
+	}
+	fs.StringVar(&settings.Hostname, "hostname", "localhost", "Host to connect to")
+	fs.BoolVar(&settings.AutoDiscover, "auto-discover", false, "Discover the closest server unless -hostname is set")
+	fs.StringVar(&settings.LocateURL, "locate-url", "", "Locate API URL used by -auto-discover")
+	fs.StringVar(&settings.Port, "port", "", "Port to connect to")
+	fs.Func("servers", "Comma separated hosts to try if connecting to -hostname fails", func(s string) error {
+		settings.Servers = strings.Split(s, ",")
+		return nil
+	})
+	fs.BoolVar(&settings.Reconnect, "reconnect", false, "Reconnect and continue the test after transient network errors")
+	fs.IntVar(&settings.Retry.MaxAttempts, "max-attempts", 0, "Maximum number of attempts to connect (default: one per server)")
+	fs.DurationVar(&settings.Retry.Backoff, "retry-backoff", 0, "Delay before retrying to connect, doubling at each attempt")
+	fs.DurationVar(&settings.Duration, "duration", 0, "Duration of each test (default: 10s, max: 60s)")
+	fs.BoolVar(&settings.SkipTLSVerify, "skip-tls-verify", false, "Skip TLS verify")
+	fs.BoolVar(&settings.DisableTLS, "disable-tls", false, "Use ws:// rather than wss://")
+	fs.StringVar(&settings.Scheme, "scheme", "", "URL scheme, either ws or wss (default: implied by -disable-tls and -port)")
+	fs.StringVar(&settings.DownloadPath, "download-path", "", "URL path of the download test (default: "+spec.DownloadURLPath+")")
+	fs.StringVar(&settings.UploadPath, "upload-path", "", "URL path of the upload test (default: "+spec.UploadURLPath+")")
+	fs.BoolVar(&settings.AllowInsecure, "allow-insecure", false, "Allow -skip-tls-verify and ws:// with non-loopback hosts")
+	fs.IntVar(&settings.Streams, "streams", 1, "Number of parallel connections to use")
+	fs.BoolVar(&settings.Adaptive, "adaptive", false, "End the download early when the speed converges")
+	fs.BoolVar(&settings.FallbackToNDT5, "ndt5-fallback", false, "Use ndt5 if the server does not support ndt7")
+	fs.DurationVar(&settings.DialTimeout, "dial-timeout", 0, "Timeout for connecting to the server (default: 7s)")
+	fs.DurationVar(&settings.ReadTimeout, "read-timeout", 0, "Timeout of each read during the download (default: 7s)")
+	fs.DurationVar(&settings.WriteTimeout, "write-timeout", 0, "Timeout of each write (default: 7s)")
+	fs.DurationVar(&settings.CloseTimeout, "close-timeout", 0, "Time to wait for the server to close the connection (default: 7s)")
+	fs.DurationVar(&settings.PingInterval, "ping-interval", 0, "Interval between WebSocket pings measuring the RTT (default: no pings)")
+	fs.Float64Var(&settings.MaxDownloadRate, "max-download-rate", 0, "Maximum download rate in bit/s (default: no limit)")
+	fs.Float64Var(&settings.MaxUploadRate, "max-upload-rate", 0, "Maximum upload rate in bit/s (default: no limit)")
+	fs.BoolVar(&settings.Deltas, "deltas", false, "Also report the bytes transferred since the previous client measurement")
+	fs.StringVar(&settings.SourceAddress, "source-address", "", "Local IP address from which to connect")
+	fs.StringVar(&settings.Interface, "interface", "", "Network interface through which to connect (Linux only)")
+	fs.StringVar(&settings.SOCKS5Proxy, "socks5-proxy", "", "SOCKS5 proxy to use (e.g. 127.0.0.1:9050 for Tor)")
+	fs.StringVar(&settings.DoHURL, "doh-url", "", "DNS-over-HTTPS server to use (e.g. "+doh.CloudflareURL+")")
+	fs.Func("dns-server", "DNS server to use (e.g. 1.1.1.1:53)", func(s string) error {
+		settings.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, s)
+			},
+		}
+		return nil
+	})
+	fs.Int64Var(&settings.MaxMessageSize, "max-message-size", 0, "Maximum size in bytes of the messages from the server (default: 16 MiB)")
+	fs.BoolVar(&settings.LowMemory, "low-memory", false, "Reduce memory usage")
+	fs.IntVar(&settings.GCPercent, "gc-percent", 0, "GOGC value to use while measuring")
+	fs.Int64Var(&settings.MemoryLimit, "memory-limit", 0, "Soft memory limit in bytes to use while measuring")
+	fs.StringVar(&settings.Upload.CongestionControl, "congestion-control", "", "TCP congestion control to use for uploading (Linux only)")
+	fs.IntVar(&settings.Upload.NotSentLowat, "notsent-lowat", 0, "TCP_NOTSENT_LOWAT in bytes to use for uploading (negative to disable)")
+	fs.Int64Var(&settings.Upload.Seed, "upload-seed", 0, "Seed of the pseudo-random upload payload, for byte-identical runs")
+	fs.Func("upload-pattern", "Fill the upload messages repeating this string instead of random data", func(s string) error {
+		settings.Upload.Pattern = []byte(s)
+		return nil
+	})
+	fs.IntVar(&settings.SendBufferSize, "sndbuf", 0, "Socket send buffer size in bytes")
+	fs.IntVar(&settings.ReceiveBufferSize, "rcvbuf", 0, "Socket receive buffer size in bytes")
+	fs.Func("metadata", "Comma separated key=value metadata to send to the server", func(s string) error {
+		settings.Metadata.Extra = make(map[string]string)
+		for _, pair := range strings.Split(s, ",") {
+			key, value, found := strings.Cut(pair, "=")
+			if !found || key == "" {
+				return errors.New("expected key=value")
+			}
+			settings.Metadata.Extra[key] = value
+		}
+		return nil
+	})
+	fs.StringVar(&settings.AccessToken, "access-token", "", "Access token for servers requiring one (default: the one from the Locate API)")
+	fs.StringVar(&settings.BearerToken, "bearer-token", "", "Bearer token for authenticated servers")
+	fs.StringVar(&settings.TLS.CAFile, "ca-file", "", "PEM file with the CAs to verify the server (default: system CAs)")
+	fs.StringVar(&settings.TLS.CertFile, "client-cert", "", "PEM file with the client certificate for mutual TLS")
+	fs.StringVar(&settings.TLS.KeyFile, "client-key", "", "PEM file with the client key for mutual TLS")
+	fs.Func("pin-sha256", "Comma separated base64 SHA-256 hashes of the server public keys to accept", func(s string) error {
+		settings.TLS.PinnedCertSHA256 = strings.Split(s, ",")
+		return nil
+	})
+	fs.Func("tls-min-version", "Minimum TLS version (e.g. 1.2, 1.3)", func(s string) (err error) {
+		settings.TLS.MinVersion, err = parseTLSVersion(s)
+		return
+	})
+	fs.Func("tls-ciphers", "Comma separated TLS 1.2 cipher suites to use", func(s string) (err error) {
+		settings.TLS.CipherSuites, err = parseCipherSuites(s)
+		return
+	})
+	return settings
+}
+
+// parseClientFlags parses args using fs and finalizes the settings.
+func parseClientFlags(fs *flag.FlagSet, args []string, settings *nuvolari.Settings) {
+	fs.Parse(args)
+	hostnameSet := false
+	fs.Visit(func(f *flag.Flag) {
+		hostnameSet = hostnameSet || f.Name == "hostname"
+	})
+	if settings.AutoDiscover && !hostnameSet {
+		settings.Hostname = ""
+	}
+}
+
+// interruptibleContext returns a context that is cancelled when the
+// user interrupts the program.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if runtime.GOOS != "windows" {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigs   // Wait for a signal to appear
+			cancel() // Cancel pending test
+		}()
+	}
+	return ctx, cancel
+}
+
+// sessionID returns id, if not empty, or a new session ID. Passing the
+// same -session-id to several invocations groups their results.
+func sessionID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	return nuvolari.NewSessionID()
+}
+
+// rwndLimitedWarning is the fraction of receive-window-limited download
+// intervals above which we warn the user.
+const rwndLimitedWarning = 0.5
+
+// runTest runs the specified test and returns its results, which are
+// two, for the download and the upload, when test is "bidirectional", and
+// for the uploads, when test is "upload" and settings.CheckCompression is
+// set. If recorder is not nil, it also receives all the events.
+func runTest(ctx context.Context, settings nuvolari.Settings, session, test string, run int,
+	recorder *collector.Recorder) ([]testResult, error) {
+	tests := []string{test}
+	if test == "bidirectional" {
+		tests = []string{"download", "upload"}
+	}
+	checkCompression := test == "upload" && settings.CheckCompression &&
+		len(settings.Upload.Pattern) <= 0
+	if checkCompression {
+		tests = []string{"upload", "upload"}
+	}
+	now := time.Now()
+	results := make([]testResult, len(tests))
+	handlers := make([]myHandler, len(tests))
+	for idx, name := range tests {
+		results[idx] = testResult{
+			Session:       session,
+			Time:          now,
+			Run:           run,
+			Test:          name,
+			Bidirectional: test == "bidirectional",
+			Compressible:  checkCompression && idx > 0,
+			Hostname:      settings.Hostname,
+			Port:          settings.Port,
+		}
+		handlers[idx] = myHandler{result: &results[idx]}
+	}
+	if len(results) == 1 && settings.TestID == "" {
+		// Generate the TestID here, so that the result contains it even
+		// if the test fails before emitting any measurement
+		id, err := nuvolari.NewTestID()
+		if err != nil {
+			return nil, err
+		}
+		settings.TestID = id
+		results[0].TestID = id
+	}
+	settings.Privacy = settings.Privacy || *privacy
+	if *summaryOnly {
+		// The summary only needs the logs describing the connection,
+		// which are few, hence we keep the logs
+		settings.EventMask = nuvolari.EventServerMeasurement |
+			nuvolari.EventClientMeasurement | nuvolari.EventFinding | nuvolari.EventLog
+	}
+	// The tui cannot show the speed of two tests at the same time
+	if *format == "tui" && !*summaryOnly && len(handlers) == 1 {
+		handlers[0].tui = newTUI()
+	}
+	var handler nuvolari.Handler = handlers[0]
+	if test == "bidirectional" {
+		handler = bidirectionalHandler{download: handlers[0], upload: handlers[1]}
+	} else if len(handlers) > 1 {
+		handler = &sequentialHandler{handlers: handlers}
+	}
+	clnt := nuvolari.Client{
+		Settings: settings,
+		Handler:  handler,
+	}
+	if recorder != nil {
+		clnt.Handler = nuvolari.MultiHandler(handler, recorder)
+	}
+	var err error
+	switch test {
+	case "download":
+		err = clnt.RunDownload(ctx)
+	case "upload":
+		if !checkCompression {
+			err = clnt.RunUpload(ctx)
+			break
+		}
+		var all *nuvolari.AllResults
+		all, err = clnt.RunUploadWithCompressionCheck(ctx)
+		results = compressionResults(results, all)
+	case "bidirectional":
+		err = clnt.RunBidirectional(ctx)
+	}
+	if handlers[0].tui != nil {
+		handlers[0].tui.Close()
+	}
+	var be *nuvolari.BidirectionalError
+	for idx := range results {
+		testErr := err
+		if errors.As(err, &be) {
+			testErr = []error{be.Download, be.Upload}[idx]
+		}
+		if checkCompression && idx < len(results)-1 {
+			testErr = nil // We only run the next upload if this one succeeded
+		}
+		finishResult(&results[idx], testErr)
+	}
+	if errors.Is(err, nuvolari.ErrInterrupted) {
+		err = nil // The user interrupted us, which is not a failure
+	}
+	return results, err
+}
+
+// compressionResults completes the results of the uploads run with the
+// compression check using all, the library results. We drop the result of
+// the compressible upload if we did not run it.
+func compressionResults(results []testResult, all *nuvolari.AllResults) []testResult {
+	if all.Upload != nil {
+		results[0].setTestID(all.Upload.TestID)
+	}
+	if all.CompressibleUpload == nil {
+		return results[:1]
+	}
+	results[1].setTestID(all.CompressibleUpload.TestID)
+	for _, d := range all.CompressibleUpload.Diagnoses {
+		if d.Code != nuvolari.DiagnosisCompressionSpeedup {
+			continue
+		}
+		results[1].Diagnoses = append(results[1].Diagnoses, d)
+		if !machineFormat() {
+			warnf("%s: a middlebox may be compressing the traffic", d.Detail)
+		}
+	}
+	return results
+}
+
+// finishResult completes result, whose test failed with err if not nil.
+func finishResult(result *testResult, err error) {
+	if errors.Is(err, nuvolari.ErrInterrupted) {
+		err = nil
+	}
+	if result.Elapsed <= 0 {
+		result.Elapsed = time.Now().Sub(result.Time).Seconds()
+	}
+	if err != nil {
+		result.Error = errorMessage(err)
+		result.ErrorCode = nuvolari.ErrorCodeOf(err).String()
+	}
+	if result.numIntervals > 0 {
+		result.RwndLimited = float64(result.numRwndLimited) / float64(result.numIntervals)
+	}
+	if result.RwndLimited >= rwndLimitedWarning && !machineFormat() {
+		warnf("the client receive window limited %.0f%% of the download: the bottleneck "+
+			"may be the client buffer rather than the network; try a larger -rcvbuf",
+			result.RwndLimited*100)
+	}
+}
+
+// runTests parses args and runs the specified tests in sequence.
+func runTests(name string, args []string, tests ...string) error {
+	fs := newFlagSet(name)
+	settings := addClientFlags(fs)
+	repeat := fs.Int("repeat", 1, "Number of times to run the tests")
+	sessionFlag := fs.String("session-id", "", "Session ID grouping the results (default: random)")
+	submitURL := fs.String("submit-url", "", "URL of the collector where to submit the summary")
+	submitToken := fs.String("submit-token", "", "Bearer token for the collector")
+	submitEvents := fs.Bool("submit-events", false, "Also submit the full stream of events")
+	submitConsent := fs.Bool("submit-consent", false, "Agree to share results with the collector")
+	fs.BoolVar(&settings.CheckCompression, "check-compression", false,
+		"After each upload, upload compressible data to detect middleboxes compressing the traffic")
+	parseClientFlags(fs, args, settings)
+	submitter := collector.Client{
+		URL:         *submitURL,
+		BearerToken: *submitToken,
+		Consented:   *submitConsent,
+	}
+	if *submitURL != "" {
+		if err := submitter.CheckConsent(); err != nil {
+			log.Printf("%s", collector.Disclosure)
+			return fmt.Errorf("use -submit-consent to agree to share results with %s", *submitURL)
+		}
+	}
+	session, err := sessionID(*sessionFlag)
+	if err != nil {
+		return err
+	}
+	if !machineFormat() {
+		log.Printf("Session: %s", session)
+	}
+	var recorder *collector.Recorder
+	if *submitURL != "" && *submitEvents {
+		recorder = &collector.Recorder{}
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	var results []testResult
+loop:
+	for run := 1; run <= *repeat; run++ {
+		for _, test := range tests {
+			var testResults []testResult
+			testResults, err = runTest(ctx, *settings, session, test, run, recorder)
+			for _, result := range testResults {
+				saveHistory(result)
+			}
+			results = append(results, testResults...)
+			if err != nil || ctx.Err() != nil {
+				break loop
+			}
+		}
+	}
+	var aggregates []aggregate
+	if *repeat > 1 {
+		aggregates = aggregateResults(results)
+		if !machineFormat() {
+			printStatistics(results, aggregates)
+		}
+	}
+	sum := summary{
+		Version:    nuvolari.Version(),
+		Results:    results,
+		Aggregates: aggregates,
+	}
+	if *summaryOnly {
+		data, err := json.Marshal(sum)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", string(data))
+	}
+	if *submitURL != "" {
+		report := collector.Report{Version: sum.Version, Summary: sum}
+		if recorder != nil {
+			report.Events = recorder.Events()
+		}
+		if err := submitter.Submit(context.Background(), report); err != nil {
+			warnf("cannot submit results: %s", err.Error())
+		}
+	}
+	return err
+}
+
+func runDownload(args []string) error {
+	return runTests("download", args, "download")
+}
+
+func runUpload(args []string) error {
+	return runTests("upload", args, "upload")
+}
+
+func runBoth(args []string) error {
+	return runTests("both", args, "download", "upload")
+}
+
+func runBidirectional(args []string) error {
+	return runTests("bidirectional", args, "bidirectional")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+	"github.com/bassosimone/nuvolari/server"
+)
+
+// checkingHandler is a nuvolari.Handler that verifies the invariants of
+// the events emitted during a test.
+type checkingHandler struct {
+	mu         sync.Mutex
+	connected  bool
+	lastClient nuvolari.Measurement
+	lastServer nuvolari.Measurement
+	numClient  int
+	numServer  int
+	violations []string
+}
+
+func (ch *checkingHandler) violation(format string, v ...interface{}) {
+	ch.violations = append(ch.violations, fmt.Sprintf(format, v...))
+}
+
+func (ch *checkingHandler) OnLogInfo(m nuvolari.LogMessage) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if m.Code == nuvolari.LogConnected {
+		ch.connected = true
+	}
+}
+
+func (ch *checkingHandler) OnServerDownloadMeasurement(m nuvolari.Measurement) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.connected {
+		ch.violation("server measurement before connecting")
+	}
+	if m.Elapsed < ch.lastServer.Elapsed {
+		ch.violation("server elapsed went backwards: %f < %f", m.Elapsed, ch.lastServer.Elapsed)
+	}
+	ch.lastServer = m
+	ch.numServer++
+}
+
+// checkClientMeasurement checks a client measurement of either test.
+func (ch *checkingHandler) checkClientMeasurement(m nuvolari.Measurement) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.connected {
+		ch.violation("client measurement before connecting")
+	}
+	if m.Elapsed < ch.lastClient.Elapsed {
+		ch.violation("client elapsed went backwards: %f < %f", m.Elapsed, ch.lastClient.Elapsed)
+	}
+	if m.NumBytes < ch.lastClient.NumBytes {
+		ch.violation("client num_bytes went backwards: %d < %d", m.NumBytes, ch.lastClient.NumBytes)
+	}
+	ch.lastClient = m
+	ch.numClient++
+}
+
+func (ch *checkingHandler) OnClientDownloadMeasurement(m nuvolari.Measurement) {
+	ch.checkClientMeasurement(m)
+}
+
+func (ch *checkingHandler) OnServerUploadMeasurement(m nuvolari.Measurement) {
+	ch.OnServerDownloadMeasurement(m)
+}
+
+func (ch *checkingHandler) OnClientUploadMeasurement(m nuvolari.Measurement) {
+	ch.checkClientMeasurement(m)
+}
+
+func (ch *checkingHandler) OnProgress(p nuvolari.Progress) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if p.Percent < 0 || p.Percent > 100 {
+		ch.violation("progress out of range: %f", p.Percent)
+	}
+}
+
+func (ch *checkingHandler) OnFinding(f nuvolari.Finding) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	switch f.Code {
+	case nuvolari.FindingUnverifiedCertificate:
+		// Expected when using self-signed certificates
+	default:
+		ch.violation("interference: %s: %s", f.Code, f.Detail)
+	}
+}
+
+// result returns an error describing the violations, if any.
+func (ch *checkingHandler) result(test string) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.connected {
+		ch.violation("never connected")
+	}
+	if test == "download" {
+		if ch.numClient <= 0 || ch.lastClient.NumBytes <= 0 {
+			ch.violation("no bytes received")
+		}
+	}
+	if test == "upload" {
+		if ch.numClient <= 0 || ch.lastClient.NumBytes <= 0 {
+			ch.violation("no bytes sent")
+		}
+	}
+	if ch.numServer <= 0 {
+		ch.violation("no server measurements")
+	}
+	if len(ch.violations) > 0 {
+		return errors.New(strings.Join(ch.violations, "; "))
+	}
+	return nil
+}
+
+// startLocalServer starts a server on a random loopback port and
+// returns its port.
+func startLocalServer() (string, error) {
+	cert, err := server.NewSelfSignedCertificate([]string{"127.0.0.1"})
+	if err != nil {
+		return "", err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, server.NewServeMux())
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	return port, err
+}
+
+// countFDs returns the number of open file descriptors, or -1 when we
+// cannot count them on this system.
+func countFDs() int {
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// soakTolerance is how many goroutines or file descriptors we allow to
+// remain alive after the soak test, to account for background activity.
+const soakTolerance = 10
+
+// errSoakCount is returned when the soak test would run less than two
+// times, in which case we cannot compare against the baseline.
+var errSoakCount = errors.New("soak: need at least two runs")
+
+// soakSettleTime is how long we wait for the goroutines of the tests to
+// exit, which includes the time the library waits for the consumer of an
+// abandoned channel.
+const soakSettleTime = 2 * time.Second
+
+// abandonChannels starts a download and an upload using the channel API,
+// cancels each of them as soon as it is measuring and stops reading the
+// channel, like a user interface does when the user closes it.
+func abandonChannels(ctx context.Context, clnt nuvolari.Client) {
+	starts := []func(nuvolari.Client, context.Context) <-chan nuvolari.Event{
+		nuvolari.Client.Download, nuvolari.Client.Upload,
+	}
+	for _, start := range starts {
+		testCtx, cancel := context.WithCancel(ctx)
+		for ev := range start(clnt, testCtx) {
+			if _, ok := ev.(nuvolari.MeasurementEvent); ok {
+				break
+			}
+		}
+		cancel()
+	}
+}
+
+// runSoak runs many back-to-back short tests and checks whether the number
+// of goroutines and of file descriptors grows, which indicates leaks.
+func runSoak(ctx context.Context, settings nuvolari.Settings, count int, duration time.Duration) error {
+	if count < 2 {
+		return errSoakCount
+	}
+	clnt := nuvolari.Client{Settings: settings}
+	var baseGoroutines, baseFDs int
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		for _, test := range []string{"download", "upload"} {
+			testCtx, cancel := context.WithTimeout(ctx, duration)
+			var err error
+			switch test {
+			case "download":
+				err = clnt.RunDownload(testCtx)
+			case "upload":
+				err = clnt.RunUpload(testCtx)
+			}
+			cancel()
+			// We expect the timeout to interrupt the test
+			if err != nil && !errors.Is(err, nuvolari.ErrInterrupted) {
+				return fmt.Errorf("soak run %d: %s: %s", i, test, err.Error())
+			}
+		}
+		abandonChannels(ctx, clnt)
+		if i == 0 {
+			// Take the baseline after the first run, such that one-time
+			// initializations (e.g. of the resolver) are not counted.
+			time.Sleep(soakSettleTime)
+			baseGoroutines, baseFDs = runtime.NumGoroutine(), countFDs()
+		}
+	}
+	time.Sleep(soakSettleTime) // Give the peers time to tear down
+	goroutines, fds := runtime.NumGoroutine(), countFDs()
+	log.Printf("soak: goroutines %d => %d; fds %d => %d", baseGoroutines, goroutines, baseFDs, fds)
+	if goroutines > baseGoroutines+soakTolerance {
+		return fmt.Errorf("soak: goroutines leaked: %d => %d", baseGoroutines, goroutines)
+	}
+	if fds >= 0 && fds > baseFDs+soakTolerance {
+		return fmt.Errorf("soak: file descriptors leaked: %d => %d", baseFDs, fds)
+	}
+	return nil
+}
+
+// runSelftest runs download and upload tests checking that byte counts,
+// event ordering and closing behave as expected. It is meant to be run
+// in CI-like environments, either against a designated test server or
+// against a server running in the same process.
+func runSelftest(args []string) error {
+	fs := newFlagSet("selftest")
+	settings := addClientFlags(fs)
+	local := fs.Bool("local", false, "Run against a server running in this process")
+	soak := fs.Int("soak", 0, "Also run this many (at least 2) short tests looking for leaks")
+	soakDuration := fs.Duration("soak-duration", 500*time.Millisecond, "Duration of each soak test")
+	parseClientFlags(fs, args, settings)
+	if *local {
+		port, err := startLocalServer()
+		if err != nil {
+			return err
+		}
+		settings.Hostname = "127.0.0.1"
+		settings.Port = port
+		settings.SkipTLSVerify = true
+	}
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	failed := false
+	for _, test := range []string{"download", "upload"} {
+		handler := &checkingHandler{}
+		clnt := nuvolari.Client{Settings: *settings, Handler: handler}
+		var err error
+		switch test {
+		case "download":
+			err = clnt.RunDownload(ctx)
+		case "upload":
+			err = clnt.RunUpload(ctx)
+		}
+		if err == nil {
+			err = handler.result(test)
+		}
+		if err != nil {
+			log.Printf("FAIL %s: %s", test, err.Error())
+			failed = true
+			continue
+		}
+		log.Printf("PASS %s", test)
+	}
+	if *soak > 0 {
+		if err := runSoak(ctx, *settings, *soak, *soakDuration); err != nil {
+			log.Printf("FAIL soak: %s", err.Error())
+			failed = true
+		} else {
+			log.Printf("PASS soak")
+		}
+	}
+	if failed {
+		return errors.New("selftest failed")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+)
+
+func TestRunSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+	port, err := startLocalServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := nuvolari.Settings{
+		Hostname:      "127.0.0.1",
+		Port:          port,
+		SkipTLSVerify: true,
+	}
+	if err := runSoak(context.Background(), settings, 10, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunSoakNeedsTwoRuns(t *testing.T) {
+	err := runSoak(context.Background(), nuvolari.Settings{}, 1, time.Second)
+	if err != errSoakCount {
+		t.Fatalf("expected errSoakCount, got %v", err)
+	}
+}
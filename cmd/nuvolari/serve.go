@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/bassosimone/nuvolari/server"
+)
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve")
+	address := fs.String("address", "127.0.0.1:4443", "Address to listen on")
+	certFile := fs.String("cert", "", "TLS certificate file (default: self-signed)")
+	keyFile := fs.String("key", "", "TLS key file (default: self-signed)")
+	bearerToken := fs.String("bearer-token", "", "Require clients to use this bearer token")
+	disableTLS := fs.Bool("disable-tls", false, "Serve ws:// rather than wss://")
+	adminAddress := fs.String("admin-address", "", "Loopback address where to expose pprof and expvar")
+	fs.Parse(args)
+	if *adminAddress != "" {
+		if err := startAdminServer(*adminAddress); err != nil {
+			return err
+		}
+	}
+	var handler http.Handler = countRequests(server.NewServeMux())
+	if *bearerToken != "" {
+		handler = server.RequireAuth(handler, server.BearerTokenVerifier(*bearerToken))
+	}
+	srv := &http.Server{
+		Addr:    *address,
+		Handler: handler,
+	}
+	if *disableTLS {
+		log.Printf("Listening on: %s (without TLS)", *address)
+		return srv.ListenAndServe()
+	}
+	if *certFile == "" || *keyFile == "" {
+		host, _, err := net.SplitHostPort(*address)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		cert, err := server.NewSelfSignedCertificate([]string{host})
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("Using a self-signed certificate; clients must skip TLS verify")
+	}
+	log.Printf("Listening on: %s", *address)
+	return srv.ListenAndServeTLS(*certFile, *keyFile)
+}
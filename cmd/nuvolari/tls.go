@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions maps the values of -tls-min-version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as "1.2".
+func parseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s", s)
+	}
+	return version, nil
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names
+// such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func parseCipherSuites(s string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/bassosimone/nuvolari/stats"
+	"github.com/bassosimone/nuvolari/units"
+)
+
+// tuiWindow is the time window covered by the sparkline.
+const tuiWindow = 10 * time.Second
+
+// tuiRefresh is the interval between screen refreshes.
+const tuiRefresh = 250 * time.Millisecond
+
+const tuiBarWidth = 20
+
+// tuiSmoothing is the weight of new samples in the displayed bit-rate.
+const tuiSmoothing = 0.3
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// tuiSample is a throughput sample displayed by the sparkline.
+type tuiSample struct {
+	elapsed float64
+	rate    float64
+}
+
+// tui is a terminal user interface showing a single status line that is
+// updated in place while a test is running.
+type tui struct {
+	mu        sync.Mutex
+	progress  nuvolari.Progress
+	last      nuvolari.Measurement
+	rate      *stats.EWMA
+	rtt       float64
+	samples   []tuiSample
+	stop      chan struct{}
+	done      chan struct{}
+	lineDrawn bool
+}
+
+// newTUI creates a tui and starts refreshing the screen.
+func newTUI() *tui {
+	t := &tui{
+		progress: nuvolari.Progress{Phase: nuvolari.PhaseConnecting, ETA: spec.DefaultDuration.Seconds()},
+		rate:     stats.NewEWMA(tuiSmoothing),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func (t *tui) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			t.draw()
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Close stops refreshing the screen and leaves the last status line.
+func (t *tui) Close() {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draw()
+	if t.lineDrawn {
+		fmt.Fprintf(os.Stdout, "\n")
+	}
+}
+
+// Log prints a message above the status line.
+func (t *tui) Log(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(os.Stdout, "\r\x1b[2K%s\n", message)
+	t.lineDrawn = false
+	t.draw()
+}
+
+// OnClientMeasurement updates the throughput using a client measurement.
+func (t *tui) OnClientMeasurement(m nuvolari.Measurement) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if dt := m.Elapsed - t.last.Elapsed; dt > 0 {
+		rate := float64(m.NumBytes-t.last.NumBytes) * 8 / dt
+		t.rate.Add(rate)
+		t.samples = append(t.samples, tuiSample{elapsed: m.Elapsed, rate: rate})
+		for len(t.samples) > 0 && m.Elapsed-t.samples[0].elapsed > tuiWindow.Seconds() {
+			t.samples = t.samples[1:]
+		}
+	}
+	t.last = m
+}
+
+// OnServerMeasurement updates the RTT using a server measurement.
+func (t *tui) OnServerMeasurement(m nuvolari.Measurement) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m.BBRInfo != nil {
+		t.rtt = m.BBRInfo.MinRTT
+	}
+}
+
+// OnProgress updates the progress bar, the phase and the ETA.
+func (t *tui) OnProgress(p nuvolari.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = p
+}
+
+func (t *tui) sparkline() string {
+	var rates []float64
+	for _, s := range t.samples {
+		rates = append(rates, s.rate)
+	}
+	max := stats.Max(rates)
+	var b strings.Builder
+	for _, s := range t.samples {
+		idx := 0
+		if max > 0 {
+			idx = int(s.rate / max * float64(len(sparkTicks)-1))
+		}
+		b.WriteRune(sparkTicks[idx])
+	}
+	return b.String()
+}
+
+// draw draws the status line. It must be called with the mutex held.
+func (t *tui) draw() {
+	progress := t.progress.Percent / 100
+	filled := int(progress * tuiBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", tuiBarWidth-filled)
+	rtt := "   n/a"
+	if t.rtt > 0 {
+		rtt = fmt.Sprintf("%6.1f", t.rtt)
+	}
+	fmt.Fprintf(os.Stdout, "\r\x1b[2K%-10s [%s] %3.0f%% eta %2.0fs %12s rtt %s ms %s",
+		t.progress.Phase, bar, progress*100, t.progress.ETA, units.FormatBitrate(t.rate.Value()),
+		rtt, t.sparkline())
+	t.lineDrawn = true
+}
@@ -0,0 +1,194 @@
+// Package collector submits results to a collection service, for running
+// measurement campaigns. The service receives a JSON Report using a POST
+// request and must reply with a 2xx status code.
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/nuvolari"
+)
+
+// Event is an event emitted during a test.
+type Event struct {
+	// Time is the time when we received the event.
+	Time time.Time `json:"time"`
+
+	// Type is the type of event (e.g. "client-download-measurement").
+	Type string `json:"type"`
+
+	// Message is the message of a log event.
+	Message string `json:"message,omitempty"`
+
+	// Code is the code of a log event.
+	Code string `json:"code,omitempty"`
+
+	// Params contains the params of a log event.
+	Params map[string]string `json:"params,omitempty"`
+
+	// Measurement is the measurement of a measurement event.
+	Measurement *nuvolari.Measurement `json:"measurement,omitempty"`
+
+	// Finding is the finding of a finding event.
+	Finding *nuvolari.Finding `json:"finding,omitempty"`
+}
+
+// Recorder is a nuvolari.Handler that records the events, so that they
+// can be submitted along with the summary. It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *Recorder) add(ev Event) {
+	ev.Time = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// Events returns a copy of the events recorded so far.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// OnLogInfo records a log event.
+func (r *Recorder) OnLogInfo(m nuvolari.LogMessage) {
+	r.add(Event{Type: "log", Message: m.Message, Code: m.Code, Params: m.Params})
+}
+
+// OnServerDownloadMeasurement records a server download measurement.
+func (r *Recorder) OnServerDownloadMeasurement(m nuvolari.Measurement) {
+	r.add(Event{Type: "server-download-measurement", Measurement: &m})
+}
+
+// OnClientDownloadMeasurement records a client download measurement.
+func (r *Recorder) OnClientDownloadMeasurement(m nuvolari.Measurement) {
+	r.add(Event{Type: "client-download-measurement", Measurement: &m})
+}
+
+// OnServerUploadMeasurement records a server upload measurement.
+func (r *Recorder) OnServerUploadMeasurement(m nuvolari.Measurement) {
+	r.add(Event{Type: "server-upload-measurement", Measurement: &m})
+}
+
+// OnClientUploadMeasurement records a client upload measurement.
+func (r *Recorder) OnClientUploadMeasurement(m nuvolari.Measurement) {
+	r.add(Event{Type: "client-upload-measurement", Measurement: &m})
+}
+
+// OnProgress does not record progress events, which only matter while
+// the test is running.
+func (r *Recorder) OnProgress(p nuvolari.Progress) {}
+
+// OnFinding records a finding.
+func (r *Recorder) OnFinding(f nuvolari.Finding) {
+	r.add(Event{Type: "finding", Finding: &f})
+}
+
+// Report is what we submit to the collection service.
+type Report struct {
+	// Version identifies the client that produced the report.
+	Version nuvolari.VersionInfo `json:"version"`
+
+	// Summary is the summary of the results.
+	Summary interface{} `json:"summary"`
+
+	// Events is the optional full stream of events.
+	Events []Event `json:"events,omitempty"`
+}
+
+// Client is a collection service client.
+type Client struct {
+	// URL is the URL of the collection service.
+	URL string
+
+	// BearerToken is the optional token used to authenticate using the
+	// Authorization header.
+	BearerToken string
+
+	// HTTPClient is the HTTP client. If nil, we use http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Consented indicates that the user has already agreed to share the
+	// results with the collection service, after reading the Disclosure.
+	Consented bool
+
+	// ConsentFunc is called, unless Consented is true, to ask the user
+	// whether to share results with the collection service at URL. It must
+	// show disclosure to the user and return true only if they agree. We
+	// call it at most once in the lifetime of the Client.
+	ConsentFunc func(URL, disclosure string) bool
+
+	// asked indicates that we called ConsentFunc, whose answer is then
+	// in Consented, so that we do not ask the user again.
+	asked bool
+}
+
+// Disclosure describes the data sharing implications of submitting.
+const Disclosure = "Submitting results shares with the operator of the " +
+	"collection service the measurement results, the time of the test, " +
+	"the server used, the IP address from which you submit, and, unless " +
+	"privacy mode is enabled, the IP address of the measurement."
+
+// ErrUnexpectedStatus is returned when the collection service fails.
+var ErrUnexpectedStatus = errors.New("Collector returned unexpected status")
+
+// ErrNoConsent is returned when the user did not consent to submitting.
+var ErrNoConsent = errors.New("User did not consent to submitting results")
+
+// CheckConsent returns ErrNoConsent unless the user consented to share the
+// results with the collection service. Applications should call it before
+// running tests whose results they will submit, such that users are not
+// asked after the fact. We remember the answer of the user, hence Submit,
+// which also calls it before submitting, does not ask again.
+func (c *Client) CheckConsent() error {
+	if !c.Consented && !c.asked && c.ConsentFunc != nil {
+		c.Consented, c.asked = c.ConsentFunc(c.URL, Disclosure), true
+	}
+	if c.Consented {
+		return nil
+	}
+	return ErrNoConsent
+}
+
+// Submit submits report to the collection service.
+func (c *Client) Submit(ctx context.Context, report Report) error {
+	if err := c.CheckConsent(); err != nil {
+		return err
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nuvolari/"+report.Version.Version)
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ErrUnexpectedStatus
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestCollector returns a collection service counting the requests.
+func newTestCollector(t *testing.T) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestSubmitWithoutConsent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		consent func(URL, disclosure string) bool
+	}{
+		{"consent unset", nil},
+		{"consent denied", func(string, string) bool { return false }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, requests := newTestCollector(t)
+			c := Client{URL: srv.URL, ConsentFunc: tc.consent}
+			if err := c.Submit(context.Background(), Report{}); err != ErrNoConsent {
+				t.Fatalf("expected ErrNoConsent, got %v", err)
+			}
+			if n := atomic.LoadInt32(requests); n != 0 {
+				t.Fatalf("the collector received %d requests without consent", n)
+			}
+		})
+	}
+}
+
+func TestSubmitAsksForConsent(t *testing.T) {
+	srv, requests := newTestCollector(t)
+	var asked bool
+	c := Client{URL: srv.URL, ConsentFunc: func(URL, disclosure string) bool {
+		asked = URL == srv.URL && disclosure == Disclosure
+		return true
+	}}
+	if err := c.Submit(context.Background(), Report{}); err != nil {
+		t.Fatal(err)
+	}
+	if !asked {
+		t.Fatal("ConsentFunc did not receive the URL and the Disclosure")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected one request, got %d", n)
+	}
+}
+
+func TestSubmitWithConsent(t *testing.T) {
+	srv, requests := newTestCollector(t)
+	c := Client{URL: srv.URL, Consented: true}
+	if err := c.Submit(context.Background(), Report{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected one request, got %d", n)
+	}
+}
+
+func TestConsentIsAskedOnce(t *testing.T) {
+	for _, answer := range []bool{true, false} {
+		srv, _ := newTestCollector(t)
+		var asked int
+		c := Client{URL: srv.URL, ConsentFunc: func(string, string) bool {
+			asked++
+			return answer
+		}}
+		first := c.CheckConsent()
+		second := c.Submit(context.Background(), Report{})
+		if (first == nil) != answer || (second == nil) != answer {
+			t.Fatalf("answer %v: unexpected errors %v and %v", answer, first, second)
+		}
+		if asked != 1 {
+			t.Fatalf("answer %v: asked for consent %d times", answer, asked)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/bassosimone/nuvolari/internal/sockopt"
+	"github.com/gorilla/websocket"
+)
+
+// connectionInfo returns information about conn. We attach it to the
+// first client-side measurement, like servers typically do.
+func connectionInfo(conn *websocket.Conn) *ConnectionInfo {
+	ci := &ConnectionInfo{
+		Client: conn.LocalAddr().String(),
+		Server: conn.RemoteAddr().String(),
+	}
+	if mss, err := sockopt.MSS(conn.UnderlyingConn()); err == nil {
+		ci.MSS = int64(mss)
+	}
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		ci.SetTLSInfo(tlsConn.ConnectionState())
+	}
+	if size, err := sockopt.SendBufferSize(conn.UnderlyingConn()); err == nil {
+		ci.SendBufferSize = int64(size)
+	}
+	if size, err := sockopt.ReceiveBufferSize(conn.UnderlyingConn()); err == nil {
+		ci.ReceiveBufferSize = int64(size)
+	}
+	if cc, err := sockopt.CongestionControl(conn.UnderlyingConn()); err == nil {
+		ci.CongestionControl = cc
+	}
+	return ci
+}
+
+// tcpInfo returns the TCP_INFO of conn, or nil if not available, which is
+// the case on systems other than Linux. We call it for each client-side
+// measurement, hence it must be cheap; it is a single getsockopt.
+func tcpInfo(conn *websocket.Conn) *TCPInfo {
+	info, err := sockopt.GetTCPInfo(conn.UnderlyingConn())
+	if err != nil {
+		return nil
+	}
+	return &TCPInfo{
+		NotsentBytes: int64(info.NotsentBytes),
+		BytesAcked:   int64(info.BytesAcked),
+		RTT:          int64(info.RTT),
+		RTTVar:       int64(info.RTTVar),
+		TotalRetrans: int64(info.TotalRetrans),
+		DeliveryRate: int64(info.DeliveryRate),
+		RcvRTT:       int64(info.RcvRTT),
+		RcvWnd:       int64(info.RcvWnd),
+		MinRTT:       int64(info.MinRTT),
+		BytesSent:    int64(info.BytesSent),
+		BytesRetrans: int64(info.BytesRetrans),
+		DataSegsOut:  int64(info.DataSegsOut),
+	}
+}
+
+// setLoss sets the Retransmissions and LossRate of the client measurement
+// m using the TCP_INFO of the sender, if available. Older kernels do not
+// report the number of data segments, in which case we use bytes.
+func setLoss(m *Measurement, sender *TCPInfo) {
+	if sender == nil {
+		return
+	}
+	m.Retransmissions = sender.TotalRetrans
+	switch {
+	case sender.DataSegsOut > 0:
+		m.LossRate = float64(sender.TotalRetrans) / float64(sender.DataSegsOut)
+	case sender.BytesSent > 0:
+		m.LossRate = float64(sender.BytesRetrans) / float64(sender.BytesSent)
+	}
+}
+
+// rwndLimitedThreshold is the fraction of the receive window that the
+// bytes in flight must reach for us to consider the interval limited by it.
+const rwndLimitedThreshold = 0.8
+
+// rwndLimited tells whether the receive window limited the throughput in
+// an interval where we received count bytes. Since the sender cannot have
+// more than a receive window of bytes in flight, when the bytes received
+// in a RTT approach the window, the window is the bottleneck.
+func rwndLimited(info *TCPInfo, count int64, interval time.Duration) bool {
+	if info == nil || info.RcvWnd <= 0 || info.RcvRTT <= 0 || interval <= 0 {
+		return false
+	}
+	rtt := time.Duration(info.RcvRTT) * time.Microsecond
+	inflight := float64(count) * float64(rtt) / float64(interval)
+	return inflight >= rwndLimitedThreshold*float64(info.RcvWnd)
+}
+
+// ecnInfo returns the ECN status of conn, or nil if not available.
+func ecnInfo(conn *websocket.Conn) *ECNInfo {
+	info, err := sockopt.GetTCPInfo(conn.UnderlyingConn())
+	if err != nil {
+		return nil
+	}
+	return &ECNInfo{
+		Negotiated:  (info.Options & sockopt.TCPIOptECN) != 0,
+		ECTSeen:     (info.Options & sockopt.TCPIOptECNSeen) != 0,
+		DeliveredCE: int64(info.DeliveredCE),
+	}
+}
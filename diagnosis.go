@@ -0,0 +1,153 @@
+package nuvolari
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bassosimone/nuvolari/stats"
+	"github.com/bassosimone/nuvolari/units"
+)
+
+// Diagnosis is the outcome of analyzing the measurements of a test, which
+// describes a pattern suggesting that a middlebox shapes or proxies the
+// traffic. Unlike a Finding, it is a heuristic and may be wrong.
+type Diagnosis struct {
+	// Code identifies the pattern (e.g. DiagnosisRoundPlateau).
+	Code string `json:"code"`
+
+	// Detail describes the pattern in human readable form.
+	Detail string `json:"detail"`
+
+	// TestID identifies the test (see Settings.TestID).
+	TestID string `json:"test_id,omitempty"`
+}
+
+const (
+	// DiagnosisRoundPlateau means that the throughput was flat at a round
+	// number, which suggests that it is limited by traffic shaping rather
+	// than by the capacity of the path.
+	DiagnosisRoundPlateau = "round-plateau"
+
+	// DiagnosisRTTStep means that the RTT suddenly changed during the
+	// test, which suggests that the path changed or that a middlebox
+	// started queueing or proxying the traffic.
+	DiagnosisRTTStep = "rtt-step"
+
+	// DiagnosisCompressionSpeedup means that uploading compressible data
+	// was much faster than uploading random data, which suggests that a
+	// middlebox compresses the traffic (see DiagnoseCompression).
+	DiagnosisCompressionSpeedup = "compression-speedup"
+)
+
+const (
+	// plateauMaxCV is the maximum coefficient of variation of a plateau.
+	plateauMaxCV = 0.05
+
+	// plateauMinSamples is the minimum number of intervals of the test.
+	plateauMinSamples = 5
+
+	// rttStepWindow is the number of measurements we compare on either side
+	// of a possible RTT step.
+	rttStepWindow = 3
+
+	// rttStepRatio is the minimum ratio between the RTTs on either side of
+	// a step, and rttStepMinDelta is the minimum difference in milliseconds.
+	rttStepRatio, rttStepMinDelta = 2.0, 5.0
+
+	// compressionSpeedup is the minimum ratio between the throughput with
+	// compressible data and with random data that suggests compression.
+	compressionSpeedup = 1.5
+)
+
+// Diagnose analyzes the client measurements of r looking for signs of
+// traffic shaping or proxying. We also call it to fill r.Diagnoses.
+func Diagnose(r *Results) []Diagnosis {
+	var diagnoses []Diagnosis
+	for _, diagnose := range []func(*Results) *Diagnosis{diagnosePlateau, diagnoseRTTStep} {
+		if d := diagnose(r); d != nil {
+			d.TestID = r.TestID
+			diagnoses = append(diagnoses, *d)
+		}
+	}
+	return diagnoses
+}
+
+// diagnosePlateau checks whether the throughput after the warm-up was flat
+// and close to a round rate, considering that the protocol overhead lowers
+// the throughput we measure at application level by a few percent.
+func diagnosePlateau(r *Results) *Diagnosis {
+	ts := r.Stability
+	if ts == nil || ts.CV > plateauMaxCV || len(r.ClientMeasurements) < plateauMinSamples+1 {
+		return nil
+	}
+	round := roundRate(ts.P50)
+	if round <= 0 || ts.P50 < 0.9*round || ts.P50 > 1.02*round {
+		return nil
+	}
+	return &Diagnosis{
+		Code: DiagnosisRoundPlateau,
+		Detail: fmt.Sprintf("the throughput was flat at %s, close to %s",
+			units.FormatBitrate(ts.P50), units.FormatBitrate(round)),
+	}
+}
+
+// roundRate returns the round rate closest to rate, i.e. one, two, two
+// and a half or five times a power of ten, at least 100 kbit/s.
+func roundRate(rate float64) float64 {
+	if rate < 1e05 {
+		return 0
+	}
+	var closest float64
+	scale := math.Pow(10, math.Floor(math.Log10(rate)))
+	for _, mantissa := range []float64{1, 2, 2.5, 5, 10} {
+		if v := mantissa * scale; math.Abs(v-rate) < math.Abs(closest-rate) {
+			closest = v
+		}
+	}
+	return closest
+}
+
+// diagnoseRTTStep looks for the first point after the warm-up where the
+// median of the loaded RTT of the next measurements differs much from the
+// median of the previous measurements.
+func diagnoseRTTStep(r *Results) *Diagnosis {
+	var elapsed, rtts []float64
+	for _, m := range r.ClientMeasurements {
+		if m.LoadedRTT > 0 && m.Elapsed >= r.WarmUp {
+			elapsed = append(elapsed, m.Elapsed)
+			rtts = append(rtts, m.LoadedRTT)
+		}
+	}
+	for idx := rttStepWindow; idx+rttStepWindow <= len(rtts); idx++ {
+		before := stats.Median(rtts[idx-rttStepWindow : idx])
+		after := stats.Median(rtts[idx : idx+rttStepWindow])
+		low, high := math.Min(before, after), math.Max(before, after)
+		if low > 0 && high/low >= rttStepRatio && high-low >= rttStepMinDelta {
+			return &Diagnosis{
+				Code: DiagnosisRTTStep,
+				Detail: fmt.Sprintf("the RTT changed from %.1f ms to %.1f ms after %.1f s",
+					before, after, elapsed[idx]),
+			}
+		}
+	}
+	return nil
+}
+
+// DiagnoseCompression compares the results of two uploads, the former
+// using random data and the latter using compressible data (see
+// UploadSettings.Pattern), to check whether a middlebox compresses the
+// traffic, in which case it returns a Diagnosis. RunAll calls it when
+// Settings.CheckCompression is set.
+func DiagnoseCompression(random, compressible *Results) *Diagnosis {
+	if random == nil || compressible == nil || random.MeanThroughput <= 0 ||
+		compressible.MeanThroughput < compressionSpeedup*random.MeanThroughput {
+		return nil
+	}
+	return &Diagnosis{
+		Code:   DiagnosisCompressionSpeedup,
+		TestID: compressible.TestID,
+		Detail: fmt.Sprintf("compressible data was uploaded at %s, random data at %s",
+			units.FormatBitrate(compressible.MeanThroughput),
+			units.FormatBitrate(random.MeanThroughput)),
+	}
+}
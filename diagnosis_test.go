@@ -0,0 +1,75 @@
+package nuvolari
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiagnoseCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		random, compressible *Results
+		want                 bool
+	}{
+		{"missing results", nil, &Results{MeanThroughput: 100}, false},
+		{"no throughput", &Results{}, &Results{MeanThroughput: 100}, false},
+		{"similar throughput", &Results{MeanThroughput: 100}, &Results{MeanThroughput: 120}, false},
+		{"speedup", &Results{MeanThroughput: 100}, &Results{MeanThroughput: 300}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := DiagnoseCompression(tc.random, tc.compressible)
+			if (d != nil) != tc.want {
+				t.Fatalf("expected a diagnosis: %v, got %+v", tc.want, d)
+			}
+			if d != nil && d.Code != DiagnosisCompressionSpeedup {
+				t.Fatalf("unexpected code %s", d.Code)
+			}
+		})
+	}
+}
+
+func TestAllChecksCompression(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Settings.CheckCompression = true
+	var summaries []*Results
+	for ev := range cl.All(context.Background()) {
+		switch ev := ev.(type) {
+		case FailureEvent:
+			t.Fatal(ev.Err)
+		case SummaryEvent:
+			summaries = append(summaries, ev.Results)
+		}
+	}
+	if len(summaries) != 3 {
+		t.Fatalf("expected 3 summaries, got %d", len(summaries))
+	}
+	if summaries[2].Test != "upload" || summaries[2].NumBytes <= 0 {
+		t.Fatalf("expected the compressible upload to run, got %+v", summaries[2])
+	}
+}
+
+func TestUploadWithCompressionCheck(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Settings.CheckCompression = true
+	all, err := cl.RunUploadWithCompressionCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Download != nil {
+		t.Fatal("expected no download")
+	}
+	if all.Upload == nil || all.CompressibleUpload == nil {
+		t.Fatalf("expected both uploads, got %+v", all)
+	}
+	if all.Upload.TestID == all.CompressibleUpload.TestID {
+		t.Fatal("expected the uploads to have distinct TestIDs")
+	}
+	cl.Settings.CheckCompression = false
+	all, err = cl.RunUploadWithCompressionCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Upload == nil || all.CompressibleUpload != nil {
+		t.Fatalf("expected only the upload, got %+v", all)
+	}
+}
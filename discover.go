@@ -0,0 +1,47 @@
+package nuvolari
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/bassosimone/nuvolari/locate"
+)
+
+// urlTemplate returns the Locate API URL template of path.
+func (cl Client) urlTemplate(path string) string {
+	scheme, _ := cl.Settings.scheme() // serverURL checks the scheme
+	return scheme + "://" + path
+}
+
+// locateServer returns the server discovered by RunAll, if any, or uses
+// the Locate API to find the closest server serving path.
+func (cl Client) locateServer(ctx context.Context, path string) (*locate.Result, error) {
+	if cl.located != nil {
+		return cl.located, nil
+	}
+	results, err := locate.Client{URL: cl.Settings.LocateURL}.Nearest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if r.URL(cl.urlTemplate(path)) != nil {
+			cl.logInfo(LogDiscovered, "Discovered server: "+r.Machine, "machine", r.Machine)
+			return &r, nil
+		}
+	}
+	return nil, locate.ErrNoServers
+}
+
+// discover finds the closest server using locateServer and returns the
+// URL to use for path, which includes the access token, if any.
+func (cl Client) discover(ctx context.Context, path string) (url.URL, error) {
+	r, err := cl.locateServer(ctx, path)
+	if err != nil {
+		return url.URL{}, err
+	}
+	u := r.URL(cl.urlTemplate(path))
+	if u == nil {
+		return url.URL{}, locate.ErrNoServers
+	}
+	return *u, nil
+}
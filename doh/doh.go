@@ -0,0 +1,180 @@
+// Package doh implements a DNS-over-HTTPS resolver, as specified by RFC
+// 8484, which works where the local resolver is broken or monitored.
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Well known DNS-over-HTTPS servers.
+const (
+	CloudflareURL = "https://cloudflare-dns.com/dns-query"
+	GoogleURL     = "https://dns.google/dns-query"
+)
+
+// mediaType is the media type of DNS messages.
+const mediaType = "application/dns-message"
+
+// maxResponseSize is the maximum size of a DNS message.
+const maxResponseSize = 1 << 16
+
+// Record types.
+const (
+	typeA    = 1
+	typeAAAA = 28
+)
+
+var (
+	// ErrUnexpectedStatus is returned when the server does not reply 200.
+	ErrUnexpectedStatus = errors.New("DNS-over-HTTPS server returned unexpected status")
+
+	// ErrInvalidResponse is returned when the response is not valid.
+	ErrInvalidResponse = errors.New("DNS-over-HTTPS server returned an invalid response")
+
+	// ErrNoAddresses is returned when the hostname has no addresses.
+	ErrNoAddresses = errors.New("Hostname has no addresses")
+)
+
+// Resolver is a DNS-over-HTTPS resolver.
+type Resolver struct {
+	// URL is the URL of the server (e.g. CloudflareURL).
+	URL string
+
+	// HTTPClient is the HTTP client. If nil, we use http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// LookupHost returns the IPv4 and IPv6 addresses of host, like the method
+// of net.Resolver with the same name.
+func (r Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		v, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, v...)
+	}
+	if len(addrs) <= 0 {
+		return nil, ErrNoAddresses
+	}
+	return addrs, nil
+}
+
+// lookup returns the addresses of host with type qtype.
+func (r Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]string, error) {
+	query, err := newQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", r.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("Accept", mediaType)
+	httpClient := r.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrUnexpectedStatus
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(data, qtype)
+}
+
+// newQuery returns a recursive query for host with type qtype. As RFC
+// 8484 recommends, the ID is zero, to make responses cacheable.
+func newQuery(host string, qtype uint16) ([]byte, error) {
+	query := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) < 1 || len(label) > 63 {
+			return nil, &net.DNSError{Err: "invalid hostname", Name: host}
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, 1), nil // class IN
+}
+
+// parseResponse returns the addresses with type qtype in data.
+func parseResponse(data []byte, qtype uint16) ([]string, error) {
+	if len(data) < 12 || data[2]&0x80 == 0 {
+		return nil, ErrInvalidResponse
+	}
+	switch rcode := data[3] & 0x0f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return nil, ErrNoAddresses
+	default:
+		return nil, ErrInvalidResponse
+	}
+	qdcount := binary.BigEndian.Uint16(data[4:])
+	ancount := binary.BigEndian.Uint16(data[6:])
+	off := 12
+	for i := 0; i < int(qdcount); i++ {
+		if off = skipName(data, off); off < 0 || off+4 > len(data) {
+			return nil, ErrInvalidResponse
+		}
+		off += 4 // type and class
+	}
+	var addrs []string
+	for i := 0; i < int(ancount); i++ {
+		if off = skipName(data, off); off < 0 || off+10 > len(data) {
+			return nil, ErrInvalidResponse
+		}
+		rtype := binary.BigEndian.Uint16(data[off:])
+		rdlength := int(binary.BigEndian.Uint16(data[off+8:]))
+		off += 10
+		if off+rdlength > len(data) {
+			return nil, ErrInvalidResponse
+		}
+		rdata := data[off : off+rdlength]
+		off += rdlength
+		// Skip the other records, e.g. CNAMEs preceding the addresses
+		if rtype != qtype || (rtype == typeA && rdlength != 4) ||
+			(rtype == typeAAAA && rdlength != 16) {
+			continue
+		}
+		addrs = append(addrs, net.IP(rdata).String())
+	}
+	return addrs, nil
+}
+
+// skipName returns the offset following the name at off, or -1.
+func skipName(data []byte, off int) int {
+	for off < len(data) {
+		length := int(data[off])
+		switch {
+		case length == 0:
+			return off + 1
+		case length&0xc0 == 0xc0: // compression pointer
+			if off+2 > len(data) {
+				return -1
+			}
+			return off + 2
+		case length&0xc0 != 0:
+			return -1
+		}
+		off += 1 + length
+	}
+	return -1
+}
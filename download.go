@@ -0,0 +1,186 @@
+package nuvolari
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// RunDownload runs a ndt7 download test. If ctx is cancelled before the test
+// is over, it returns an error wrapping ErrInterrupted.
+func (cl Client) RunDownload(ctx context.Context) error {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	cl.Settings = cl.Settings.clone()
+	if err := cl.Settings.ensureTestID(); err != nil {
+		return err
+	}
+	if cl.Settings.Streams > 1 {
+		return cl.runStreams(ctx, spec.DownloadURLPath, "download", PhaseDownload,
+			Client.RunDownloadConn, Client.clientDownloadMeasurement)
+	}
+	conn, wsURL, err := cl.dial(ctx, spec.DownloadURLPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			cl.logInfo(LogInterrupted, "Download interrupted by user", "test", "download")
+			return wrapError(ErrInterrupted, ctx.Err())
+		}
+		if cl.shouldFallBack(err, wsURL) {
+			return cl.runNDT5(ctx, "download", wsURL.Hostname())
+		}
+		return err
+	}
+	return cl.runReconnecting(ctx, conn, wsURL, "download", Client.RunDownloadConn)
+}
+
+// sendMeasurement sends m to the server as a counter-flow measurement, so
+// that the server can archive the client view of the transfer.
+func (cl Client) sendMeasurement(conn *websocket.Conn, m Measurement) error {
+	data, err := json.Marshal(cl.redactMeasurement(m))
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout(cl.Settings.WriteTimeout)))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// RunDownloadConn runs a ndt7 download test over conn, which must have been
+// established by the caller using the download URL path and the ndt7
+// subprotocol. This allows to reuse the measurement loop with connections
+// established using custom transports. The caller owns conn and is
+// responsible for closing it.
+func (cl Client) RunDownloadConn(ctx context.Context, conn *websocket.Conn) (err error) {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	conn.SetReadLimit(cl.Settings.readLimit())
+	defer cl.Settings.tuneGC()()
+	t0 := time.Now()
+	tLast := t0
+	tProgress := t0
+	count := int64(0)
+	countLast := count
+	defer func() {
+		if err != nil && count > countLast {
+			cl.clientDownloadMeasurement(cl.finalMeasurement(spec.TestDownload, conn, t0, tLast, count, countLast))
+		}
+	}()
+	truncated := false
+	pinger := newPinger(conn, cl.Settings.PingInterval, timeout(cl.Settings.WriteTimeout))
+	maxDuration := float64(cl.Settings.duration()) * 1.5
+	var conv convergence
+	var lat latencyTracker
+	var arrivals arrivalTracker
+	var serverTCPInfo *TCPInfo
+	discard := newPacer(ctx, cl.Settings.MaxDownloadRate, cl.Settings.duration()).writer(ioutil.Discard)
+	closing := false
+	for {
+		// Check whether the user interrupted us
+		select {
+		case <-ctx.Done():
+			cl.logInfo(LogInterrupted, "Download interrupted by user", "test", "download")
+			cl.closeNormally(conn)
+			return wrapError(ErrInterrupted, ctx.Err())
+		default:
+			break
+		}
+		// Check whether we've run for too much time
+		now := time.Now()
+		elapsed := now.Sub(t0)
+		if float64(elapsed) >= maxDuration {
+			cl.closeNormally(conn)
+			return ErrServerGoneWild
+		}
+		// Check whether it's time to emit the next progress event
+		if now.Sub(tProgress) >= progressInterval {
+			cl.progress(PhaseDownload, elapsed)
+			tProgress = now
+		}
+		// Check whether it's time to run the next client-side measurement
+		if now.Sub(tLast) >= spec.MinMeasurementInterval {
+			measurement := cl.clientMeasurement(spec.TestDownload, elapsed, count,
+				now.Sub(tLast), count-countLast)
+			measurement.ECNInfo = ecnInfo(conn)
+			measurement.TCPInfo = tcpInfo(conn)
+			measurement.AppRTT = pinger.takeSamples()
+			lat.measure(&measurement)
+			measurement.ArrivalJitter = arrivals.takeJitter()
+			setLoss(&measurement, serverTCPInfo)
+			measurement.RwndLimited = rwndLimited(measurement.TCPInfo,
+				count-countLast, now.Sub(tLast))
+			if tLast == t0 {
+				measurement.ConnectionInfo = connectionInfo(conn)
+			}
+			cl.clientDownloadMeasurement(measurement)
+			conv.addClient(throughput(count, elapsed))
+			// Failing to send is not fatal: the server may be closing the
+			// connection and the next read tells us what happened.
+			cl.sendMeasurement(conn, measurement)
+			tLast, countLast = now, count
+		}
+		// Check whether we can end the download early. We keep reading
+		// until the server replies to our Close frame with its own.
+		if cl.Settings.Adaptive && !closing && conv.converged(elapsed) {
+			cl.logInfo(LogConverged, "Speed converged: ending the download early")
+			if err := cl.closeNormally(conn); err != nil {
+				return err
+			}
+			closing = true
+		}
+		pinger.maybePing(conn, now)
+		// Read and process the next WebSocket message
+		conn.SetReadDeadline(time.Now().Add(timeout(cl.Settings.ReadTimeout)))
+		mtype, reader, err := conn.NextReader()
+		if err != nil {
+			// When reading the server Close frame, the websocket library
+			// replies with a Close frame, completing the handshake
+			if err := closeError(err); err != nil {
+				return readError(err)
+			}
+			break
+		}
+		if mtype != websocket.TextMessage {
+			arrivals.add(time.Now())
+			// We stream binary messages rather than reading them in memory
+			// so that memory usage does not depend on the message size.
+			n, err := io.Copy(discard, reader)
+			count += n
+			if err != nil {
+				return readError(err)
+			}
+			continue
+		}
+		mdata, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return readError(err)
+		}
+		measurement, err := spec.ParseMeasurement(mdata)
+		if err != nil {
+			return wrapError(ErrProtocolViolation, err)
+		}
+		// Since TCP delivers data in order, by the time we receive a
+		// measurement we must have received all that was sent before.
+		if measurement.NumBytes > count && !truncated {
+			cl.finding(Finding{
+				Code: FindingTruncatedData,
+				Detail: fmt.Sprintf("received %d bytes but the server sent %d bytes",
+					count, measurement.NumBytes),
+			})
+			truncated = true
+		}
+		count += int64(len(mdata))
+		conv.addServer(measurement)
+		lat.addServer(measurement)
+		if measurement.TCPInfo != nil {
+			serverTCPInfo = measurement.TCPInfo
+		}
+		cl.serverDownloadMeasurement(measurement)
+	}
+	cl.progress(PhaseFinalizing, cl.Settings.duration())
+	return nil
+}
@@ -0,0 +1,199 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/bassosimone/nuvolari/locate"
+	"github.com/bassosimone/nuvolari/ndt5"
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// The following errors identify the phase of the test that failed. We
+// return them wrapping the error that caused the failure, hence use
+// errors.Is to check for them and errors.As to inspect the cause.
+var (
+	// ErrDialFailed means that we could not connect to the server, e.g.
+	// because of DNS, TCP or TLS errors.
+	ErrDialFailed = errors.New("Cannot connect to the server")
+
+	// ErrHandshake means that the WebSocket handshake failed, e.g. because
+	// the server does not support ndt7 or rejected our credentials.
+	ErrHandshake = errors.New("WebSocket handshake failed")
+
+	// ErrReadTimeout means that the server stopped sending data.
+	ErrReadTimeout = errors.New("Timed out reading from the server")
+
+	// ErrProtocolViolation means that the server sent invalid messages.
+	ErrProtocolViolation = errors.New("Server violated the protocol")
+
+	// ErrInterrupted means that the context was cancelled before the test
+	// was over. The cause is the error returned by the context.
+	ErrInterrupted = errors.New("Test interrupted")
+)
+
+// wrapError returns an error that wraps both class and cause.
+func wrapError(class, cause error) error {
+	return fmt.Errorf("%w: %w", class, cause)
+}
+
+// readError wraps err, which occurred reading from the server, with
+// ErrReadTimeout if it is a timeout, or with ErrProtocolViolation if the
+// server exceeded the read limit.
+func readError(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return wrapError(ErrProtocolViolation, err)
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return wrapError(ErrReadTimeout, err)
+	}
+	return err
+}
+
+// ErrorCode is a stable code identifying a class of failures, so that
+// applications can map failures to messages without parsing the error
+// strings, which may change between releases. The numeric values and the
+// names returned by String never change; we only add new codes.
+type ErrorCode int
+
+const (
+	// ErrorCodeNone means that there was no error.
+	ErrorCodeNone = ErrorCode(0)
+
+	// ErrorCodeGeneric is an error that does not fit any other class.
+	ErrorCodeGeneric = ErrorCode(1)
+
+	// ErrorCodeInvalidSettings means that the Settings are not valid.
+	ErrorCodeInvalidSettings = ErrorCode(2)
+
+	// ErrorCodeDNS means that resolving the server hostname failed.
+	ErrorCodeDNS = ErrorCode(3)
+
+	// ErrorCodeTimeout means that a network operation timed out.
+	ErrorCodeTimeout = ErrorCode(4)
+
+	// ErrorCodeNetwork means that a network operation failed.
+	ErrorCodeNetwork = ErrorCode(5)
+
+	// ErrorCodeHandshake means that the WebSocket handshake failed.
+	ErrorCodeHandshake = ErrorCode(6)
+
+	// ErrorCodeProtocol means that the server violated the protocol.
+	ErrorCodeProtocol = ErrorCode(7)
+
+	// ErrorCodeServer means that the server misbehaved.
+	ErrorCodeServer = ErrorCode(8)
+
+	// ErrorCodeLocate means that discovering the server failed.
+	ErrorCodeLocate = ErrorCode(9)
+
+	// ErrorCodeInterrupted means that the test was interrupted.
+	ErrorCodeInterrupted = ErrorCode(10)
+
+	// ErrorCodeCertificate means that the server certificate is not valid
+	// or does not match the pinned public keys.
+	ErrorCodeCertificate = ErrorCode(11)
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeNone:            "none",
+	ErrorCodeGeneric:         "generic",
+	ErrorCodeInvalidSettings: "invalid-settings",
+	ErrorCodeDNS:             "dns",
+	ErrorCodeTimeout:         "timeout",
+	ErrorCodeNetwork:         "network",
+	ErrorCodeHandshake:       "handshake",
+	ErrorCodeProtocol:        "protocol",
+	ErrorCodeServer:          "server",
+	ErrorCodeLocate:          "locate",
+	ErrorCodeInterrupted:     "interrupted",
+	ErrorCodeCertificate:     "certificate",
+}
+
+// String returns the stable name of the code (e.g. "timeout").
+func (code ErrorCode) String() string {
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+	return "generic"
+}
+
+// Retryable tells whether running the test again may succeed.
+func (code ErrorCode) Retryable() bool {
+	switch code {
+	case ErrorCodeTimeout, ErrorCodeNetwork, ErrorCodeHandshake, ErrorCodeServer, ErrorCodeLocate:
+		return true
+	}
+	return false
+}
+
+// ErrorCodeOf returns the code of err. It returns ErrorCodeNone if err is
+// nil and ErrorCodeGeneric if err does not belong to any class.
+func ErrorCodeOf(err error) ErrorCode {
+	switch {
+	case err == nil:
+		return ErrorCodeNone
+	case errors.Is(err, ErrInterrupted):
+		return ErrorCodeInterrupted
+	case errors.Is(err, ErrInvalidHostname), errors.Is(err, ErrInvalidPort),
+		errors.Is(err, ErrInvalidScheme), errors.Is(err, ErrInvalidPath),
+		errors.Is(err, ErrInsecureSettings), errors.Is(err, ErrInvalidCABundle),
+		errors.Is(err, ErrInvalidSourceAddress), errors.Is(err, ErrInvalidDuration),
+		errors.Is(err, ErrInvalidStreams), errors.Is(err, ErrInvalidPin),
+		errors.Is(err, ErrInvalidTLSConfig), errors.Is(err, ErrInvalidHandler):
+		return ErrorCodeInvalidSettings
+	case errors.Is(err, ErrPinMismatch):
+		return ErrorCodeCertificate
+	case errors.Is(err, ErrServerGoneWild), errors.Is(err, ndt5.ErrServerBusy),
+		errors.Is(err, ndt5.ErrServerFault):
+		return ErrorCodeServer
+	case errors.Is(err, ErrHandshake), errors.Is(err, websocket.ErrBadHandshake):
+		return ErrorCodeHandshake
+	case errors.Is(err, ErrProtocolViolation), errors.Is(err, spec.ErrInvalidMeasurement),
+		errors.Is(err, ndt5.ErrProtocolViolation):
+		return ErrorCodeProtocol
+	case errors.Is(err, ErrReadTimeout):
+		return ErrorCodeTimeout
+	case errors.Is(err, locate.ErrNoServers), errors.Is(err, locate.ErrUnexpectedStatus):
+		return ErrorCodeLocate
+	}
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return ErrorCodeDNS
+	}
+	var closeError *CloseError
+	if errors.As(err, &closeError) {
+		switch closeError.Code {
+		case websocket.CloseGoingAway, websocket.CloseInternalServerErr,
+			websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+			return ErrorCodeServer
+		}
+		return ErrorCodeProtocol
+	}
+	var wsCloseError *websocket.CloseError
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &wsCloseError) || errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+		return ErrorCodeProtocol
+	}
+	var certError *tls.CertificateVerificationError
+	if errors.As(err, &certError) {
+		return ErrorCodeCertificate
+	}
+	var netError net.Error
+	if errors.As(err, &netError) {
+		if netError.Timeout() {
+			return ErrorCodeTimeout
+		}
+		return ErrorCodeNetwork
+	}
+	if errors.Is(err, ErrDialFailed) {
+		return ErrorCodeNetwork
+	}
+	return ErrorCodeGeneric
+}
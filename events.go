@@ -0,0 +1,332 @@
+package nuvolari
+
+import (
+	"math"
+	"time"
+)
+
+// EventMask is a bitmask of classes of events.
+type EventMask uint
+
+const (
+	// EventLog selects log events (i.e. OnLogInfo).
+	EventLog EventMask = 1 << iota
+
+	// EventServerMeasurement selects server-side measurements.
+	EventServerMeasurement
+
+	// EventClientMeasurement selects client-side measurements.
+	EventClientMeasurement
+
+	// EventFinding selects signs of middlebox interference.
+	EventFinding
+
+	// EventProgress selects progress events.
+	EventProgress
+
+	// EventAll selects all classes of events.
+	EventAll = EventLog | EventServerMeasurement | EventClientMeasurement |
+		EventFinding | EventProgress
+)
+
+// wants tells whether the Handler wants to receive events of class.
+func (cl Client) wants(class EventMask) bool {
+	mask := cl.Settings.EventMask
+	if mask == 0 {
+		mask = EventAll
+	}
+	return cl.Handler != nil && (mask&class) != 0
+}
+
+// LogMessage is a structured log message. Code and Params allow user
+// interfaces to localize and match messages, while Message is the English
+// formatted message. The codes and their params are stable.
+type LogMessage struct {
+	// Code identifies the message (e.g. LogConnecting).
+	Code string `json:"code"`
+
+	// Params contains the parameters of the message (e.g. "url").
+	Params map[string]string `json:"params,omitempty"`
+
+	// Message is the formatted message in English.
+	Message string `json:"message"`
+
+	// TestID identifies the test, if any (see Settings.TestID).
+	TestID string `json:"test_id,omitempty"`
+}
+
+// String returns the formatted message.
+func (lm LogMessage) String() string {
+	return lm.Message
+}
+
+const (
+	// LogConnecting means that we're connecting to the "url" param.
+	LogConnecting = "connecting"
+
+	// LogDiscovered means that the Locate API returned the "machine" param
+	// as the closest server.
+	LogDiscovered = "discovered"
+
+	// LogConnected means that we're connected.
+	LogConnected = "connected"
+
+	// LogInterrupted means that the user interrupted the "test" param.
+	LogInterrupted = "interrupted"
+
+	// LogCongestionControl means that we're using the "algorithm" param
+	// as the TCP congestion control algorithm.
+	LogCongestionControl = "congestion-control"
+
+	// LogAttempt means that we're starting the "attempt" param attempt to
+	// connect, using the "server" param (see Settings.Retry).
+	LogAttempt = "attempt"
+
+	// LogAttemptFailed means that the "attempt" param attempt to connect
+	// failed with the "error" param and we're going to retry.
+	LogAttemptFailed = "attempt-failed"
+
+	// LogFallback means that we're running the test using the "protocol"
+	// param, since the server does not support ndt7.
+	LogFallback = "fallback"
+
+	// LogConverged means that we're ending the download early because
+	// the speed has converged (see Settings.Adaptive).
+	LogConverged = "converged"
+
+	// LogResolved means that the "hostname" param resolved to the comma
+	// separated "addresses" param in "elapsed" ms (see Settings.Resolver).
+	LogResolved = "resolved"
+
+	// LogTLSHandshake means that we completed the TLS handshake. The
+	// params describe the connection (see TLSInfoOf).
+	LogTLSHandshake = "tls-handshake"
+
+	// LogConnectionSetup means that we established the connection. The
+	// params break down the time it took (see ConnectionSetupOf).
+	LogConnectionSetup = "connection-setup"
+
+	// LogReconnecting means that the "test" param failed with the "error"
+	// param and we're reconnecting to continue (see Settings.Reconnect).
+	LogReconnecting = "reconnecting"
+)
+
+// logInfo emits a log message, where params contains key/value pairs.
+func (cl Client) logInfo(code, message string, params ...string) {
+	if !cl.wants(EventLog) {
+		return
+	}
+	lm := LogMessage{Code: code, Message: message, TestID: cl.Settings.TestID}
+	if len(params) > 0 {
+		lm.Params = make(map[string]string)
+		for i := 0; i+1 < len(params); i += 2 {
+			lm.Params[params[i]] = params[i+1]
+		}
+	}
+	cl.Handler.OnLogInfo(lm)
+}
+
+func (cl Client) serverDownloadMeasurement(m Measurement) {
+	if m.TestID == "" {
+		m.TestID = cl.Settings.TestID
+	}
+	if cl.wants(EventServerMeasurement) {
+		cl.Handler.OnServerDownloadMeasurement(cl.redactMeasurement(m))
+	}
+}
+
+func (cl Client) clientDownloadMeasurement(m Measurement) {
+	if m.TestID == "" {
+		m.TestID = cl.Settings.TestID
+	}
+	if cl.wants(EventClientMeasurement) {
+		cl.Handler.OnClientDownloadMeasurement(cl.redactMeasurement(m))
+	}
+}
+
+func (cl Client) serverUploadMeasurement(m Measurement) {
+	if m.TestID == "" {
+		m.TestID = cl.Settings.TestID
+	}
+	if cl.wants(EventServerMeasurement) {
+		cl.Handler.OnServerUploadMeasurement(cl.redactMeasurement(m))
+	}
+}
+
+func (cl Client) clientUploadMeasurement(m Measurement) {
+	if m.TestID == "" {
+		m.TestID = cl.Settings.TestID
+	}
+	if cl.wants(EventClientMeasurement) {
+		cl.Handler.OnClientUploadMeasurement(cl.redactMeasurement(m))
+	}
+}
+
+// Progress is a lightweight event describing the progress of a test, which
+// allows to drive a progress bar without understanding measurements.
+type Progress struct {
+	// Phase is the current phase (e.g. PhaseDownload).
+	Phase string `json:"phase"`
+
+	// Percent is the percentage of the test duration that has elapsed,
+	// between 0 and 100.
+	Percent float64 `json:"percent"`
+
+	// ETA is the estimated number of seconds until the end of the test.
+	ETA float64 `json:"eta"`
+
+	// TestID identifies the test, if any (see Settings.TestID).
+	TestID string `json:"test_id,omitempty"`
+}
+
+const (
+	// PhaseConnecting means that we're connecting to the server.
+	PhaseConnecting = "connecting"
+
+	// PhaseDownload means that we're running the download.
+	PhaseDownload = "download"
+
+	// PhaseUpload means that we're running the upload.
+	PhaseUpload = "upload"
+
+	// PhaseBidirectional means that we're running the download and the
+	// upload concurrently (see Client.RunBidirectional).
+	PhaseBidirectional = "bidirectional"
+
+	// PhaseFinalizing means that the measurement is over and we're
+	// closing the connection.
+	PhaseFinalizing = "finalizing"
+)
+
+// progressInterval is the interval between progress events.
+const progressInterval = 100 * time.Millisecond
+
+// progress emits a progress event. Since the tests last for a fixed
+// duration, we estimate the remaining time from the elapsed time.
+func (cl Client) progress(phase string, elapsed time.Duration) {
+	if cl.wants(EventProgress) {
+		duration := cl.Settings.duration().Seconds()
+		cl.Handler.OnProgress(Progress{
+			Phase:   phase,
+			Percent: math.Min(100, 100*elapsed.Seconds()/duration),
+			ETA:     math.Max(0, duration-elapsed.Seconds()),
+			TestID:  cl.Settings.TestID,
+		})
+	}
+}
+
+func (cl Client) finding(f Finding) {
+	if f.TestID == "" {
+		f.TestID = cl.Settings.TestID
+	}
+	if cl.wants(EventFinding) {
+		cl.Handler.OnFinding(f)
+	}
+}
+
+// maskedHandler delivers to Handler only the events selected by mask, so
+// that we can apply the Settings.EventMask to some Handlers only.
+type maskedHandler struct {
+	Handler
+	mask EventMask
+}
+
+func (mh maskedHandler) OnLogInfo(m LogMessage) {
+	if mh.mask&EventLog != 0 {
+		mh.Handler.OnLogInfo(m)
+	}
+}
+
+func (mh maskedHandler) OnServerDownloadMeasurement(m Measurement) {
+	if mh.mask&EventServerMeasurement != 0 {
+		mh.Handler.OnServerDownloadMeasurement(m)
+	}
+}
+
+func (mh maskedHandler) OnClientDownloadMeasurement(m Measurement) {
+	if mh.mask&EventClientMeasurement != 0 {
+		mh.Handler.OnClientDownloadMeasurement(m)
+	}
+}
+
+func (mh maskedHandler) OnServerUploadMeasurement(m Measurement) {
+	if mh.mask&EventServerMeasurement != 0 {
+		mh.Handler.OnServerUploadMeasurement(m)
+	}
+}
+
+func (mh maskedHandler) OnClientUploadMeasurement(m Measurement) {
+	if mh.mask&EventClientMeasurement != 0 {
+		mh.Handler.OnClientUploadMeasurement(m)
+	}
+}
+
+func (mh maskedHandler) OnFinding(f Finding) {
+	if mh.mask&EventFinding != 0 {
+		mh.Handler.OnFinding(f)
+	}
+}
+
+func (mh maskedHandler) OnProgress(p Progress) {
+	if mh.mask&EventProgress != 0 {
+		mh.Handler.OnProgress(p)
+	}
+}
+
+type multiHandler []Handler
+
+func (mh multiHandler) OnLogInfo(m LogMessage) {
+	for _, h := range mh {
+		h.OnLogInfo(m)
+	}
+}
+
+func (mh multiHandler) OnServerDownloadMeasurement(m Measurement) {
+	for _, h := range mh {
+		h.OnServerDownloadMeasurement(m)
+	}
+}
+
+func (mh multiHandler) OnClientDownloadMeasurement(m Measurement) {
+	for _, h := range mh {
+		h.OnClientDownloadMeasurement(m)
+	}
+}
+
+func (mh multiHandler) OnServerUploadMeasurement(m Measurement) {
+	for _, h := range mh {
+		h.OnServerUploadMeasurement(m)
+	}
+}
+
+func (mh multiHandler) OnClientUploadMeasurement(m Measurement) {
+	for _, h := range mh {
+		h.OnClientUploadMeasurement(m)
+	}
+}
+
+func (mh multiHandler) OnProgress(p Progress) {
+	for _, h := range mh {
+		h.OnProgress(p)
+	}
+}
+
+func (mh multiHandler) OnFinding(f Finding) {
+	for _, h := range mh {
+		h.OnFinding(f)
+	}
+}
+
+// MultiHandler returns a Handler that delivers each event to all the
+// specified handlers, sequentially and in order, so that a single test
+// can feed, e.g., a user interface and a file at the same time. Nil
+// handlers are ignored.
+func MultiHandler(handlers ...Handler) Handler {
+	var mh multiHandler
+	for _, h := range handlers {
+		if h != nil {
+			mh = append(mh, h)
+		}
+	}
+	return mh
+}
@@ -0,0 +1,74 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/bassosimone/nuvolari/ndt5"
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// shouldFallBack tells whether, after failing to connect to wsURL with
+// err, we should run the test using ndt5 (see Settings.FallbackToNDT5).
+func (cl Client) shouldFallBack(err error, wsURL url.URL) bool {
+	return cl.Settings.FallbackToNDT5 && wsURL.Hostname() != "" &&
+		errors.Is(err, ErrHandshake)
+}
+
+// runNDT5 runs test, either "download" or "upload", using ndt5 with the
+// server at hostname, i.e. the one that refused the ndt7 handshake. It emits
+// the client measurements and, at the end, a server measurement with the
+// throughput measured by the server, like the ndt7 tests do.
+func (cl Client) runNDT5(ctx context.Context, test, hostname string) error {
+	cl.logInfo(LogFallback, "Server does not support ndt7: falling back to ndt5",
+		"protocol", "ndt5")
+	dialer, err := cl.Settings.makeNetDialer()
+	if err != nil {
+		return err
+	}
+	dialer.Timeout = timeout(cl.Settings.DialTimeout)
+	// The server chooses the duration, which the progress depends on
+	cl.Settings.Duration = ndt5.Duration
+	emit, run, phase := Client.clientDownloadMeasurement, ndt5.Client.Download, PhaseDownload
+	emitServer := Client.serverDownloadMeasurement
+	if test == spec.TestUpload {
+		emit, run, phase = Client.clientUploadMeasurement, ndt5.Client.Upload, PhaseUpload
+		emitServer = Client.serverUploadMeasurement
+	}
+	var tLast time.Duration
+	var countLast int64
+	measurement := func(elapsed time.Duration, count int64) Measurement {
+		m := cl.clientMeasurement(test, elapsed, count, elapsed-tLast, count-countLast)
+		tLast, countLast = elapsed, count
+		return m
+	}
+	client := ndt5.Client{
+		Hostname: hostname,
+		Dialer:   dialer,
+		OnProgress: func(elapsed time.Duration, count int64) {
+			cl.progress(phase, elapsed)
+			if elapsed-tLast >= spec.MinMeasurementInterval {
+				emit(cl, measurement(elapsed, count))
+			}
+		},
+	}
+	result, err := run(client, ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			cl.logInfo(LogInterrupted, interruptedMessage(test), "test", test)
+			return wrapError(ErrInterrupted, ctx.Err())
+		}
+		return err
+	}
+	emit(cl, measurement(result.Elapsed, result.NumBytes))
+	emitServer(cl, Measurement{
+		Origin:     spec.OriginServer,
+		Test:       test,
+		Elapsed:    result.Elapsed.Seconds(),
+		Throughput: result.ServerThroughput,
+	})
+	cl.progress(PhaseFinalizing, cl.Settings.duration())
+	return nil
+}
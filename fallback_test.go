@@ -0,0 +1,58 @@
+package nuvolari
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// logRecorder is a Handler recording the codes of the log messages.
+type logRecorder struct {
+	Handler
+	codes []string
+}
+
+func (lr *logRecorder) OnLogInfo(m LogMessage) {
+	lr.codes = append(lr.codes, m.Code)
+}
+
+func TestFallbackUsesTheRefusingServer(t *testing.T) {
+	// A server that does not speak ndt7, hence refuses the handshake
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &logRecorder{Handler: MultiHandler()}
+	cl := Client{Handler: recorder, Settings: Settings{
+		Servers:        []string{host},
+		Port:           port,
+		Scheme:         "ws",
+		FallbackToNDT5: true,
+	}}
+	// There is no ndt5 server, hence the fallback fails to connect, but
+	// the error tells us which server it used.
+	if conn, err := net.Dial("tcp", net.JoinHostPort(host, "3001")); err == nil {
+		conn.Close()
+		t.Skip("something is listening on the ndt5 port")
+	}
+	err = cl.RunDownload(context.Background())
+	if err == nil || !strings.Contains(err.Error(), net.JoinHostPort(host, "3001")) {
+		t.Fatalf("expected the fallback to connect to %s, got %v", host, err)
+	}
+	for _, code := range recorder.codes {
+		if code == LogFallback {
+			return
+		}
+	}
+	t.Fatal("expected the fallback log message")
+}
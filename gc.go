@@ -0,0 +1,48 @@
+package nuvolari
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// The GC settings are global, hence we reference count the running tests
+// that asked to tune the GC and restore the original settings when the
+// last one of them terminates. When tests run concurrently, the settings
+// of the first test that started win.
+var (
+	gcMu             sync.Mutex
+	gcUsers          int
+	savedGCPercent   int
+	savedMemoryLimit int64
+)
+
+// tuneGC applies the GC settings, if any, and returns a function that
+// restores the previous settings when the measurement is over.
+func (s Settings) tuneGC() func() {
+	if s.GCPercent == 0 && s.MemoryLimit == 0 {
+		return func() {}
+	}
+	gcMu.Lock()
+	defer gcMu.Unlock()
+	if gcUsers == 0 {
+		savedGCPercent = debug.SetGCPercent(-1)
+		debug.SetGCPercent(savedGCPercent)
+		savedMemoryLimit = debug.SetMemoryLimit(-1)
+		if s.GCPercent != 0 {
+			debug.SetGCPercent(s.GCPercent)
+		}
+		if s.MemoryLimit != 0 {
+			debug.SetMemoryLimit(s.MemoryLimit)
+		}
+	}
+	gcUsers++
+	return func() {
+		gcMu.Lock()
+		defer gcMu.Unlock()
+		gcUsers--
+		if gcUsers == 0 {
+			debug.SetGCPercent(savedGCPercent)
+			debug.SetMemoryLimit(savedMemoryLimit)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//go:build integration
+// +build integration
+
+package nuvolari
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari/server"
+)
+
+// The integration tests run against the server in NUVOLARI_TEST_SERVER,
+// given as host or host:port, if set, or else against a local server.
+//
+//	go test -tags integration -run Integration .
+
+// orderHandler is a Handler checking the order of the events of a test.
+type orderHandler struct {
+	mu         sync.Mutex
+	connected  bool
+	lastClient Measurement
+	lastServer Measurement
+	numClient  int
+	numServer  int
+	percent    float64
+	violations []string
+}
+
+func (oh *orderHandler) violation(format string, v ...interface{}) {
+	oh.violations = append(oh.violations, fmt.Sprintf(format, v...))
+}
+
+func (oh *orderHandler) OnLogInfo(m LogMessage) {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	if m.Code == LogConnected {
+		oh.connected = true
+	}
+}
+
+func (oh *orderHandler) server(m Measurement) {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	if !oh.connected {
+		oh.violation("server measurement before connecting")
+	}
+	if m.Elapsed < oh.lastServer.Elapsed {
+		oh.violation("server elapsed went backwards")
+	}
+	oh.lastServer = m
+	oh.numServer++
+}
+
+func (oh *orderHandler) client(m Measurement) {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	if !oh.connected {
+		oh.violation("client measurement before connecting")
+	}
+	if m.Elapsed < oh.lastClient.Elapsed || m.NumBytes < oh.lastClient.NumBytes {
+		oh.violation("client measurement went backwards")
+	}
+	oh.lastClient = m
+	oh.numClient++
+}
+
+func (oh *orderHandler) OnServerDownloadMeasurement(m Measurement) { oh.server(m) }
+func (oh *orderHandler) OnClientDownloadMeasurement(m Measurement) { oh.client(m) }
+func (oh *orderHandler) OnServerUploadMeasurement(m Measurement)   { oh.server(m) }
+func (oh *orderHandler) OnClientUploadMeasurement(m Measurement)   { oh.client(m) }
+func (oh *orderHandler) OnFinding(Finding)                         {}
+
+func (oh *orderHandler) OnProgress(p Progress) {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	if p.Percent < oh.percent {
+		oh.violation("progress went backwards")
+	}
+	oh.percent = p.Percent
+}
+
+// countingListener counts the bytes read and written on the connections
+// it accepts, i.e. the bytes on the wire, excluding the TCP/IP headers.
+type countingListener struct {
+	net.Listener
+	read, written *int64
+}
+
+func (cl countingListener) Accept() (net.Conn, error) {
+	conn, err := cl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, read: cl.read, written: cl.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	read, written *int64
+}
+
+func (cc countingConn) Read(data []byte) (int, error) {
+	n, err := cc.Conn.Read(data)
+	atomic.AddInt64(cc.read, int64(n))
+	return n, err
+}
+
+func (cc countingConn) Write(data []byte) (int, error) {
+	n, err := cc.Conn.Write(data)
+	atomic.AddInt64(cc.written, int64(n))
+	return n, err
+}
+
+// localServer is the state of the local server.
+type localServer struct {
+	wg            sync.WaitGroup
+	read, written int64
+}
+
+// integrationClient returns the Client to use and the local server, which
+// is nil when using NUVOLARI_TEST_SERVER.
+func integrationClient(t *testing.T) (Client, *localServer) {
+	if hostport := os.Getenv("NUVOLARI_TEST_SERVER"); hostport != "" {
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			host, port = hostport, ""
+		}
+		cl := Client{Settings: Settings{Hostname: host, Port: port, Duration: 2 * time.Second}}
+		return cl, nil
+	}
+	ls := &localServer{}
+	mux := server.NewServeMux()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ls.wg.Add(1)
+		defer ls.wg.Done()
+		mux.ServeHTTP(w, r)
+	}))
+	srv.Listener = countingListener{Listener: srv.Listener, read: &ls.read, written: &ls.written}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := Client{Settings: Settings{
+		Hostname: host, Port: port, Scheme: "ws", Duration: 2 * time.Second,
+	}}
+	return cl, ls
+}
+
+// closed tells whether the server handlers returned, which happens when
+// the closing handshake is over, within a short time after the test.
+func (ls *localServer) closed() bool {
+	done := make(chan struct{})
+	go func() {
+		ls.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(3 * time.Second):
+		return false
+	}
+}
+
+func testIntegration(t *testing.T, test string) {
+	cl, ls := integrationClient(t)
+	handler := &orderHandler{}
+	cl.Handler = handler
+	var err error
+	switch test {
+	case "download":
+		err = cl.RunDownload(context.Background())
+	case "upload":
+		err = cl.RunUpload(context.Background())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls != nil && !ls.closed() {
+		t.Fatal("the server did not complete the closing handshake")
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	for _, v := range handler.violations {
+		t.Error(v)
+	}
+	if handler.numClient <= 0 || handler.numServer <= 0 {
+		t.Fatalf("expected client and server measurements, got %d and %d",
+			handler.numClient, handler.numServer)
+	}
+	// Each side measures at its own cadence, hence the last measurements
+	// may differ by about one interval worth of data.
+	client, server := handler.lastClient.NumBytes, handler.lastServer.NumBytes
+	if client <= 0 || server <= 0 || math.Abs(float64(client-server)) > 0.25*float64(server) {
+		t.Fatalf("inconsistent byte counts: client %d, server %d", client, server)
+	}
+	if ls == nil {
+		return
+	}
+	// The payload cannot exceed what the server transferred on the wire.
+	wire := atomic.LoadInt64(&ls.written)
+	if test == "upload" {
+		wire = atomic.LoadInt64(&ls.read)
+	}
+	if client > wire {
+		t.Fatalf("client counted %d bytes, but the wire carried %d", client, wire)
+	}
+}
+
+func TestIntegrationDownload(t *testing.T) {
+	testIntegration(t, "download")
+}
+
+func TestIntegrationUpload(t *testing.T) {
+	testIntegration(t, "upload")
+}
@@ -0,0 +1,88 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// Finding is a sign that a middlebox may be interfering with the test.
+type Finding struct {
+	// Code identifies the kind of finding (e.g. "stripped-header").
+	Code string `json:"code"`
+
+	// Detail describes the finding in human readable form.
+	Detail string `json:"detail"`
+
+	// TestID identifies the test (see Settings.TestID).
+	TestID string `json:"test_id,omitempty"`
+}
+
+const (
+	// FindingStrippedHeader means that the response lacks the ndt7
+	// subprotocol header, which a middlebox may have stripped.
+	FindingStrippedHeader = "stripped-header"
+
+	// FindingUnexpectedSubprotocol means that the response contains a
+	// subprotocol different from the one we requested.
+	FindingUnexpectedSubprotocol = "unexpected-subprotocol"
+
+	// FindingTruncatedData means that we received fewer bytes than the
+	// server claims to have sent.
+	FindingTruncatedData = "truncated-data"
+
+	// FindingTLSDowngrade means that the TLS version is older than any
+	// version that a modern server would negotiate.
+	FindingTLSDowngrade = "tls-downgrade"
+
+	// FindingUnverifiedCertificate means that, while skipping TLS verify,
+	// we noticed that the certificate would not have been valid, which
+	// happens with self-signed certificates but also with TLS MITM.
+	FindingUnverifiedCertificate = "unverified-certificate"
+)
+
+// checkHandshake looks for signs of interference in the handshake.
+func (cl Client) checkHandshake(conn *websocket.Conn, resp *http.Response) {
+	if resp != nil && resp.Header.Get("Sec-WebSocket-Protocol") == "" {
+		cl.finding(Finding{
+			Code:   FindingStrippedHeader,
+			Detail: "the response lacks the Sec-WebSocket-Protocol header",
+		})
+	} else if conn.Subprotocol() != spec.SecWebSocketProtocol {
+		cl.finding(Finding{
+			Code:   FindingUnexpectedSubprotocol,
+			Detail: fmt.Sprintf("the server selected %q", conn.Subprotocol()),
+		})
+	}
+	tlsConn, ok := conn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	if state.Version < tls.VersionTLS12 {
+		cl.finding(Finding{
+			Code:   FindingTLSDowngrade,
+			Detail: fmt.Sprintf("negotiated TLS version 0x%04x", state.Version),
+		})
+	}
+	if cl.Settings.SkipTLSVerify && len(state.PeerCertificates) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       cl.Settings.Hostname,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			cl.finding(Finding{
+				Code:   FindingUnverifiedCertificate,
+				Detail: cl.redactError(err).Error(),
+			})
+		}
+	}
+}
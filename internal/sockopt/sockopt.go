@@ -0,0 +1,30 @@
+// Package sockopt reads and writes socket options of the connections
+// used for measuring, where the operating system allows that.
+package sockopt
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrUnsupported is returned when the operation is not supported on this
+// system or the connection does not wrap a socket.
+var ErrUnsupported = errors.New("Operation not supported")
+
+// ErrUnknownAlgorithm is returned when the kernel does not provide the
+// requested congestion control algorithm.
+var ErrUnknownAlgorithm = errors.New("Congestion control algorithm not available")
+
+// rawConn returns the raw socket below conn, unwrapping TLS if needed.
+func rawConn(conn net.Conn) (syscall.RawConn, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return sc.SyscallConn()
+}
@@ -0,0 +1,134 @@
+package sockopt
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// MSS returns the maximum segment size of the TCP connection below conn.
+func MSS(conn net.Conn) (int, error) {
+	return getsockoptInt(conn, syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+}
+
+// SendBufferSize returns the SO_SNDBUF of the socket below conn. Note that
+// Linux doubles the requested value to account for bookkeeping overhead.
+func SendBufferSize(conn net.Conn) (int, error) {
+	return getsockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+}
+
+// ReceiveBufferSize returns the SO_RCVBUF of the socket below conn. Note
+// that Linux doubles the requested value, like for SO_SNDBUF.
+func ReceiveBufferSize(conn net.Conn) (int, error) {
+	return getsockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+}
+
+// SetCongestionControl sets the congestion control algorithm (e.g. "bbr")
+// of the TCP connection below conn.
+func SetCongestionControl(conn net.Conn, name string) error {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+	var soerr error
+	err = rc.Control(func(fd uintptr) {
+		soerr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+	})
+	if err != nil {
+		return err
+	}
+	if soerr == syscall.ENOENT {
+		return ErrUnknownAlgorithm
+	}
+	return soerr
+}
+
+// tcpCANameMax is TCP_CA_NAME_MAX, the maximum length of the name of a
+// congestion control algorithm, including the terminating zero.
+const tcpCANameMax = 16
+
+// CongestionControl returns the name of the congestion control algorithm
+// (e.g. "cubic") of the TCP connection below conn.
+func CongestionControl(conn net.Conn) (string, error) {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return "", err
+	}
+	var name [tcpCANameMax]byte
+	size := uint32(len(name))
+	var soerr error
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+			uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			soerr = errno
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if soerr != nil {
+		return "", soerr
+	}
+	return string(bytes.TrimRight(name[:size], "\x00")), nil
+}
+
+// tcpNotSentLowat is TCP_NOTSENT_LOWAT, which package syscall lacks.
+const tcpNotSentLowat = 25
+
+// SetNotSentLowat sets the TCP_NOTSENT_LOWAT of the TCP connection below
+// conn, i.e. the amount of unsent bytes above which the socket is not
+// writable anymore.
+func SetNotSentLowat(conn net.Conn, value int) error {
+	return setsockoptInt(conn, syscall.IPPROTO_TCP, tcpNotSentLowat, value)
+}
+
+// setsockoptInt writes an integer socket option of conn.
+func setsockoptInt(conn net.Conn, level, name, value int) error {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+	var soerr error
+	err = rc.Control(func(fd uintptr) {
+		soerr = syscall.SetsockoptInt(int(fd), level, name, value)
+	})
+	if err != nil {
+		return err
+	}
+	return soerr
+}
+
+// getsockoptInt reads an integer socket option of conn.
+func getsockoptInt(conn net.Conn, level, name int) (int, error) {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return 0, err
+	}
+	var value int
+	var soerr error
+	err = rc.Control(func(fd uintptr) {
+		value, soerr = syscall.GetsockoptInt(int(fd), level, name)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, soerr
+}
+
+// BindToDevice returns a net.Dialer Control function that binds sockets
+// to the named network interface (e.g. "wwan0") using SO_BINDTODEVICE.
+func BindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var soerr error
+		err := c.Control(func(fd uintptr) {
+			soerr = syscall.BindToDevice(int(fd), device)
+		})
+		if err != nil {
+			return err
+		}
+		return soerr
+	}, nil
+}
@@ -0,0 +1,49 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+)
+
+// MSS returns the maximum segment size of the TCP connection below conn.
+func MSS(conn net.Conn) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// SendBufferSize returns the SO_SNDBUF of the socket below conn.
+func SendBufferSize(conn net.Conn) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// ReceiveBufferSize returns the SO_RCVBUF of the socket below conn.
+func ReceiveBufferSize(conn net.Conn) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// SetCongestionControl sets the congestion control algorithm (e.g. "bbr")
+// of the TCP connection below conn.
+func SetCongestionControl(conn net.Conn, name string) error {
+	return ErrUnsupported
+}
+
+// CongestionControl returns the name of the congestion control algorithm
+// (e.g. "cubic") of the TCP connection below conn.
+func CongestionControl(conn net.Conn) (string, error) {
+	return "", ErrUnsupported
+}
+
+// SetNotSentLowat sets the TCP_NOTSENT_LOWAT of the TCP connection below
+// conn, i.e. the amount of unsent bytes above which the socket is not
+// writable anymore.
+func SetNotSentLowat(conn net.Conn, value int) error {
+	return ErrUnsupported
+}
+
+// BindToDevice returns a net.Dialer Control function that binds sockets
+// to the named network interface (e.g. "wwan0") using SO_BINDTODEVICE.
+func BindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,90 @@
+package sockopt
+
+// TCPInfo mirrors struct tcp_info in linux/tcp.h, which is only available
+// on Linux. We cannot use syscall.TCPInfo because it lacks the fields added
+// by recent kernels. Older kernels fill only a prefix of the structure,
+// leaving the other fields zero. All the 64 bit fields are naturally
+// aligned, so the layout is the same also on 32 bit systems.
+type TCPInfo struct {
+	State       uint8
+	CAState     uint8
+	Retransmits uint8
+	Probes      uint8
+	Backoff     uint8
+	Options     uint8
+	WScale      uint8
+	AppLimited  uint8
+
+	RTO    uint32
+	ATO    uint32
+	SndMSS uint32
+	RcvMSS uint32
+
+	Unacked uint32
+	Sacked  uint32
+	Lost    uint32
+	Retrans uint32
+	Fackets uint32
+
+	LastDataSent uint32
+	LastAckSent  uint32
+	LastDataRecv uint32
+	LastAckRecv  uint32
+
+	PMTU        uint32
+	RcvSsthresh uint32
+	RTT         uint32
+	RTTVar      uint32
+	SndSsthresh uint32
+	SndCwnd     uint32
+	AdvMSS      uint32
+	Reordering  uint32
+
+	RcvRTT   uint32
+	RcvSpace uint32
+
+	TotalRetrans uint32
+
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+
+	NotsentBytes uint32
+	MinRTT       uint32
+	DataSegsIn   uint32
+	DataSegsOut  uint32
+
+	DeliveryRate uint64
+
+	BusyTime      uint64
+	RwndLimited   uint64
+	SndbufLimited uint64
+
+	Delivered   uint32
+	DeliveredCE uint32
+
+	BytesSent    uint64
+	BytesRetrans uint64
+	DSACKDups    uint32
+	ReordSeen    uint32
+
+	RcvOOOPack uint32
+
+	SndWnd uint32
+	RcvWnd uint32
+
+	Rehash uint32
+
+	TotalRTO           uint16
+	TotalRTORecoveries uint16
+	TotalRTOTime       uint32
+}
+
+// Bits of TCPInfo.Options.
+const (
+	TCPIOptECN     = 8
+	TCPIOptECNSeen = 16
+)
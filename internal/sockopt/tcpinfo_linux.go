@@ -0,0 +1,30 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// GetTCPInfo returns the TCP_INFO of the TCP connection below conn.
+func GetTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	var info TCPInfo
+	var soerr error
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			soerr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, soerr
+}
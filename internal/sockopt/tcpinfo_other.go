@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import "net"
+
+// GetTCPInfo returns the TCP_INFO of the TCP connection below conn.
+func GetTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	return nil, ErrUnsupported
+}
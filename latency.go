@@ -0,0 +1,146 @@
+package nuvolari
+
+import (
+	"math"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/bassosimone/nuvolari/stats"
+)
+
+// LatencyUnderLoad describes how much the RTT grows while the link is
+// loaded by the test, i.e. the bufferbloat. All the times are in
+// milliseconds.
+type LatencyUnderLoad struct {
+	// IdleRTT is the minimum RTT we observed, which approximates the RTT
+	// of the idle link.
+	IdleRTT float64 `json:"idle_rtt"`
+
+	// LoadedRTT is the median of the RTT measured in each interval of
+	// the test, while the link was loaded.
+	LoadedRTT float64 `json:"loaded_rtt"`
+
+	// Inflation is LoadedRTT divided by IdleRTT, which is close to one
+	// on links without bufferbloat.
+	Inflation float64 `json:"inflation"`
+
+	// RPM is the responsiveness under load in round trips per minute,
+	// i.e. 60000 divided by LoadedRTT. The higher, the better.
+	RPM float64 `json:"rpm"`
+}
+
+// newLatencyUnderLoad returns the LatencyUnderLoad given the minimum RTT
+// idle and the loaded RTT samples, or nil if either is not known. We use
+// the minimum that the client measurements refer to, rather than MinRTT,
+// so that we compare RTTs measured in the same way.
+func newLatencyUnderLoad(idle float64, loaded []float64) *LatencyUnderLoad {
+	if len(loaded) <= 0 {
+		return nil
+	}
+	median := stats.Median(loaded)
+	if idle <= 0 || median <= 0 {
+		return nil
+	}
+	return &LatencyUnderLoad{
+		IdleRTT:   idle,
+		LoadedRTT: median,
+		Inflation: median / idle,
+		RPM:       60000 / median,
+	}
+}
+
+// latencyTracker sets the LoadedRTT and RTTInflation of the client
+// measurements of a connection, tracking the minimum RTT so far.
+type latencyTracker struct {
+	idle float64 // minimum RTT in milliseconds, zero if unknown
+	last float64 // last application-level RTT sample, zero if none
+}
+
+// addServer updates the minimum RTT using the server measurement m.
+func (lt *latencyTracker) addServer(m Measurement) {
+	if m.BBRInfo != nil && m.BBRInfo.MinRTT > 0 {
+		lt.idle = minRTT(lt.idle, m.BBRInfo.MinRTT)
+	}
+	if m.TCPInfo != nil && m.TCPInfo.MinRTT > 0 {
+		lt.idle = minRTT(lt.idle, float64(m.TCPInfo.MinRTT)/1000)
+	}
+}
+
+// measure sets the LoadedRTT, RTTInflation and Jitter of the client
+// measurement m, if we have RTT samples. We prefer the application-level
+// samples, which are what applications experience, and otherwise use
+// TCP_INFO, where the receiver estimate is more accurate during the
+// download.
+func (lt *latencyTracker) measure(m *Measurement) {
+	var loaded float64
+	switch info := m.TCPInfo; {
+	case len(m.AppRTT) > 0:
+		loaded = stats.Median(m.AppRTT)
+		lt.idle = minRTT(lt.idle, stats.Min(m.AppRTT))
+		m.Jitter = lt.jitter(m.AppRTT)
+	case info != nil && m.Test == spec.TestDownload && info.RcvRTT > 0:
+		loaded = float64(info.RcvRTT) / 1000
+		m.Jitter = float64(info.RTTVar) / 1000
+	case info != nil && info.RTT > 0:
+		loaded = float64(info.RTT) / 1000
+		m.Jitter = float64(info.RTTVar) / 1000
+	}
+	if loaded <= 0 {
+		return
+	}
+	lt.idle = minRTT(lt.idle, loaded)
+	m.LoadedRTT = loaded
+	m.RTTInflation = loaded / lt.idle
+}
+
+// jitter returns the mean absolute difference between consecutive RTT
+// samples, including the last sample of the previous interval, like the
+// interarrival jitter of RFC 3550 without smoothing.
+func (lt *latencyTracker) jitter(samples []float64) float64 {
+	var sum float64
+	var count int
+	for _, rtt := range samples {
+		if lt.last > 0 {
+			sum += math.Abs(rtt - lt.last)
+			count++
+		}
+		lt.last = rtt
+	}
+	if count <= 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// arrivalTracker measures the variability of the time between the arrival
+// of consecutive download messages, which grows when the path delivers
+// data in bursts (e.g. because of Wi-Fi aggregation or queueing).
+type arrivalTracker struct {
+	last        time.Time
+	count       int
+	mean, accum float64 // running mean and sum of squares of differences
+}
+
+// add records that a message arrived at t.
+func (at *arrivalTracker) add(t time.Time) {
+	if !at.last.IsZero() {
+		// We use Welford's algorithm to avoid storing the samples
+		x := milliseconds(t.Sub(at.last))
+		at.count++
+		delta := x - at.mean
+		at.mean += delta / float64(at.count)
+		at.accum += delta * (x - at.mean)
+	}
+	at.last = t
+}
+
+// takeJitter returns the standard deviation, in milliseconds, of the
+// interarrival times since the previous call.
+func (at *arrivalTracker) takeJitter() float64 {
+	var jitter float64
+	if at.count > 1 {
+		jitter = math.Sqrt(at.accum / float64(at.count))
+	}
+	at.count, at.mean, at.accum = 0, 0, 0
+	return jitter
+}
@@ -0,0 +1,123 @@
+// Package locate implements a client for the M-Lab Locate API, which
+// returns the ndt7 servers that are closest to the client. The API is
+// documented at https://github.com/m-lab/locate.
+package locate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultURL is the default Locate API URL for ndt7.
+const DefaultURL = "https://locate.measurementlab.net/v2/nearest/ndt/ndt7"
+
+// Location is the location of a server.
+type Location struct {
+	// City is the city where the server is.
+	City string `json:"city"`
+
+	// Country is the country where the server is.
+	Country string `json:"country"`
+}
+
+// Result is a server returned by the Locate API.
+type Result struct {
+	// Machine is the name of the machine (e.g. mlab1-lga05.mlab-oti.measurement-lab.org).
+	Machine string `json:"machine"`
+
+	// Location is the optional location of the machine.
+	Location *Location `json:"location,omitempty"`
+
+	// URLs maps URL templates (e.g. "wss:///ndt/v7/download") to the
+	// actual URLs to use, which include access tokens.
+	URLs map[string]string `json:"urls"`
+}
+
+// Metro returns the metro code of the machine (e.g. "lga") or an empty
+// string if the machine name is not in the expected format.
+func (r Result) Metro() string {
+	v := strings.SplitN(r.Machine, ".", 2)
+	v = strings.SplitN(v[0], "-", 2)
+	if len(v) != 2 || len(v[1]) < 3 {
+		return ""
+	}
+	return v[1][:3]
+}
+
+// URL returns the URL to use for the specified URL template (e.g.
+// "wss:///ndt/v7/download") or nil if no such URL is available.
+func (r Result) URL(template string) *url.URL {
+	s, ok := r.URLs[template]
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// Hostname returns the hostname of the ndt7 server, which may differ from
+// the machine name, or an empty string if there is no suitable URL.
+func (r Result) Hostname() string {
+	for _, s := range r.URLs {
+		if u, err := url.Parse(s); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	return ""
+}
+
+// Client is a Locate API client.
+type Client struct {
+	// URL is the Locate API URL. If empty, we use DefaultURL.
+	URL string
+
+	// HTTPClient is the HTTP client. If nil, we use http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// ErrUnexpectedStatus is returned when the Locate API fails.
+var ErrUnexpectedStatus = errors.New("Locate API returned unexpected status")
+
+// ErrNoServers is returned when the Locate API returns no servers.
+var ErrNoServers = errors.New("Locate API returned no servers")
+
+// Nearest returns the servers closest to the client, sorted by distance.
+func (c Client) Nearest(ctx context.Context) ([]Result, error) {
+	URL := c.URL
+	if URL == "" {
+		URL = DefaultURL
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrUnexpectedStatus
+	}
+	var reply struct {
+		Results []Result `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Results) <= 0 {
+		return nil, ErrNoServers
+	}
+	return reply.Results, nil
+}
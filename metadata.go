@@ -0,0 +1,72 @@
+package nuvolari
+
+import (
+	"cmp"
+	"net/url"
+	"runtime"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// MetadataSettings describes the client to the server, following the
+// M-Lab conventions. We always send the name and the version of this
+// library. Empty fields are not sent.
+type MetadataSettings struct {
+	// ClientName is the name of the application (e.g. "my-speedtest").
+	ClientName string
+
+	// ClientVersion is the version of the application (e.g. "v1.2.3").
+	ClientVersion string
+
+	// ClientOS is the operating system. If empty, we use runtime.GOOS,
+	// unless Settings.Privacy is set.
+	ClientOS string
+
+	// ClientArch is the architecture. If empty, we use runtime.GOARCH,
+	// unless Settings.Privacy is set.
+	ClientArch string
+
+	// Extra contains arbitrary additional metadata. It cannot override
+	// the other fields, the parameters of the protocol (e.g. the duration
+	// of the test) or the parameters of the URLs returned by the Locate
+	// API.
+	Extra map[string]string
+}
+
+// reservedParameters contains the parameters that Extra cannot override.
+var reservedParameters = map[string]bool{
+	spec.DurationParameter:             true,
+	spec.TestIDParameter:               true,
+	spec.AccessTokenParameter:          true,
+	spec.ClientNameParameter:           true,
+	spec.ClientVersionParameter:        true,
+	spec.ClientLibraryNameParameter:    true,
+	spec.ClientLibraryVersionParameter: true,
+	spec.ClientOSParameter:             true,
+	spec.ClientArchParameter:           true,
+}
+
+// apply adds the metadata to query.
+func (ms MetadataSettings) apply(query url.Values, privacy bool) {
+	for key, value := range ms.Extra {
+		if !reservedParameters[key] && !query.Has(key) {
+			query.Set(key, value)
+		}
+	}
+	os, arch := ms.ClientOS, ms.ClientArch
+	if !privacy {
+		os, arch = cmp.Or(os, runtime.GOOS), cmp.Or(arch, runtime.GOARCH)
+	}
+	for key, value := range map[string]string{
+		spec.ClientNameParameter:           ms.ClientName,
+		spec.ClientVersionParameter:        ms.ClientVersion,
+		spec.ClientLibraryNameParameter:    "nuvolari",
+		spec.ClientLibraryVersionParameter: Version().Version,
+		spec.ClientOSParameter:             os,
+		spec.ClientArchParameter:           arch,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+}
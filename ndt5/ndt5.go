@@ -0,0 +1,423 @@
+// Package ndt5 implements a client for the legacy ndt5 protocol, which
+// allows to measure older M-Lab servers that do not support ndt7. The
+// protocol is documented at https://github.com/ndt-project/ndt/wiki.
+package ndt5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPort is the default port of the control connection.
+const DefaultPort = "3001"
+
+// Duration is the duration of a test, which the server chooses.
+const Duration = 10 * time.Second
+
+// Message types.
+const (
+	msgSrvQueue     = 1
+	msgLogin        = 2
+	msgTestPrepare  = 3
+	msgTestStart    = 4
+	msgTestMsg      = 5
+	msgTestFinalize = 6
+	msgResults      = 8
+	msgLogout       = 9
+	msgWaiting      = 10
+)
+
+// Test identifiers. We always request testStatus, which tells the server
+// that we understand the queue messages.
+const (
+	testC2S    = 2
+	testS2C    = 4
+	testStatus = 16
+)
+
+// Values of the SRV_QUEUE message.
+const (
+	queueStart     = "0"
+	queueFault     = "9977"
+	queueBusy      = "9988"
+	queueHeartbeat = "9990"
+	queueBusy60s   = "9999"
+)
+
+// kickoff is the message the server sends right after the login.
+const kickoff = "123456 654321"
+
+// progressInterval is the interval between calls to OnProgress.
+const progressInterval = 100 * time.Millisecond
+
+// bulkSize is the size of the reads and writes of the data connection.
+const bulkSize = 1 << 13
+
+var (
+	// ErrProtocolViolation is returned when the server violates the protocol.
+	ErrProtocolViolation = errors.New("Server violated the ndt5 protocol")
+
+	// ErrServerBusy is returned when the server cannot run the test now.
+	ErrServerBusy = errors.New("Server is busy")
+
+	// ErrServerFault is returned when the server fails.
+	ErrServerFault = errors.New("Server failed")
+)
+
+// Client is a ndt5 client.
+type Client struct {
+	// Hostname is the hostname of the server.
+	Hostname string
+
+	// Port is the port of the control connection. If empty, we use
+	// DefaultPort.
+	Port string
+
+	// Dialer is the optional dialer to use.
+	Dialer *net.Dialer
+
+	// OnProgress, if not nil, is called every 100 ms during the transfer,
+	// from the goroutine running the test, with the elapsed time and the
+	// number of bytes transferred so far.
+	OnProgress func(elapsed time.Duration, numBytes int64)
+}
+
+// Result is the result of a test.
+type Result struct {
+	// Elapsed is the duration of the transfer measured by the client.
+	Elapsed time.Duration
+
+	// NumBytes is the number of bytes transferred, according to the client.
+	NumBytes int64
+
+	// ServerThroughput is the throughput measured by the server, in bit/s.
+	ServerThroughput float64
+
+	// Vars contains the variables that the server sends along with the
+	// results (e.g. "MinRTT"), which depend on the server.
+	Vars map[string]string
+}
+
+// Download runs a ndt5 download (i.e. server to client) test.
+func (c Client) Download(ctx context.Context) (*Result, error) {
+	return c.run(ctx, testS2C)
+}
+
+// Upload runs a ndt5 upload (i.e. client to server) test.
+func (c Client) Upload(ctx context.Context) (*Result, error) {
+	return c.run(ctx, testC2S)
+}
+
+// session is a ndt5 session, i.e. a control connection.
+type session struct {
+	client Client
+	ctx    context.Context
+	conn   net.Conn
+	reader *bufio.Reader
+	result *Result
+}
+
+func (c Client) dial(ctx context.Context, port string) (net.Conn, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.Hostname, port))
+}
+
+func (c Client) run(ctx context.Context, test int) (*Result, error) {
+	port := c.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	conn, err := c.dial(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Unblock any I/O when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(3 * Duration))
+	s := &session{
+		client: c,
+		ctx:    ctx,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		result: &Result{Vars: make(map[string]string)},
+	}
+	if err := s.run(test); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return s.result, nil
+}
+
+func (s *session) run(test int) error {
+	if err := s.writeMessage(msgLogin, []byte{byte(test | testStatus)}); err != nil {
+		return err
+	}
+	buf := make([]byte, len(kickoff))
+	if _, err := io.ReadFull(s.reader, buf); err != nil {
+		return err
+	}
+	if string(buf) != kickoff {
+		return fmt.Errorf("%w: invalid kickoff message", ErrProtocolViolation)
+	}
+	if err := s.waitInQueue(); err != nil {
+		return err
+	}
+	if _, err := s.expectMessage(msgLogin); err != nil { // server version
+		return err
+	}
+	tests, err := s.expectMessage(msgLogin)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(tests)) != strconv.Itoa(test) {
+		return fmt.Errorf("%w: unexpected tests: %q", ErrProtocolViolation, tests)
+	}
+	if test == testS2C {
+		err = s.runDownload()
+	} else {
+		err = s.runUpload()
+	}
+	if err != nil {
+		return err
+	}
+	return s.readResults()
+}
+
+// waitInQueue waits until the server tells us that the test starts.
+func (s *session) waitInQueue() error {
+	for {
+		body, err := s.expectMessage(msgSrvQueue)
+		if err != nil {
+			return err
+		}
+		switch string(body) {
+		case queueStart:
+			return nil
+		case queueFault:
+			return ErrServerFault
+		case queueBusy, queueBusy60s:
+			return ErrServerBusy
+		case queueHeartbeat:
+			if err := s.writeMessage(msgWaiting, nil); err != nil {
+				return err
+			}
+		}
+		// Otherwise, it is the number of minutes we need to wait
+	}
+}
+
+// prepare handles TEST_PREPARE and TEST_START and returns the connection
+// to use for the test.
+func (s *session) prepare() (net.Conn, error) {
+	body, err := s.expectMessage(msgTestPrepare)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("%w: missing port", ErrProtocolViolation)
+	}
+	if _, err := strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return nil, fmt.Errorf("%w: invalid port: %q", ErrProtocolViolation, fields[0])
+	}
+	conn, err := s.client.dial(s.ctx, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.expectMessage(msgTestStart); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// transfer uses fn to transfer data over conn until fn fails, the server
+// closes conn or, if sending, Duration elapses, and records the bytes.
+func (s *session) transfer(conn net.Conn, fn func([]byte) (int, error), buf []byte,
+	sending bool) error {
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+	t0 := time.Now()
+	// Allow the server some time to stop sending before we give up
+	conn.SetDeadline(t0.Add(Duration + 5*time.Second))
+	tProgress := t0
+	var count int64
+	for {
+		n, err := fn(buf)
+		count += int64(n)
+		now := time.Now()
+		s.result.Elapsed, s.result.NumBytes = now.Sub(t0), count
+		if s.client.OnProgress != nil && now.Sub(tProgress) >= progressInterval {
+			s.client.OnProgress(s.result.Elapsed, count)
+			tProgress = now
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sending && now.Sub(t0) >= Duration {
+			return nil
+		}
+	}
+}
+
+func (s *session) runDownload() error {
+	conn, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	if err := s.transfer(conn, conn.Read, make([]byte, bulkSize), false); err != nil {
+		return err
+	}
+	// The server sends "throughput unsent_bytes total_sent_bytes"
+	body, err := s.expectMessage(msgTestMsg)
+	if err != nil {
+		return err
+	}
+	if err := s.parseThroughput(body); err != nil {
+		return err
+	}
+	clientThroughput := 0.0
+	if elapsed := s.result.Elapsed.Seconds(); elapsed > 0 {
+		clientThroughput = float64(s.result.NumBytes) * 8 / elapsed / 1000
+	}
+	msg := strconv.FormatFloat(clientThroughput, 'f', -1, 64)
+	if err := s.writeMessage(msgTestMsg, []byte(msg)); err != nil {
+		return err
+	}
+	// The server now sends its variables until TEST_FINALIZE
+	for {
+		mtype, body, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		switch mtype {
+		case msgTestMsg:
+			s.parseVars(body)
+		case msgTestFinalize:
+			return nil
+		default:
+			return fmt.Errorf("%w: unexpected message %d", ErrProtocolViolation, mtype)
+		}
+	}
+}
+
+func (s *session) runUpload() error {
+	conn, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	buf := make([]byte, bulkSize)
+	for i := range buf {
+		buf[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	if err := s.transfer(conn, conn.Write, buf, true); err != nil {
+		return err
+	}
+	// The server sends the throughput it measured
+	body, err := s.expectMessage(msgTestMsg)
+	if err != nil {
+		return err
+	}
+	if err := s.parseThroughput(body); err != nil {
+		return err
+	}
+	_, err = s.expectMessage(msgTestFinalize)
+	return err
+}
+
+// parseThroughput parses the throughput in kbit/s at the beginning of body.
+func (s *session) parseThroughput(body []byte) error {
+	fields := strings.Fields(string(body))
+	if len(fields) < 1 {
+		return fmt.Errorf("%w: missing throughput", ErrProtocolViolation)
+	}
+	kbps, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || kbps < 0 {
+		return fmt.Errorf("%w: invalid throughput: %q", ErrProtocolViolation, fields[0])
+	}
+	s.result.ServerThroughput = kbps * 1000
+	return nil
+}
+
+// parseVars parses the "name: value" lines of body into the variables.
+func (s *session) parseVars(body []byte) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if name, value, found := strings.Cut(line, ":"); found {
+			s.result.Vars[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// readResults reads the results until the server logs out.
+func (s *session) readResults() error {
+	for {
+		mtype, body, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		switch mtype {
+		case msgResults:
+			s.parseVars(body)
+		case msgLogout:
+			return nil
+		default:
+			return fmt.Errorf("%w: unexpected message %d", ErrProtocolViolation, mtype)
+		}
+	}
+}
+
+// readMessage reads a message, which consists of the type, the length of
+// the body as a 16 bit big endian integer and the body.
+func (s *session) readMessage() (int, []byte, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return int(header[0]), body, nil
+}
+
+// expectMessage reads a message of type mtype and returns its body.
+func (s *session) expectMessage(mtype int) ([]byte, error) {
+	got, body, err := s.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if got != mtype {
+		return nil, fmt.Errorf("%w: expected message %d, got %d", ErrProtocolViolation, mtype, got)
+	}
+	return body, nil
+}
+
+// writeMessage writes a message of type mtype.
+func (s *session) writeMessage(mtype int, body []byte) error {
+	if len(body) > 0xffff {
+		return errors.New("Message is too long")
+	}
+	msg := append([]byte{byte(mtype), byte(len(body) >> 8), byte(len(body))}, body...)
+	_, err := s.conn.Write(msg)
+	return err
+}
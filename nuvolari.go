@@ -1,17 +1,32 @@
 // Package nuvolari implements a ndt7 client. The specification of ndt7 is
 // available at https://github.com/m-lab/ndt-cloud/blob/master/spec/ndt7.md.
+//
+// There are two API styles. RunDownload and RunUpload deliver the events to
+// the Client's Handler, while Download and Upload post them on a channel.
+// Both styles share the same Settings and the same implementation, since
+// the channel based API is just a Handler that writes on a channel. With
+// either style, the Client's Sink also receives the events as NDJSON.
+//
+// One can either fill a Client directly or use New, which validates the
+// hostname and the options immediately.
 package nuvolari
 
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bassosimone/nuvolari/internal/sockopt"
+	"github.com/bassosimone/nuvolari/locate"
+	"github.com/bassosimone/nuvolari/spec"
 	"github.com/gorilla/websocket"
 )
 
@@ -20,176 +35,791 @@ type Settings struct {
 	// Hostname is the hostname of the ndt7 server.
 	Hostname string
 
-	// Port is the port of the ndt7 server.
+	// AutoDiscover indicates that, if Hostname is empty, we should use
+	// the M-Lab Locate API to discover the closest ndt7 server.
+	AutoDiscover bool
+
+	// LocateURL is the optional Locate API URL used by AutoDiscover.
+	LocateURL string
+
+	// Port is the optional port of the ndt7 server, either as a number or
+	// as a service name (e.g. "https").
 	Port string
 
+	// Duration is the optional duration of each test. Zero means using
+	// spec.DefaultDuration; the maximum is spec.MaxDuration. We ask the
+	// server to honor Duration using spec.DurationParameter, hence a
+	// download from a server ignoring it fails with ErrServerGoneWild.
+	Duration time.Duration
+
+	// TestID is the optional identifier of the test, which RunDownload and
+	// RunUpload generate using NewTestID when empty. All the events and the
+	// Results contain it, and we send it to the server using the query
+	// string parameter spec.TestIDParameter, so that the client logs can
+	// be joined with the server archives.
+	TestID string
+
+	// Streams is the number of parallel connections to use for each
+	// test, to saturate paths where a single TCP flow cannot (up to 16).
+	// Measurements of each connection have the Stream field set, and we
+	// also emit client measurements aggregating all the connections.
+	Streams int
+
+	// FallbackToNDT5 indicates that, if the server does not support ndt7,
+	// i.e. the WebSocket handshake fails, we should run the test using the
+	// legacy ndt5 protocol, on port 3001 of the server that refused the
+	// handshake, so that we can still measure older servers. This does not
+	// apply to multi-stream tests.
+	FallbackToNDT5 bool
+
+	// Servers contains additional servers to try, in order, when we fail
+	// to connect to Hostname, e.g. because it is down or overloaded. When
+	// Hostname is empty, we only try Servers. See also Retry.
+	Servers []string
+
+	// Retry controls how many times we try to connect and how long we
+	// wait between attempts.
+	Retry RetrySettings
+
+	// Reconnect enables reconnecting to the server, when a single-stream
+	// test fails because of a transient network error, and continuing
+	// the test for the remaining time, if any. The measurements still form
+	// a single series and the first measurement after reconnecting has
+	// the Gap field set. This is useful on flaky wireless links.
+	Reconnect bool
+
+	// InterTestGap is the optional time that RunAll waits between the
+	// download and the upload, e.g. to let queues drain.
+	InterTestGap time.Duration
+
+	// CheckCompression makes RunAll and RunUploadWithCompressionCheck, after
+	// the upload, run a second upload using compressible data, to check
+	// whether a middlebox compresses the traffic (see DiagnoseCompression).
+	// It has no effect when you set Upload.Pattern, since the first upload
+	// must use random data.
+	CheckCompression bool
+
+	// Adaptive ends the download before Duration when the speed has
+	// converged, to save data on metered connections. We consider the
+	// speed converged when, according to the BBR information sent by the
+	// server, the pipe is full or, otherwise, when the mean throughput
+	// measured by the client has been stable for the last two seconds.
+	Adaptive bool
+
+	// PingInterval, if positive, is the interval between the WebSocket
+	// pings we send to measure the application-level RTT, which we report
+	// in the AppRTT field of the client measurements.
+	PingInterval time.Duration
+
+	// MaxDownloadRate, if positive, is the maximum rate, in bits per
+	// second, at which we read during the download. This allows to test
+	// user interfaces and Adaptive at a controlled speed, without shaping
+	// the network, since TCP flow control slows down the server. We stop
+	// limiting the rate when the test duration elapses, to read the data
+	// queued in the meantime, which may increase the final measurements.
+	MaxDownloadRate float64
+
+	// MaxUploadRate, if positive, is the maximum rate, in bits per second,
+	// at which we write during the upload, e.g. to limit the impact of
+	// periodic tests on production links.
+	MaxUploadRate float64
+
+	// Deltas makes the client measurements also report the bytes we
+	// transferred and the time elapsed since the previous measurement,
+	// in the IntervalBytes and IntervalElapsed fields, besides the
+	// cumulative counters, which is convenient for graphing.
+	Deltas bool
+
+	// WarmUp is the initial part of each test that we exclude when
+	// computing the MeanThroughput of the Results, so that TCP slow start
+	// does not lower it on short tests. Zero means using defaultWarmUp
+	// and a negative value means not excluding anything.
+	WarmUp time.Duration
+
+	// DialTimeout is the optional timeout for connecting to the server,
+	// including the TLS and WebSocket handshakes. When zero, we use the
+	// HandshakeTimeout of the Dialer or, if that is zero, 7 seconds.
+	DialTimeout time.Duration
+
+	// ReadTimeout is the optional timeout of each read during the download,
+	// when the server is expected to send continuously (default: 7s).
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the optional timeout of each write, including the
+	// WebSocket control frames (default: 7s).
+	WriteTimeout time.Duration
+
+	// CloseTimeout is the optional time we wait for the server Close frame
+	// during the closing handshake (default: 7s).
+	CloseTimeout time.Duration
+
 	// SkipTLSVerify indicates whether we should skip TLS verify.
 	SkipTLSVerify bool
+
+	// DisableTLS indicates whether we should use ws:// rather than wss://,
+	// for servers that are not using TLS. When Port is "80" we use ws://
+	// and when Port is "443" we use wss://, regardless of DisableTLS.
+	DisableTLS bool
+
+	// Scheme is the optional scheme of the URLs, either "ws" or "wss". If
+	// set, it wins over DisableTLS and the scheme implied by Port.
+	Scheme string
+
+	// DownloadPath is the optional URL path of the download test (default:
+	// spec.DownloadURLPath), for private deployments that mount ndt7 under
+	// a prefix (e.g. behind a reverse proxy). We ignore it when using the
+	// Locate API, which returns the URLs to use.
+	DownloadPath string
+
+	// UploadPath is like DownloadPath but for the upload test.
+	UploadPath string
+
+	// AllowInsecure must be set for SkipTLSVerify and ws:// to be honored
+	// with hosts other than loopback ones. This prevents applications from
+	// accidentally shipping settings that disable TLS or certificate
+	// validation when running tests against public servers.
+	AllowInsecure bool
+
+	// Dialer is the optional websocket.Dialer to use as a template. It
+	// allows to configure, e.g., proxies, TLS and buffer sizes. We never
+	// modify the Dialer; we apply the other settings to a copy of it.
+	Dialer *websocket.Dialer
+
+	// SourceAddress is the optional local IP address from which to connect,
+	// so that multi-homed clients can choose the uplink to measure.
+	SourceAddress string
+
+	// Interface is the optional network interface (e.g. "wwan0") through
+	// which to connect. This uses SO_BINDTODEVICE and is Linux only.
+	Interface string
+
+	// BearerToken is the optional token to send with the upgrade request
+	// using the Authorization header, for authenticated deployments.
+	BearerToken string
+
+	// AccessToken is the optional access token to send using the
+	// spec.AccessTokenParameter query string parameter, for servers that
+	// require one (e.g. M-Lab servers when not using the Locate API). The
+	// token included in the URLs returned by the Locate API, if any, wins.
+	AccessToken string
+
+	// Metadata describes the application and the device running the tests
+	// to the server, which may archive it along with the measurements. We
+	// send it using the URL query string.
+	Metadata MetadataSettings
+
+	// Cookies are optional cookies to send with the upgrade request.
+	Cookies []*http.Cookie
+
+	// LowMemory reduces the memory used by tests, for running on embedded
+	// devices. It uses smaller I/O buffers and upload messages, and does
+	// not cache prepared upload messages. We do not reduce the read limit
+	// because the spec requires accepting messages of that size; we read
+	// binary messages in streaming fashion, so the limit costs no memory.
+	LowMemory bool
+
+	// GCPercent, if not zero, is the GOGC value to use while measuring. A
+	// higher value reduces GC pauses, which on low-end devices may show up
+	// as artificial throughput dips, at the cost of using more memory.
+	GCPercent int
+
+	// MemoryLimit, if not zero, is the soft memory limit in bytes to use
+	// while measuring. Use it with a high GCPercent to avoid collecting
+	// garbage unless memory usage gets close to the limit.
+	MemoryLimit int64
+
+	// EventMask selects the classes of events delivered to the Handler. The
+	// zero value means that the Handler receives all events.
+	EventMask EventMask
+
+	// EventBuffer is the size of the buffer of the channels returned by
+	// Download, Upload and All. In any case, the test never waits for the
+	// consumer of the channel: we queue the events and, if the consumer
+	// falls behind, we drop log events and coalesce progress events.
+	EventBuffer int
+
+	// MaxMessageSize is the maximum size of the messages that we accept
+	// from the server. If zero, we use spec.MaxMessageSize. We fail with
+	// ErrProtocolViolation when the server sends larger messages.
+	MaxMessageSize int64
+
+	// WrapConn is an optional function that wraps the network connection
+	// before the TLS and WebSocket handshakes. It allows, e.g., to shape
+	// the bandwidth for testing or to collect custom instrumentation.
+	WrapConn func(net.Conn) net.Conn
+
+	// DialFunc is the optional function to use to create the network
+	// connection to the server, e.g. to run tests over unix sockets,
+	// userspace TCP stacks or in-memory pipes without a real network. It
+	// wins over the dial functions of the Dialer, SourceAddress and
+	// Interface; we still apply the other settings (e.g. WrapConn).
+	DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// SOCKS5Proxy is the optional address (e.g. "127.0.0.1:9050") of a
+	// SOCKS5 proxy to use. The proxy resolves the server hostname, hence
+	// this works with Tor onion services and does not leak DNS queries.
+	SOCKS5Proxy string
+
+	// Resolver is the optional resolver to use to resolve the server
+	// hostname, e.g. when the local resolver is broken or monitored.
+	// We emit LogResolved with the addresses and the resolution time.
+	// With a SOCKS5Proxy, the proxy resolves the server hostname.
+	Resolver Resolver
+
+	// DoHURL is the optional URL of a DNS-over-HTTPS server (e.g.
+	// doh.CloudflareURL) to use to resolve the server hostname, when
+	// Resolver is nil. The TLS certificate is still verified using
+	// the server hostname.
+	DoHURL string
+
+	// SendBufferSize, if not zero, is the SO_SNDBUF to request for the
+	// measurement sockets. The kernel may adjust the value; we report the
+	// effective value in the ConnectionInfo, where possible.
+	SendBufferSize int
+
+	// ReceiveBufferSize, if not zero, is the SO_RCVBUF to request for the
+	// measurement sockets. Like SendBufferSize, this is useful to rule out
+	// or reproduce buffer-limited throughput on high-BDP paths.
+	ReceiveBufferSize int
+
+	// Privacy enables data minimization: the events only contain the
+	// network part of the client address (i.e. /24 for IPv4 and /48 for
+	// IPv6), without the port, and no client hostname.
+	Privacy bool
+
+	// TLS contains the settings to use servers with a private PKI.
+	TLS TLSSettings
+
+	// Upload contains the settings specific to the upload test.
+	Upload UploadSettings
 }
 
-// BBRInfo contains BBR information.
-type BBRInfo struct {
-	// MaxBandwidth is the bandwidth measured in bits per second.
-	MaxBandwidth float64 `json:"max_bandwidth"`
+// UploadSettings contains the settings specific to the upload test.
+type UploadSettings struct {
+	// CongestionControl is the optional TCP congestion control algorithm
+	// (e.g. "cubic", "bbr") to use for uploading. This is only supported
+	// on Linux and the algorithm must be available in the kernel.
+	CongestionControl string
 
-	// MinRTT is the round-trip time measured in milliseconds.
-	MinRTT float64 `json:"min_rtt"`
+	// NotSentLowat is the TCP_NOTSENT_LOWAT, in bytes, to use for uploading,
+	// which limits the amount of unsent data queued in the kernel, so that
+	// the bytes we count as written track more closely the bytes actually
+	// leaving the host. Zero means using defaultNotSentLowat and a negative
+	// value means not setting TCP_NOTSENT_LOWAT.
+	NotSentLowat int
+
+	// Seed, if not zero, seeds the generator of the pseudo-random payload
+	// of the messages, so that repeated runs send the same bytes, which
+	// helps debugging middleboxes that compress or tamper with traffic.
+	Seed int64
+
+	// Pattern, if not empty, is the content of the messages, which we
+	// repeat as needed to fill them, instead of pseudo-random data. This
+	// takes precedence over Seed.
+	Pattern []byte
 }
 
-// Measurement is a performance measurement.
-type Measurement struct {
-	// Elapsed is the number of seconds elapsed since the beginning.
-	Elapsed float64 `json:"elapsed"`
+// ensureTestID generates the TestID, if empty.
+func (s *Settings) ensureTestID() error {
+	if s.TestID != "" {
+		return nil
+	}
+	id, err := NewTestID()
+	if err != nil {
+		return err
+	}
+	s.TestID = id
+	return nil
+}
 
-	// BBRInfo is optional BBR information included when possible.
-	BBRInfo *BBRInfo `json:"bbr_info,omitempty"`
+// clone returns a copy of the settings that does not share any mutable
+// state with the original, so that a running test is not affected by
+// the caller modifying the settings it passed to the Client.
+func (s Settings) clone() Settings {
+	if s.Dialer != nil {
+		dialer := *s.Dialer
+		s.Dialer = &dialer
+	}
+	if s.Cookies != nil {
+		cookies := make([]*http.Cookie, 0, len(s.Cookies))
+		for _, c := range s.Cookies {
+			cookie := *c
+			cookies = append(cookies, &cookie)
+		}
+		s.Cookies = cookies
+	}
+	s.Servers = append([]string(nil), s.Servers...)
+	s.Upload.Pattern = append([]byte(nil), s.Upload.Pattern...)
+	if s.Metadata.Extra != nil {
+		extra := make(map[string]string, len(s.Metadata.Extra))
+		for key, value := range s.Metadata.Extra {
+			extra[key] = value
+		}
+		s.Metadata.Extra = extra
+	}
+	s.TLS.CAPEM = append([]byte(nil), s.TLS.CAPEM...)
+	s.TLS.CipherSuites = append([]uint16(nil), s.TLS.CipherSuites...)
+	s.TLS.PinnedCertSHA256 = append([]string(nil), s.TLS.PinnedCertSHA256...)
+	return s
 }
 
+// BBRInfo contains BBR information.
+type BBRInfo = spec.BBRInfo
+
+// ConnectionInfo contains information about the connection.
+type ConnectionInfo = spec.ConnectionInfo
+
+// ECNInfo contains information about Explicit Congestion Notification.
+type ECNInfo = spec.ECNInfo
+
+// TCPInfo contains information from TCP_INFO.
+type TCPInfo = spec.TCPInfo
+
+// Measurement is a performance measurement.
+type Measurement = spec.Measurement
+
 // Handler handles Client events.
 type Handler interface {
 	// OnLogInfo receives an informational message.
-	OnLogInfo(string)
+	OnLogInfo(LogMessage)
 
 	// OnServerDownloadMeasurement receives a server-side download measurement.
 	OnServerDownloadMeasurement(Measurement)
 
 	// OnClientDownloadMeasurement receives a client-side download measurement.
 	OnClientDownloadMeasurement(Measurement)
+
+	// OnServerUploadMeasurement receives a server-side upload measurement.
+	OnServerUploadMeasurement(Measurement)
+
+	// OnClientUploadMeasurement receives a client-side upload measurement.
+	OnClientUploadMeasurement(Measurement)
+
+	// OnFinding receives a sign of middlebox interference.
+	OnFinding(Finding)
+
+	// OnProgress receives the progress of the test at a fixed cadence.
+	OnProgress(Progress)
 }
 
 // Client is the default client implementation.
+//
+// A single Client can run multiple tests, either sequentially or concurrently
+// from different goroutines. When a test starts, it takes a private copy of
+// the Settings, so changing the Settings while a test is running only affects
+// the tests started afterwards. Tests never modify the Client. The Handler
+// is shared, therefore it must be safe for concurrent use when running
+// tests concurrently, while the Sink may be any io.Writer. If you set
+// Settings.TestID, concurrent tests share the same TestID.
 type Client struct {
 	// Settings contains client settings.
 	Settings Settings
 
 	// Handler for events.
 	Handler Handler
-}
 
-const downloadURLPath = "/ndt/v7/download"
+	// Sink, if not nil, receives each event serialized as a line of JSON,
+	// besides the Handler or the channel (see SinkRecord). We write on it
+	// in the background, serializing the writes of concurrent tests, and
+	// the tests return after their events have been written. If the Sink
+	// is too slow, we drop events, and the tests return anyway after
+	// waiting for a few seconds.
+	Sink io.Writer
+
+	// located is the server discovered by RunAll, if any, which the tests
+	// use rather than discovering the server again.
+	located *locate.Result
+}
 
 // ErrInvalidHostname is returned when Settings.Hostname is invalid.
 var ErrInvalidHostname = errors.New("Hostname is invalid")
 
-func (cl Client) makeURL() (url.URL, error) {
+// ErrInvalidPort is returned when Settings.Port is invalid.
+var ErrInvalidPort = errors.New("Port is invalid")
+
+// ErrInvalidScheme is returned when Settings.Scheme is invalid.
+var ErrInvalidScheme = errors.New("Scheme is invalid")
+
+// ErrInvalidPath is returned when Settings.DownloadPath or
+// Settings.UploadPath does not start with a slash.
+var ErrInvalidPath = errors.New("URL path is invalid")
+
+// ErrInvalidDuration is returned when Settings.Duration is out of range.
+var ErrInvalidDuration = errors.New("Duration is invalid")
+
+// ErrInvalidSourceAddress is returned when Settings.SourceAddress is not an IP.
+var ErrInvalidSourceAddress = errors.New("Source address is invalid")
+
+// ErrInsecureSettings is returned when the settings disable TLS or skip
+// TLS verify for a non-loopback host and AllowInsecure is not set.
+var ErrInsecureSettings = errors.New("Insecure settings require AllowInsecure")
+
+// isLoopback tells whether hostname refers to the loopback interface.
+func isLoopback(hostname string) bool {
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkInsecure returns ErrInsecureSettings if using u is insecure and
+// the user did not explicitly allow it.
+func (cl Client) checkInsecure(u url.URL) error {
+	insecure := cl.Settings.SkipTLSVerify || u.Scheme == "ws"
+	if insecure && !cl.Settings.AllowInsecure && !isLoopback(cl.Settings.Hostname) {
+		return ErrInsecureSettings
+	}
+	return nil
+}
+
+// makeURL returns the URL for path. We treat any hostname that is not an IP
+// address as an opaque name, so that names only meaningful to a proxy, such
+// as Tor onion services, are passed along verbatim.
+func (cl Client) makeURL(path string) (url.URL, error) {
 	var u url.URL
-	u.Scheme = "wss"
-	if cl.Settings.Port != "" {
-		ip := net.ParseIP(cl.Settings.Hostname)
-		if ip == nil || ip.To4() != nil {
-			u.Host = cl.Settings.Hostname
-			u.Host += ":"
-			u.Host += cl.Settings.Port
-		} else if ip.To16() != nil {
-			u.Host = "["
-			u.Host += cl.Settings.Hostname
-			u.Host += "]:"
-			u.Host += cl.Settings.Port
-		} else {
-			return url.URL{}, ErrInvalidHostname
-		}
+	scheme, err := cl.Settings.scheme()
+	if err != nil {
+		return url.URL{}, err
+	}
+	u.Scheme = scheme
+	path, err = cl.Settings.urlPath(path)
+	if err != nil {
+		return url.URL{}, err
+	}
+	hostname := cl.Settings.Hostname
+	if !validHostname(hostname) {
+		return url.URL{}, ErrInvalidHostname
+	}
+	port, err := parsePort(cl.Settings.Port)
+	if err != nil {
+		return url.URL{}, err
+	}
+	// The well known ports imply the scheme, unless it's explicit, which
+	// in turn implies the port, hence we omit the default port.
+	switch {
+	case port == 80 && cl.Settings.Scheme == "":
+		u.Scheme = "ws"
+	case port == 443 && cl.Settings.Scheme == "":
+		u.Scheme = "wss"
+	}
+	if (port == 80 && u.Scheme == "ws") || (port == 443 && u.Scheme == "wss") {
+		port = 0
+	}
+	if port != 0 {
+		u.Host = net.JoinHostPort(hostname, strconv.Itoa(port))
+	} else if strings.Contains(hostname, ":") {
+		u.Host = "[" + hostname + "]" // IPv6 address literal
 	} else {
-		u.Host = cl.Settings.Hostname
+		u.Host = hostname
 	}
-	u.Path = downloadURLPath
+	u.Path = path
 	return u, nil
 }
 
-func (cl Client) makeDialer() websocket.Dialer {
-  var d websocket.Dialer
-	if cl.Settings.SkipTLSVerify {
-		config := tls.Config{InsecureSkipVerify: true}
-		d.TLSClientConfig = &config
+// validHostname tells whether hostname may be the host of a URL.
+func validHostname(hostname string) bool {
+	return hostname != "" && !strings.ContainsAny(hostname, "/?#@[] ")
+}
+
+// parsePort returns the number of port, or zero if port is empty.
+func parsePort(port string) (int, error) {
+	if port == "" {
+		return 0, nil
+	}
+	// LookupPort accepts both numbers and service names (e.g. "https")
+	number, err := net.LookupPort("tcp", port)
+	if err != nil || number <= 0 {
+		return 0, ErrInvalidPort
+	}
+	return number, nil
+}
+
+// wrapDialContext returns a function that uses the dial function that d
+// would use and then wraps the resulting connection using wrap.
+func wrapDialContext(d websocket.Dialer, wrap func(net.Conn) net.Conn) func(
+	context.Context, string, string) (net.Conn, error) {
+	dial := d.NetDialContext
+	if dial == nil && d.NetDial != nil {
+		netDial := d.NetDial
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return netDial(network, address)
+		}
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(conn), nil
+	}
+}
+
+// setBufferSizes sets the socket buffer sizes of conn. We ignore errors
+// because the kernel clamps the values anyway, and we report the values
+// that are in effect in the ConnectionInfo.
+func (s Settings) setBufferSizes(conn net.Conn) net.Conn {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if s.SendBufferSize != 0 {
+			tcpConn.SetWriteBuffer(s.SendBufferSize)
+		}
+		if s.ReceiveBufferSize != 0 {
+			tcpConn.SetReadBuffer(s.ReceiveBufferSize)
+		}
+	}
+	return conn
+}
+
+// timeout returns value, if not zero, or the default timeout.
+func timeout(value time.Duration) time.Duration {
+	if value == 0 {
+		return defaultTimeout
+	}
+	return value
+}
+
+// scheme returns the scheme of the URLs, ignoring the port.
+func (s Settings) scheme() (string, error) {
+	switch {
+	case s.Scheme == "ws", s.Scheme == "wss":
+		return s.Scheme, nil
+	case s.Scheme != "":
+		return "", ErrInvalidScheme
+	case s.DisableTLS:
+		return "ws", nil
+	default:
+		return "wss", nil
+	}
+}
+
+// urlPath returns the URL path to use for the test whose standard URL
+// path is path.
+func (s Settings) urlPath(path string) (string, error) {
+	custom := ""
+	switch path {
+	case spec.DownloadURLPath:
+		custom = s.DownloadPath
+	case spec.UploadURLPath:
+		custom = s.UploadPath
+	}
+	if custom == "" {
+		return path, nil
+	}
+	if !strings.HasPrefix(custom, "/") {
+		return "", ErrInvalidPath
+	}
+	return custom, nil
+}
+
+// readLimit returns the maximum size of the messages that we accept.
+func (s Settings) readLimit() int64 {
+	if s.MaxMessageSize == 0 {
+		return spec.MaxMessageSize
+	}
+	return s.MaxMessageSize
+}
+
+// duration returns the duration of each test.
+func (s Settings) duration() time.Duration {
+	if s.Duration == 0 {
+		return spec.DefaultDuration
+	}
+	return s.Duration
+}
+
+// warmUp returns the initial part of each test to exclude from the mean.
+func (s Settings) warmUp() time.Duration {
+	if s.WarmUp == 0 {
+		return defaultWarmUp
+	}
+	return max(s.WarmUp, 0)
+}
+
+// makeNetDialer returns a net.Dialer bound to the source address and to
+// the network interface specified in the settings.
+func (s Settings) makeNetDialer() (*net.Dialer, error) {
+	dialer := &net.Dialer{}
+	if s.SourceAddress != "" {
+		ip := net.ParseIP(s.SourceAddress)
+		if ip == nil {
+			return nil, ErrInvalidSourceAddress
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
 	}
-	return d
+	if s.Interface != "" {
+		control, err := sockopt.BindToDevice(s.Interface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+	}
+	return dialer, nil
 }
 
-const defaultDuration = 10
+func (cl Client) makeDialer() (websocket.Dialer, error) {
+	var d websocket.Dialer
+	if cl.Settings.Dialer != nil {
+		d = *cl.Settings.Dialer
+	}
+	if cl.Settings.SkipTLSVerify || !cl.Settings.TLS.empty() {
+		config := d.TLSClientConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if err := cl.Settings.TLS.apply(config); err != nil {
+			return d, err
+		}
+		config.InsecureSkipVerify = cl.Settings.SkipTLSVerify || config.InsecureSkipVerify
+		d.TLSClientConfig = config
+	}
+	if cl.Settings.LowMemory {
+		if d.ReadBufferSize == 0 {
+			d.ReadBufferSize = lowMemoryBufferSize
+		}
+		if d.WriteBufferSize == 0 {
+			d.WriteBufferSize = lowMemoryBufferSize
+		}
+	}
+	if cl.Settings.DialTimeout != 0 {
+		d.HandshakeTimeout = cl.Settings.DialTimeout
+	}
+	if d.HandshakeTimeout == 0 {
+		d.HandshakeTimeout = defaultTimeout
+	}
+	if cl.Settings.SOCKS5Proxy != "" {
+		d.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: cl.Settings.SOCKS5Proxy})
+	}
+	if cl.Settings.SourceAddress != "" || cl.Settings.Interface != "" {
+		dialer, err := cl.Settings.makeNetDialer()
+		if err != nil {
+			return d, err
+		}
+		// Binding wins over the template dial functions, if any
+		d.NetDialContext = dialer.DialContext
+		d.NetDial = nil
+	}
+	if cl.Settings.DialFunc != nil {
+		d.NetDialContext = cl.Settings.DialFunc
+		d.NetDial = nil
+	}
+	if r := cl.Settings.resolver(); r != nil {
+		d.NetDialContext = cl.wrapResolver(d, r)
+		d.NetDial = nil
+	}
+	if cl.Settings.SendBufferSize != 0 || cl.Settings.ReceiveBufferSize != 0 {
+		d.NetDialContext = wrapDialContext(d, cl.Settings.setBufferSizes)
+		d.NetDial = nil
+	}
+	if cl.Settings.WrapConn != nil {
+		d.NetDialContext = wrapDialContext(d, cl.Settings.WrapConn)
+		d.NetDial = nil
+	}
+	return d, nil
+}
 
 const defaultTimeout = 7 * time.Second
 
-const secWebSocketProtocol = "net.measurementlab.ndt.v7"
+const lowMemoryBufferSize = 1 << 11
 
-const minMeasurementInterval = 250 * time.Millisecond
+const lowMemoryMessageSize = 1 << 11
 
-const minMaxMessageSize = 1 << 17
+const defaultNotSentLowat = 1 << 17
+
+const defaultWarmUp = 2 * time.Second
 
 // ErrServerGoneWild is returned when the server runs a download for too much
 // time, so that it's proper to stop the download from the client side.
 var ErrServerGoneWild = errors.New("Server is running for too much time")
 
-// RunDownload runs a ndt7 download test.
-func (cl Client) RunDownload(ctx context.Context) error {
-	wsURL, err := cl.makeURL()
+func (cl Client) makeHeaders() http.Header {
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	headers.Set("User-Agent", "nuvolari/"+Version().Version)
+	if cl.Settings.BearerToken != "" {
+		headers.Set("Authorization", "Bearer "+cl.Settings.BearerToken)
+	}
+	// Using http.Request.AddCookie ensures we correctly format cookies.
+	req := http.Request{Header: headers}
+	for _, cookie := range cl.Settings.Cookies {
+		req.AddCookie(cookie)
+	}
+	return headers
+}
+
+// serverURL returns the URL to use for path, discovering the server if
+// needed. Connecting several times to the returned URL allows to use the
+// same server for all the connections of a multi-stream test.
+func (cl Client) serverURL(ctx context.Context, path string) (url.URL, error) {
+	if cl.Settings.Duration < 0 || cl.Settings.Duration > spec.MaxDuration {
+		return url.URL{}, ErrInvalidDuration
+	}
+	if _, err := cl.Settings.scheme(); err != nil {
+		return url.URL{}, err
+	}
+	var wsURL url.URL
+	var err error
+	if cl.Settings.Hostname == "" && cl.Settings.AutoDiscover {
+		wsURL, err = cl.discover(ctx, path)
+		// The server hostname is needed, e.g., to check the certificate
+		cl.Settings.Hostname = wsURL.Hostname()
+	} else {
+		wsURL, err = cl.makeURL(path)
+	}
 	if err != nil {
-		return err
+		return url.URL{}, err
 	}
-	wsDialer := cl.makeDialer()
-	headers := http.Header{}
-	headers.Add("Sec-WebSocket-Protocol", secWebSocketProtocol)
-	wsDialer.HandshakeTimeout = defaultTimeout
-	if cl.Handler != nil {
-		cl.Handler.OnLogInfo("Connecting to: " + wsURL.String())
+	if err := cl.checkInsecure(wsURL); err != nil {
+		return url.URL{}, err
+	}
+	query := wsURL.Query()
+	cl.Settings.Metadata.apply(query, cl.Settings.Privacy)
+	if cl.Settings.Duration != 0 {
+		query.Set(spec.DurationParameter,
+			strconv.FormatInt(int64(cl.Settings.Duration/time.Millisecond), 10))
+	}
+	if cl.Settings.TestID != "" {
+		query.Set(spec.TestIDParameter, cl.Settings.TestID)
+	}
+	if cl.Settings.AccessToken != "" && !query.Has(spec.AccessTokenParameter) {
+		query.Set(spec.AccessTokenParameter, cl.Settings.AccessToken)
 	}
-	conn, _, err := wsDialer.Dial(wsURL.String(), headers)
+	wsURL.RawQuery = query.Encode()
+	return wsURL, nil
+}
+
+// connect establishes a connection with the server at wsURL. We use
+// DialContext such that cancelling ctx interrupts also DNS lookups and
+// TLS handshakes.
+func (cl Client) connect(ctx context.Context, wsURL url.URL) (*websocket.Conn, error) {
+	// The server hostname is needed, e.g., to check the certificate
+	cl.Settings.Hostname = wsURL.Hostname()
+	wsDialer, err := cl.makeDialer()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	conn.SetReadLimit(minMaxMessageSize)
-	defer conn.Close()
-	if cl.Handler != nil {
-		cl.Handler.OnLogInfo("Connection established")
-	}
-	t0 := time.Now()
-	tLast := t0
-	count := int64(0)
-	maxDuration := float64(time.Duration(defaultDuration)*time.Second) * 1.5
-	for {
-		// Check whether the user interrupted us
-		select {
-		case <-ctx.Done():
-			if cl.Handler != nil {
-				cl.Handler.OnLogInfo("Download interrupted by user")
-			}
-			return nil  // No error because user interrupted us
-		default:
-			break
-		}
-		// Check whether we've run for too much time
-		now := time.Now()
-		elapsed := now.Sub(t0)
-		if float64(elapsed) >= maxDuration {
-			return ErrServerGoneWild
-		}
-		// Check whether it's time to run the next client-side measurement
-		if now.Sub(tLast) >= minMeasurementInterval {
-			if cl.Handler != nil {
-				cl.Handler.OnClientDownloadMeasurement(Measurement{
-					Elapsed: elapsed.Seconds(),
-				})
-			}
-			tLast = now
-		}
-		// Read and process the next WebSocket message
-		conn.SetReadDeadline(time.Now().Add(defaultTimeout))
-		mtype, mdata, err := conn.ReadMessage()
-		if err != nil {
-			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				return err
-			}
-			break
-		}
-		count += int64(len(mdata))
-		if mtype == websocket.TextMessage {
-			var measurement Measurement
-			err := json.Unmarshal(mdata, &measurement)
-			if err != nil {
-				return err
-			}
-			if cl.Handler != nil {
-				cl.Handler.OnServerDownloadMeasurement(measurement)
-			}
+	headers := cl.makeHeaders()
+	// Do not log the query, which may contain access tokens
+	logURL := wsURL
+	logURL.RawQuery = ""
+	cl.logInfo(LogConnecting, "Connecting to: "+logURL.String(), "url", logURL.String())
+	cl.progress(PhaseConnecting, 0)
+	trace := newSetupTrace()
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	conn, resp, err := wsDialer.DialContext(ctx, wsURL.String(), headers)
+	if err != nil {
+		if resp != nil || err == websocket.ErrBadHandshake {
+			return nil, wrapError(ErrHandshake, err)
 		}
+		return nil, wrapError(ErrDialFailed, err)
 	}
-	return nil
+	cl.logInfo(LogConnected, "Connection established")
+	cl.logConnectionSetup(trace.setup(time.Now()))
+	if trace.tlsInfo != nil {
+		cl.logTLSInfo(trace.tlsInfo)
+	}
+	cl.checkHandshake(conn, resp)
+	return conn, nil
 }
@@ -0,0 +1,249 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari/server"
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient starts a local ndt7 server and returns a Client that runs
+// one second long tests against it. The server stops when the test ends.
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	srv := httptest.NewServer(server.NewServeMux())
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Client{Settings: Settings{
+		Hostname: host,
+		Port:     port,
+		Scheme:   "ws",
+		Duration: time.Second,
+		WarmUp:   -1,
+	}}
+}
+
+// countingHandler is a Handler, safe for concurrent use, that counts the
+// client measurements of each test.
+type countingHandler struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (ch *countingHandler) count(m Measurement) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.counts[m.TestID]++
+}
+
+func (ch *countingHandler) OnLogInfo(LogMessage)                    {}
+func (ch *countingHandler) OnServerDownloadMeasurement(Measurement) {}
+func (ch *countingHandler) OnClientDownloadMeasurement(m Measurement) {
+	ch.count(m)
+}
+func (ch *countingHandler) OnServerUploadMeasurement(Measurement) {}
+func (ch *countingHandler) OnClientUploadMeasurement(m Measurement) {
+	ch.count(m)
+}
+func (ch *countingHandler) OnFinding(Finding)   {}
+func (ch *countingHandler) OnProgress(Progress) {}
+
+func TestClientRunsTestsConcurrently(t *testing.T) {
+	cl := newTestClient(t)
+	handler := &countingHandler{counts: make(map[string]int)}
+	cl.Handler = handler
+	cl.Settings.Dialer = &websocket.Dialer{}
+	cl.Settings.Cookies = []*http.Cookie{{Name: "session", Value: "x"}}
+	cl.Settings.Metadata.Extra = map[string]string{"run": "concurrent"}
+	runs := []func(context.Context) error{
+		func(ctx context.Context) error {
+			_, err := cl.RunDownloadWithResults(ctx)
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := cl.RunUploadWithResults(ctx)
+			return err
+		},
+		cl.RunBidirectional,
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(runs))
+	for i := 0; i < 2; i++ {
+		for _, run := range runs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- run(context.Background())
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cl.Settings.TestID != "" || cl.Settings.Cookies[0].Value != "x" {
+		t.Fatal("the tests modified the Settings of the Client")
+	}
+	// Each bidirectional test runs a download and an upload.
+	if len(handler.counts) != 8 {
+		t.Fatalf("expected client measurements of 8 tests, got %d", len(handler.counts))
+	}
+	for id, count := range handler.counts {
+		if count <= 0 {
+			t.Fatalf("no client measurements for %s", id)
+		}
+	}
+}
+
+func TestMakeURLPort(t *testing.T) {
+	tests := []struct {
+		port string
+		host string
+		err  error
+	}{
+		{port: "", host: "example.com"},
+		{port: "4443", host: "example.com:4443"},
+		{port: "https", host: "example.com"},
+		{port: "ssh", host: "example.com:22"},
+		{port: "0", err: ErrInvalidPort},
+		{port: "65536", err: ErrInvalidPort},
+		{port: "-1", err: ErrInvalidPort},
+		{port: "4443/x", err: ErrInvalidPort},
+		{port: "no-such-service", err: ErrInvalidPort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.port, func(t *testing.T) {
+			cl := Client{Settings: Settings{Hostname: "example.com", Port: tt.port}}
+			u, err := cl.makeURL(spec.DownloadURLPath)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && u.Host != tt.host {
+				t.Fatalf("expected %s, got %s", tt.host, u.Host)
+			}
+		})
+	}
+}
+
+func TestInvalidPortFailsBeforeDialing(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Settings.Port = "99999"
+	err := cl.RunDownload(context.Background())
+	if !errors.Is(err, ErrInvalidPort) {
+		t.Fatalf("expected ErrInvalidPort, got %v", err)
+	}
+	if ErrorCodeOf(err) != ErrorCodeInvalidSettings {
+		t.Fatalf("expected an invalid settings error code for %v", err)
+	}
+}
+
+func TestMakeURLScheme(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		url      string
+		err      error
+	}{{
+		name: "default",
+		url:  "wss://example.com/ndt/v7/download",
+	}, {
+		name:     "disable TLS",
+		settings: Settings{DisableTLS: true},
+		url:      "ws://example.com/ndt/v7/download",
+	}, {
+		name:     "disable TLS with custom port",
+		settings: Settings{DisableTLS: true, Port: "8080"},
+		url:      "ws://example.com:8080/ndt/v7/download",
+	}, {
+		name:     "port 80 implies ws",
+		settings: Settings{Port: "80"},
+		url:      "ws://example.com/ndt/v7/download",
+	}, {
+		name:     "port 443 implies wss",
+		settings: Settings{Port: "443"},
+		url:      "wss://example.com/ndt/v7/download",
+	}, {
+		name:     "explicit scheme wins over the port",
+		settings: Settings{Scheme: "ws", Port: "443"},
+		url:      "ws://example.com:443/ndt/v7/download",
+	}, {
+		name:     "explicit scheme omits its default port",
+		settings: Settings{Scheme: "wss", Port: "443"},
+		url:      "wss://example.com/ndt/v7/download",
+	}, {
+		name:     "invalid scheme",
+		settings: Settings{Scheme: "http"},
+		err:      ErrInvalidScheme,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.settings.Hostname = "example.com"
+			u, err := Client{Settings: tt.settings}.makeURL(spec.DownloadURLPath)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && u.String() != tt.url {
+				t.Fatalf("expected %s, got %s", tt.url, u.String())
+			}
+		})
+	}
+}
+
+func TestInsecureSettingsRequireAllowInsecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		scheme   string
+		skip     bool
+		allow    bool
+		err      error
+	}{
+		{name: "ws to public host", hostname: "ndt.example.com", scheme: "ws", err: ErrInsecureSettings},
+		{name: "skip verify for public host", hostname: "ndt.example.com", scheme: "wss",
+			skip: true, err: ErrInsecureSettings},
+		{name: "ws to public host allowed", hostname: "ndt.example.com", scheme: "ws", allow: true},
+		{name: "ws to loopback address", hostname: "127.0.0.1", scheme: "ws"},
+		{name: "ws to localhost", hostname: "localhost", scheme: "ws"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := newTestClient(t)
+			address := net.JoinHostPort(cl.Settings.Hostname, cl.Settings.Port)
+			var dials int
+			cl.Settings.DialFunc = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dials++
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}
+			cl.Settings.Hostname = tt.hostname
+			cl.Settings.Scheme = tt.scheme
+			cl.Settings.SkipTLSVerify = tt.skip
+			cl.Settings.AllowInsecure = tt.allow
+			err := cl.RunDownload(context.Background())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if tt.err != nil && dials != 0 {
+				t.Fatalf("we dialed %d times with insecure settings", dials)
+			}
+		})
+	}
+}
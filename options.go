@@ -0,0 +1,95 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// Option configures the Client returned by New.
+type Option func(*Client) error
+
+// ErrInvalidTLSConfig is returned by WithTLSConfig when the config is nil.
+var ErrInvalidTLSConfig = errors.New("TLS config is invalid")
+
+// ErrInvalidHandler is returned by WithHandler when the handler is nil.
+var ErrInvalidHandler = errors.New("Handler is invalid")
+
+// New returns a Client for the server at hostname, configured using opts.
+// Unlike setting the fields of a Client, which we only check when running
+// a test, New validates hostname and the options immediately and returns
+// an error wrapping ErrInvalidHostname, ErrInvalidPort, etc., and saying
+// which value is invalid. We skip nil options, so that callers can build
+// opts conditionally.
+func New(hostname string, opts ...Option) (Client, error) {
+	if !validHostname(hostname) {
+		return Client{}, fmt.Errorf("%w: %q", ErrInvalidHostname, hostname)
+	}
+	cl := Client{Settings: Settings{Hostname: hostname}}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(&cl); err != nil {
+			return Client{}, err
+		}
+	}
+	return cl, nil
+}
+
+// WithPort sets Settings.Port, which is a port number or a service name.
+func WithPort(port string) Option {
+	return func(cl *Client) error {
+		if _, err := parsePort(port); err != nil || port == "" {
+			return fmt.Errorf("%w: %q", ErrInvalidPort, port)
+		}
+		cl.Settings.Port = port
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS config of Settings.Dialer, creating it if
+// needed. The other TLS settings (e.g. Settings.TLS) still apply to a
+// copy of config.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(cl *Client) error {
+		if config == nil {
+			return ErrInvalidTLSConfig
+		}
+		var dialer websocket.Dialer
+		if cl.Settings.Dialer != nil {
+			dialer = *cl.Settings.Dialer
+		}
+		dialer.TLSClientConfig = config
+		cl.Settings.Dialer = &dialer
+		return nil
+	}
+}
+
+// WithDuration sets Settings.Duration, which must be positive and not
+// longer than spec.MaxDuration.
+func WithDuration(duration time.Duration) Option {
+	return func(cl *Client) error {
+		if duration <= 0 || duration > spec.MaxDuration {
+			return fmt.Errorf("%w: %s is not in (0, %s]", ErrInvalidDuration,
+				duration, spec.MaxDuration)
+		}
+		cl.Settings.Duration = duration
+		return nil
+	}
+}
+
+// WithHandler sets the Handler of the Client, which must not be nil.
+func WithHandler(handler Handler) Option {
+	return func(cl *Client) error {
+		if handler == nil {
+			return ErrInvalidHandler
+		}
+		cl.Handler = handler
+		return nil
+	}
+}
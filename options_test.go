@@ -0,0 +1,109 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+func TestNew(t *testing.T) {
+	config := &tls.Config{ServerName: "example.com"}
+	handler := MultiHandler()
+	tests := []struct {
+		name     string
+		hostname string
+		opts     []Option
+		err      error
+		check    func(Client) bool
+	}{{
+		name:     "no options",
+		hostname: "example.com",
+		check:    func(cl Client) bool { return cl.Settings.Hostname == "example.com" },
+	}, {
+		name:     "invalid hostname",
+		hostname: "example.com/path",
+		err:      ErrInvalidHostname,
+	}, {
+		name:     "nil option",
+		hostname: "example.com",
+		opts:     []Option{nil, WithPort("4443")},
+		check:    func(cl Client) bool { return cl.Settings.Port == "4443" },
+	}, {
+		name:     "port number",
+		hostname: "example.com",
+		opts:     []Option{WithPort("4443")},
+		check:    func(cl Client) bool { return cl.Settings.Port == "4443" },
+	}, {
+		name:     "service name",
+		hostname: "example.com",
+		opts:     []Option{WithPort("https")},
+		check:    func(cl Client) bool { return cl.Settings.Port == "https" },
+	}, {
+		name:     "empty port",
+		hostname: "example.com",
+		opts:     []Option{WithPort("")},
+		err:      ErrInvalidPort,
+	}, {
+		name:     "out of range port",
+		hostname: "example.com",
+		opts:     []Option{WithPort("65536")},
+		err:      ErrInvalidPort,
+	}, {
+		name:     "TLS config",
+		hostname: "example.com",
+		opts:     []Option{WithTLSConfig(config)},
+		check: func(cl Client) bool {
+			return cl.Settings.Dialer != nil && cl.Settings.Dialer.TLSClientConfig == config
+		},
+	}, {
+		name:     "nil TLS config",
+		hostname: "example.com",
+		opts:     []Option{WithTLSConfig(nil)},
+		err:      ErrInvalidTLSConfig,
+	}, {
+		name:     "duration",
+		hostname: "example.com",
+		opts:     []Option{WithDuration(5 * time.Second)},
+		check:    func(cl Client) bool { return cl.Settings.Duration == 5*time.Second },
+	}, {
+		name:     "zero duration",
+		hostname: "example.com",
+		opts:     []Option{WithDuration(0)},
+		err:      ErrInvalidDuration,
+	}, {
+		name:     "too long duration",
+		hostname: "example.com",
+		opts:     []Option{WithDuration(spec.MaxDuration + time.Second)},
+		err:      ErrInvalidDuration,
+	}, {
+		name:     "handler",
+		hostname: "example.com",
+		opts:     []Option{WithHandler(handler)},
+		check:    func(cl Client) bool { return cl.Handler != nil },
+	}, {
+		name:     "nil handler",
+		hostname: "example.com",
+		opts:     []Option{WithHandler(nil)},
+		err:      ErrInvalidHandler,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl, err := New(tt.hostname, tt.opts...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				if ErrorCodeOf(err) != ErrorCodeInvalidSettings {
+					t.Fatalf("expected an invalid settings error code for %v", err)
+				}
+				return
+			}
+			if !tt.check(cl) {
+				t.Fatalf("unexpected Client: %+v", cl)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package nuvolari
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// pacingBurst is the amount of time worth of data that a pacer allows
+// to transfer at once, after a period of inactivity.
+const pacingBurst = 100 * time.Millisecond
+
+// pacer limits the rate of a transfer using a token bucket, where the
+// tokens are bytes. A nil pacer does not limit the rate.
+type pacer struct {
+	ctx      context.Context
+	deadline time.Time
+	rate     float64 // bytes per second
+	tokens   float64
+	last     time.Time
+}
+
+// newPacer returns a pacer limiting the rate to bitsPerSecond, or nil if
+// bitsPerSecond is not positive. The pacer stops limiting the rate when ctx
+// is done or duration elapses, since the sender of the data stops sending
+// at that point and we need to read the data queued in the socket buffers
+// to complete the test.
+func newPacer(ctx context.Context, bitsPerSecond float64, duration time.Duration) *pacer {
+	if bitsPerSecond <= 0 {
+		return nil
+	}
+	rate, now := bitsPerSecond/8, time.Now()
+	return &pacer{
+		ctx:      ctx,
+		deadline: now.Add(duration),
+		rate:     rate,
+		last:     now,
+	}
+}
+
+// wait consumes n bytes worth of tokens, waiting until the bucket is not
+// in debt anymore, so that the mean rate does not exceed the limit.
+func (p *pacer) wait(n int) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	if now.After(p.deadline) {
+		return
+	}
+	p.tokens = min(p.tokens+now.Sub(p.last).Seconds()*p.rate, p.rate*pacingBurst.Seconds())
+	p.tokens -= float64(n)
+	p.last = now
+	if p.tokens >= 0 {
+		return
+	}
+	delay := time.Duration(-p.tokens / p.rate * float64(time.Second))
+	timer := time.NewTimer(min(delay, p.deadline.Sub(now)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.ctx.Done():
+	}
+}
+
+// writer returns a writer that paces the writes to w.
+func (p *pacer) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return pacedWriter{w: w, p: p}
+}
+
+type pacedWriter struct {
+	w io.Writer
+	p *pacer
+}
+
+func (pw pacedWriter) Write(data []byte) (int, error) {
+	n, err := pw.w.Write(data)
+	pw.p.wait(n)
+	return n, err
+}
@@ -0,0 +1,80 @@
+package nuvolari
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestPacerLimitsTheRate(t *testing.T) {
+	// At 1 MB/s, writing 300 kB takes 300 ms, minus the burst
+	p := newPacer(context.Background(), 8e6, 10*time.Second)
+	w := p.writer(ioutil.Discard)
+	t0 := time.Now()
+	for i := 0; i < 300; i++ {
+		w.Write(make([]byte, 1000))
+	}
+	if elapsed := time.Since(t0); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected about 300 ms, got %s", elapsed)
+	}
+}
+
+func TestPacerStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tests := []struct {
+		name  string
+		pacer *pacer
+	}{
+		{name: "after duration", pacer: newPacer(context.Background(), 8e3, 50*time.Millisecond)},
+		{name: "when ctx is done", pacer: newPacer(ctx, 8e3, 10*time.Second)},
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// At 1 kB/s, writing 1 MB would take more than 15 minutes
+			w := tt.pacer.writer(ioutil.Discard)
+			t0 := time.Now()
+			for i := 0; i < 1000; i++ {
+				w.Write(make([]byte, 1000))
+			}
+			if elapsed := time.Since(t0); elapsed > time.Second {
+				t.Fatalf("the pacer did not stop, elapsed %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestNoPacerWithoutRate(t *testing.T) {
+	if p := newPacer(context.Background(), 0, time.Second); p != nil {
+		t.Fatal("expected no pacer")
+	}
+	if w := (*pacer)(nil).writer(ioutil.Discard); w != ioutil.Discard {
+		t.Fatal("expected the nil pacer not to wrap the writer")
+	}
+}
+
+func TestMaxDownloadRate(t *testing.T) {
+	const rate = 20e6
+	cl := newTestClient(t)
+	cl.Settings.MaxDownloadRate = rate
+	results, err := cl.RunDownloadWithResults(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checked int
+	for _, m := range results.ClientMeasurements {
+		// Skip the last measurements, when we stop limiting the rate
+		if m.Elapsed <= 0 || m.Elapsed > 0.8 {
+			continue
+		}
+		if m.Throughput > 2*rate {
+			t.Fatalf("expected at most %g bit/s, got %g bit/s at %.2f s",
+				rate, m.Throughput, m.Elapsed)
+		}
+		checked++
+	}
+	if checked <= 0 {
+		t.Fatal("no client measurements to check")
+	}
+}
@@ -0,0 +1,95 @@
+package nuvolari
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Number of bits of the addresses that we keep in privacy mode.
+const (
+	privacyIPv4Bits = 24
+	privacyIPv6Bits = 48
+)
+
+// truncateIP returns ip with only its network part, or nil if ip is nil.
+func truncateIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(privacyIPv4Bits, 32))
+	}
+	if ip != nil {
+		return ip.Mask(net.CIDRMask(privacyIPv6Bits, 128))
+	}
+	return nil
+}
+
+// redactEndpoint truncates the address of an endpoint (e.g. "1.2.3.4:5")
+// and strips the port. Since hostnames may identify the user, we strip
+// them entirely.
+func redactEndpoint(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	if ip := truncateIP(net.ParseIP(host)); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// addressPattern matches strings that may be IPv4 or IPv6 addresses.
+var addressPattern = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
+// RedactAddresses truncates all the IP addresses in s in the same way
+// in which privacy mode truncates the addresses in the events. Use it to
+// redact free form text, such as error messages, before storing it.
+func RedactAddresses(s string) string {
+	return addressPattern.ReplaceAllStringFunc(s, func(match string) string {
+		// Keep the trailing port, if any, since it is not identifying
+		trimmed := strings.Trim(match, ":.")
+		if ip := net.ParseIP(trimmed); ip != nil {
+			return strings.Replace(match, trimmed, truncateIP(ip).String(), 1)
+		}
+		if host, port, err := net.SplitHostPort(trimmed); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				return strings.Replace(match, trimmed,
+					net.JoinHostPort(truncateIP(ip).String(), port), 1)
+			}
+		}
+		return match
+	})
+}
+
+// redactMeasurement returns a copy of m where the client endpoint has
+// been redacted, if we are in privacy mode.
+func (cl Client) redactMeasurement(m Measurement) Measurement {
+	if cl.Settings.Privacy && m.ConnectionInfo != nil {
+		ci := *m.ConnectionInfo
+		ci.Client = redactEndpoint(ci.Client)
+		m.ConnectionInfo = &ci
+	}
+	return m
+}
+
+// redactedError is an error whose message is redacted (see RedactAddresses)
+// and which still wraps the original error, so that errors.Is works.
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string {
+	return RedactAddresses(e.err.Error())
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with its message redacted, if we are in privacy
+// mode, so that we do not store or emit the addresses it may contain.
+func (cl Client) redactError(err error) error {
+	if !cl.Settings.Privacy || err == nil {
+		return err
+	}
+	return redactedError{err: err}
+}
@@ -0,0 +1,44 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPrivacyRedactsFailure(t *testing.T) {
+	// Get a port where nobody is listening, so that the dial fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	cl := Client{Settings: Settings{
+		Hostname: "127.0.0.1",
+		Port:     port,
+		Scheme:   "ws",
+		Privacy:  true,
+	}}
+	results, err := cl.RunDownloadWithResults(context.Background())
+	if err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	for _, s := range []string{results.Failure, err.Error()} {
+		if strings.Contains(s, "127.0.0.1") {
+			t.Errorf("failure not redacted: %s", s)
+		}
+		if !strings.Contains(s, "127.0.0.0") {
+			t.Errorf("failure does not contain the truncated address: %s", s)
+		}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("redaction lost the error chain: %v", err)
+	}
+}
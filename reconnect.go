@@ -0,0 +1,127 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// minReconnectTime is the minimum remaining time for which it makes sense
+// to reconnect and continue the test (see Settings.Reconnect).
+const minReconnectTime = time.Second
+
+// transient tells whether err, which occurred while measuring, may be
+// caused by a temporary problem of the network (e.g. a wireless link).
+func transient(err error) bool {
+	var netError net.Error
+	return errors.As(err, &netError) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// reconnectHandler adjusts the client measurements of the connections
+// following the first one, such that the measurements form a single
+// series starting at the beginning of the test.
+type reconnectHandler struct {
+	Handler
+	duration float64 // seconds the whole test lasts
+	elapsed  float64 // seconds between the beginning and this connection
+	numBytes int64   // bytes transferred by the previous connections
+	last     int64   // bytes transferred by this connection
+	gap      float64 // seconds we spent reconnecting, if not yet reported
+}
+
+func (rh *reconnectHandler) adjust(m Measurement) Measurement {
+	rh.last = m.NumBytes
+	m.Elapsed += rh.elapsed
+	m.NumBytes += rh.numBytes
+	if m.Elapsed > 0 {
+		m.Throughput = float64(m.NumBytes) * 8 / m.Elapsed
+	}
+	if m.AppInfo != nil {
+		m.AppInfo = spec.NewAppInfo(time.Duration(m.Elapsed*float64(time.Second)), m.NumBytes)
+	}
+	m.Gap, rh.gap = rh.gap, 0
+	return m
+}
+
+func (rh *reconnectHandler) OnClientDownloadMeasurement(m Measurement) {
+	rh.Handler.OnClientDownloadMeasurement(rh.adjust(m))
+}
+
+func (rh *reconnectHandler) OnClientUploadMeasurement(m Measurement) {
+	rh.Handler.OnClientUploadMeasurement(rh.adjust(m))
+}
+
+// OnProgress converts the progress of the connection, which lasts for the
+// remaining time, into the progress of the whole test.
+func (rh *reconnectHandler) OnProgress(p Progress) {
+	if rh.duration > 0 {
+		done := rh.elapsed + p.Percent/100*(rh.duration-rh.elapsed)
+		p.Percent = math.Min(100, done/rh.duration*100)
+	}
+	rh.Handler.OnProgress(p)
+}
+
+// reconnected records that the connection we are about to use starts
+// elapsed after the beginning, following a gap without connection.
+func (rh *reconnectHandler) reconnected(elapsed, gap time.Duration) {
+	rh.elapsed = elapsed.Seconds()
+	rh.numBytes += rh.last
+	rh.last = 0
+	rh.gap = gap.Seconds()
+}
+
+// runReconnecting runs test over conn, which we established using wsURL,
+// using run. With Settings.Reconnect, when run fails because of a transient
+// error, we reconnect to wsURL and continue, as long as there is time left.
+func (cl Client) runReconnecting(ctx context.Context, conn *websocket.Conn, wsURL url.URL,
+	test string, run func(Client, context.Context, *websocket.Conn) error) error {
+	defer func() { conn.Close() }()
+	if !cl.Settings.Reconnect {
+		return run(cl, ctx, conn)
+	}
+	duration := cl.Settings.duration()
+	// Without a Handler, we wrap a Handler discarding the events
+	rh := &reconnectHandler{Handler: MultiHandler(cl.Handler), duration: duration.Seconds()}
+	cl.Handler = rh
+	t0 := time.Now()
+	for {
+		err := run(cl, ctx, conn)
+		if err == nil || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+		tFailure := time.Now()
+		remaining := duration - tFailure.Sub(t0)
+		if remaining < minReconnectTime {
+			return err
+		}
+		reason := err.Error()
+		if cl.Settings.Privacy {
+			reason = RedactAddresses(reason)
+		}
+		cl.logInfo(LogReconnecting, "Reconnecting after: "+reason, "test", test, "error", reason)
+		conn.Close()
+		// Ask the server to run only for the remaining time
+		cl.Settings.Duration = remaining
+		query := wsURL.Query()
+		query.Set(spec.DurationParameter, strconv.FormatInt(remaining.Milliseconds(), 10))
+		wsURL.RawQuery = query.Encode()
+		conn, err = cl.connect(ctx, wsURL)
+		if err != nil {
+			if ctx.Err() != nil {
+				cl.logInfo(LogInterrupted, interruptedMessage(test), "test", test)
+				return wrapError(ErrInterrupted, ctx.Err())
+			}
+			return err
+		}
+		now := time.Now()
+		rh.reconnected(now.Sub(t0), now.Sub(tFailure))
+	}
+}
@@ -0,0 +1,62 @@
+package nuvolari
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/nuvolari/server"
+)
+
+// resettingListener resets the first connection it accepts after delay,
+// to simulate a transient network failure.
+type resettingListener struct {
+	net.Listener
+	delay time.Duration
+	once  sync.Once
+}
+
+func (rl *resettingListener) Accept() (net.Conn, error) {
+	conn, err := rl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	rl.once.Do(func() {
+		time.AfterFunc(rl.delay, func() {
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0) // Send RST rather than FIN
+			}
+			conn.Close()
+		})
+	})
+	return conn, nil
+}
+
+func TestReconnectWithoutHandler(t *testing.T) {
+	srv := httptest.NewUnstartedServer(server.NewServeMux())
+	srv.Listener = &resettingListener{Listener: srv.Listener, delay: 300 * time.Millisecond}
+	srv.Start()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := Client{Settings: Settings{
+		Hostname:  host,
+		Port:      port,
+		Scheme:    "ws",
+		Duration:  2 * time.Second,
+		Reconnect: true,
+	}}
+	if err := cl.RunDownload(context.Background()); err != nil {
+		t.Fatalf("expected to reconnect, got %s", err)
+	}
+}
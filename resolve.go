@@ -0,0 +1,78 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/nuvolari/doh"
+	"github.com/gorilla/websocket"
+)
+
+// Resolver resolves hostnames. *net.Resolver and doh.Resolver implement it.
+type Resolver interface {
+	// LookupHost returns the addresses of host.
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolver returns the resolver to use, or nil to let the dialer resolve
+// the hostname as usual.
+func (s Settings) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	if s.DoHURL != "" {
+		return doh.Resolver{URL: s.DoHURL}
+	}
+	return nil
+}
+
+// wrapResolver returns a dial function that resolves the hostname using
+// r, emits LogResolved and then dials each address in turn using the dial
+// function that d would use, until one succeeds.
+func (cl Client) wrapResolver(d websocket.Dialer, r Resolver) func(
+	context.Context, string, string) (net.Conn, error) {
+	dial := wrapDialContext(d, func(conn net.Conn) net.Conn { return conn })
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+		}
+		t0 := time.Now()
+		addrs, err := r.LookupHost(ctx, host)
+		if err == nil && len(addrs) <= 0 {
+			err = doh.ErrNoAddresses
+		}
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{Err: err})
+		}
+		if err != nil {
+			// Let ErrorCodeOf classify this as a DNS failure
+			return nil, &net.DNSError{Err: err.Error(), Name: host, UnwrapErr: err}
+		}
+		elapsed := time.Since(t0)
+		cl.logInfo(LogResolved, "Resolved "+host+" to "+strings.Join(addrs, ", "),
+			"hostname", host, "addresses", strings.Join(addrs, ","),
+			"elapsed", strconv.FormatInt(elapsed.Milliseconds(), 10))
+		var errs []error
+		for _, addr := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
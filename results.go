@@ -0,0 +1,412 @@
+package nuvolari
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/bassosimone/nuvolari/stats"
+	"github.com/gorilla/websocket"
+)
+
+// Results summarizes a test, so that callers do not need to aggregate
+// the events themselves.
+type Results struct {
+	// Test is either "download" or "upload".
+	Test string `json:"test"`
+
+	// ClientVersion identifies the client that produced the Results.
+	ClientVersion VersionInfo `json:"client_version"`
+
+	// TestID identifies the test (see Settings.TestID).
+	TestID string `json:"test_id,omitempty"`
+
+	// NumBytes is the number of bytes transferred at application level.
+	NumBytes int64 `json:"num_bytes"`
+
+	// Elapsed is the number of seconds elapsed when we transferred
+	// NumBytes, according to the client measurements.
+	Elapsed float64 `json:"elapsed"`
+
+	// MeanThroughput is the mean throughput in bit/s, excluding the
+	// first WarmUp seconds of the test.
+	MeanThroughput float64 `json:"mean_throughput"`
+
+	// WarmUp is the number of seconds at the beginning of the test that
+	// we excluded when computing MeanThroughput (see Settings.WarmUp). It
+	// is zero when the test is too short to exclude anything.
+	WarmUp float64 `json:"warm_up,omitempty"`
+
+	// MaxThroughput is the highest throughput, in bit/s, measured in any
+	// interval between two consecutive client measurements.
+	MaxThroughput float64 `json:"max_throughput"`
+
+	// Stability contains the statistics of the throughput measured in
+	// each interval between two consecutive client measurements, after
+	// the warm-up, if any. It is nil when there are no such intervals.
+	Stability *ThroughputStats `json:"stability,omitempty"`
+
+	// MinRTT is the minimum RTT in milliseconds, or zero if unknown.
+	MinRTT float64 `json:"min_rtt,omitempty"`
+
+	// LatencyUnderLoad describes how much the RTT grew during the test,
+	// if we have RTT samples (see Settings.PingInterval).
+	LatencyUnderLoad *LatencyUnderLoad `json:"latency_under_load,omitempty"`
+
+	// ClientCongestionControl is the TCP congestion control algorithm
+	// used by the client, if known.
+	ClientCongestionControl string `json:"client_congestion_control,omitempty"`
+
+	// ServerCongestionControl is the TCP congestion control algorithm
+	// used by the server, if known. When the server does not report it,
+	// but sends BBR information, we assume that it uses BBR.
+	ServerCongestionControl string `json:"server_congestion_control,omitempty"`
+
+	// Jitter is the median of the Jitter of the client measurements, in
+	// milliseconds, or zero if unknown.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// Retransmissions is the number of segments that the sender of the
+	// data retransmitted, or zero if unknown. For multi-stream tests, it
+	// is the sum over all the connections.
+	Retransmissions int64 `json:"retransmissions,omitempty"`
+
+	// LossRate is the estimated fraction of the segments that were lost,
+	// or zero if unknown (see Measurement.LossRate).
+	LossRate float64 `json:"loss_rate,omitempty"`
+
+	// ArrivalJitter is the median of the ArrivalJitter of the client
+	// measurements, in milliseconds, or zero if unknown.
+	ArrivalJitter float64 `json:"arrival_jitter,omitempty"`
+
+	// TLS describes the TLS connection, if any. For multi-stream tests, it
+	// describes the first connection.
+	TLS *TLSInfo `json:"tls,omitempty"`
+
+	// ConnectionSetup breaks down the time to establish the connection.
+	// For multi-stream tests, it describes the first connection.
+	ConnectionSetup *ConnectionSetup `json:"connection_setup,omitempty"`
+
+	// Streams contains the results of each connection of multi-stream
+	// tests, while the other fields refer to all the connections.
+	Streams []StreamResults `json:"streams,omitempty"`
+
+	// ServerMeasurements contains the server measurements.
+	ServerMeasurements []Measurement `json:"server_measurements,omitempty"`
+
+	// ClientMeasurements contains the client measurements. For multi-stream
+	// tests, these are the measurements aggregating all the connections.
+	ClientMeasurements []Measurement `json:"client_measurements,omitempty"`
+
+	// Diagnoses contains the signs of traffic shaping or proxying that
+	// we noticed analyzing the measurements, if any (see Diagnose).
+	Diagnoses []Diagnosis `json:"diagnoses,omitempty"`
+
+	// Failure is the error that occurred, if any.
+	Failure string `json:"failure,omitempty"`
+}
+
+// ThroughputStats describes the distribution of the throughput, in bit/s,
+// measured in each interval of a test, which shows how stable it was.
+type ThroughputStats struct {
+	// P5 is the 5th percentile.
+	P5 float64 `json:"p5"`
+
+	// P25 is the 25th percentile.
+	P25 float64 `json:"p25"`
+
+	// P50 is the median.
+	P50 float64 `json:"p50"`
+
+	// P75 is the 75th percentile.
+	P75 float64 `json:"p75"`
+
+	// P95 is the 95th percentile.
+	P95 float64 `json:"p95"`
+
+	// CV is the coefficient of variation, i.e. the standard deviation
+	// divided by the mean, which is zero when the throughput is constant.
+	CV float64 `json:"cv"`
+}
+
+// newThroughputStats returns the ThroughputStats of rates, or nil if
+// rates is empty.
+func newThroughputStats(rates []float64) *ThroughputStats {
+	if len(rates) <= 0 {
+		return nil
+	}
+	ts := &ThroughputStats{
+		P5:  stats.Percentile(rates, 5),
+		P25: stats.Percentile(rates, 25),
+		P50: stats.Percentile(rates, 50),
+		P75: stats.Percentile(rates, 75),
+		P95: stats.Percentile(rates, 95),
+	}
+	if mean := stats.Mean(rates); mean > 0 {
+		ts.CV = stats.StdDev(rates) / mean
+	}
+	return ts
+}
+
+// StreamResults summarizes a connection of a multi-stream test.
+type StreamResults struct {
+	// Stream is the 1-based number of the connection.
+	Stream int `json:"stream"`
+
+	// NumBytes is the number of bytes transferred at application level.
+	NumBytes int64 `json:"num_bytes"`
+
+	// Elapsed is the number of seconds elapsed when we transferred NumBytes.
+	Elapsed float64 `json:"elapsed"`
+
+	// MeanThroughput is the mean throughput in bit/s.
+	MeanThroughput float64 `json:"mean_throughput"`
+}
+
+// resultsRecorder is a Handler that collects measurements for Results.
+type resultsRecorder struct {
+	warmUp  time.Duration
+	server  []Measurement
+	client  []Measurement
+	streams []Measurement
+	tls     *TLSInfo
+	setup   *ConnectionSetup
+}
+
+// addClient records a client measurement of either test.
+func (rr *resultsRecorder) addClient(m Measurement) {
+	if m.Stream != 0 {
+		rr.streams = append(rr.streams, m)
+		return
+	}
+	rr.client = append(rr.client, m)
+}
+
+func (rr *resultsRecorder) OnLogInfo(m LogMessage) {
+	if info := TLSInfoOf(m); info != nil && rr.tls == nil {
+		rr.tls = info
+	}
+	if cs := ConnectionSetupOf(m); cs != nil && rr.setup == nil {
+		rr.setup = cs
+	}
+}
+
+func (rr *resultsRecorder) OnServerDownloadMeasurement(m Measurement) {
+	rr.server = append(rr.server, m)
+}
+
+func (rr *resultsRecorder) OnClientDownloadMeasurement(m Measurement) {
+	rr.addClient(m)
+}
+
+func (rr *resultsRecorder) OnServerUploadMeasurement(m Measurement) {
+	rr.server = append(rr.server, m)
+}
+
+func (rr *resultsRecorder) OnClientUploadMeasurement(m Measurement) {
+	rr.addClient(m)
+}
+
+func (rr *resultsRecorder) OnFinding(Finding) {}
+
+func (rr *resultsRecorder) OnProgress(Progress) {}
+
+// failedResults returns the Results of test, which failed with err before
+// running, e.g. because it was interrupted.
+func failedResults(test string, err error) *Results {
+	return &Results{Test: test, ClientVersion: Version(), Failure: err.Error()}
+}
+
+// results computes the Results of test, which failed with err if not nil.
+func (rr *resultsRecorder) results(test string, err error) *Results {
+	r := &Results{
+		Test:               test,
+		ClientVersion:      Version(),
+		ServerMeasurements: rr.server,
+		ClientMeasurements: rr.client,
+		TLS:                rr.tls,
+		ConnectionSetup:    rr.setup,
+	}
+	if err != nil {
+		r.Failure = err.Error()
+	}
+	for _, m := range rr.client {
+		if m.TestID != "" {
+			r.TestID = m.TestID
+			break
+		}
+	}
+	var prev, first Measurement
+	var rates, steadyRates, loaded, jitter, arrivalJitter []float64
+	var idle float64
+	var lossy Measurement
+	lossyStreams := make(map[int]Measurement)
+	// addClient processes the client measurements of either kind
+	addClient := func(m Measurement) {
+		if ci := m.ConnectionInfo; ci != nil && r.ClientCongestionControl == "" {
+			r.ClientCongestionControl = ci.CongestionControl
+		}
+		r.MinRTT = clientMinRTT(r.MinRTT, m)
+		if m.LoadedRTT > 0 && m.RTTInflation > 0 {
+			loaded = append(loaded, m.LoadedRTT)
+			idle = minRTT(idle, m.LoadedRTT/m.RTTInflation)
+		}
+		if m.Jitter > 0 {
+			jitter = append(jitter, m.Jitter)
+		}
+		if m.ArrivalJitter > 0 {
+			arrivalJitter = append(arrivalJitter, m.ArrivalJitter)
+		}
+	}
+	for _, m := range rr.client {
+		if dt := m.Elapsed - prev.Elapsed; dt > 0 {
+			rate := float64(m.NumBytes-prev.NumBytes) * 8 / dt
+			r.MaxThroughput = math.Max(r.MaxThroughput, rate)
+			rates = append(rates, rate)
+			if first.Elapsed > 0 {
+				steadyRates = append(steadyRates, rate)
+			}
+		}
+		if rr.warmUp > 0 && first.Elapsed == 0 && m.Elapsed >= rr.warmUp.Seconds() {
+			first = m
+		}
+		addClient(m)
+		if m.Retransmissions > 0 {
+			lossy = m
+		}
+		prev = m
+	}
+	for _, m := range rr.streams {
+		addClient(m)
+		if m.Retransmissions > 0 {
+			lossyStreams[m.Stream] = m
+		}
+		for len(r.Streams) < m.Stream {
+			r.Streams = append(r.Streams, StreamResults{Stream: len(r.Streams) + 1})
+		}
+		sr := &r.Streams[m.Stream-1]
+		sr.NumBytes, sr.Elapsed = m.NumBytes, m.Elapsed
+		if sr.Elapsed > 0 {
+			sr.MeanThroughput = float64(sr.NumBytes) * 8 / sr.Elapsed
+		}
+	}
+	r.NumBytes, r.Elapsed = prev.NumBytes, prev.Elapsed
+	// We only exclude the warm-up when there is time left afterwards
+	if first.Elapsed > 0 && prev.Elapsed > first.Elapsed {
+		r.WarmUp = first.Elapsed
+		r.MeanThroughput = float64(r.NumBytes-first.NumBytes) * 8 / (r.Elapsed - first.Elapsed)
+		rates = steadyRates
+	} else if r.Elapsed > 0 {
+		r.MeanThroughput = float64(r.NumBytes) * 8 / r.Elapsed
+	}
+	r.Stability = newThroughputStats(rates)
+	var sentBBRInfo bool
+	for _, m := range rr.server {
+		if m.BBRInfo != nil && m.BBRInfo.MinRTT > 0 {
+			r.MinRTT = minRTT(r.MinRTT, m.BBRInfo.MinRTT)
+		}
+		if ci := m.ConnectionInfo; ci != nil && r.ServerCongestionControl == "" {
+			r.ServerCongestionControl = ci.CongestionControl
+		}
+		sentBBRInfo = sentBBRInfo || m.BBRInfo != nil
+	}
+	if r.ServerCongestionControl == "" && sentBBRInfo {
+		r.ServerCongestionControl = "bbr"
+	}
+	r.LatencyUnderLoad = newLatencyUnderLoad(idle, loaded)
+	r.Jitter = stats.Median(jitter)
+	r.Retransmissions, r.LossRate = lossy.Retransmissions, lossy.LossRate
+	if len(lossyStreams) > 0 {
+		// The counters are cumulative, hence we use the last measurement
+		// of each stream, weighting the loss rate by the bytes transferred
+		var numBytes int64
+		for _, sr := range r.Streams {
+			numBytes += sr.NumBytes
+		}
+		for _, m := range lossyStreams {
+			r.Retransmissions += m.Retransmissions
+			if numBytes > 0 {
+				r.LossRate += m.LossRate * float64(r.Streams[m.Stream-1].NumBytes) / float64(numBytes)
+			}
+		}
+	}
+	r.ArrivalJitter = stats.Median(arrivalJitter)
+	return r
+}
+
+// clientMinRTT returns the minimum between cur and the RTTs in m.
+func clientMinRTT(cur float64, m Measurement) float64 {
+	if m.TCPInfo != nil && m.TCPInfo.RTT > 0 {
+		cur = minRTT(cur, float64(m.TCPInfo.RTT)/1000)
+	}
+	for _, rtt := range m.AppRTT {
+		cur = minRTT(cur, rtt)
+	}
+	return cur
+}
+
+// minRTT returns the minimum between cur, where zero means unknown, and v.
+func minRTT(cur, v float64) float64 {
+	if cur <= 0 {
+		return v
+	}
+	return math.Min(cur, v)
+}
+
+// finalMeasurement returns the client measurement that we emit when test
+// fails after transferring count bytes more than countLast, which the
+// last measurement, taken at tLast, says, so that the measurements cover
+// all the data until the failure.
+func (cl Client) finalMeasurement(test string, conn *websocket.Conn, t0, tLast time.Time,
+	count, countLast int64) Measurement {
+	now := time.Now()
+	m := cl.clientMeasurement(test, now.Sub(t0), count, now.Sub(tLast), count-countLast)
+	m.TCPInfo = tcpInfo(conn)
+	return m
+}
+
+// withRecorder returns a copy of cl whose Handler also delivers all the
+// events to recorder, and a function to call when the test is over (see
+// withSink). The Settings.EventMask only applies to the Handler and to the
+// Sink, so that the recorder does not miss the measurements.
+func (cl Client) withRecorder(recorder Handler) (Client, func()) {
+	cl, closeSink := cl.withSink()
+	if cl.Handler != nil && cl.Settings.EventMask != 0 {
+		cl.Handler = maskedHandler{Handler: cl.Handler, mask: cl.Settings.EventMask}
+	}
+	cl.Settings.EventMask = EventAll
+	cl.Handler = MultiHandler(cl.Handler, recorder)
+	return cl, closeSink
+}
+
+// runWithResults runs a test, recording its measurements, and returns
+// the Results along with the error that occurred, if any.
+func (cl Client) runWithResults(ctx context.Context, test string,
+	run func(Client, context.Context) error) (*Results, error) {
+	// Generate the TestID here, so that the Results contain it even if
+	// the test fails before emitting any measurement
+	if err := cl.Settings.ensureTestID(); err != nil {
+		err = cl.redactError(err)
+		return failedResults(test, err), err
+	}
+	rr := &resultsRecorder{warmUp: cl.Settings.warmUp()}
+	cl, closeSink := cl.withRecorder(rr)
+	defer closeSink()
+	err := cl.redactError(run(cl, ctx))
+	results := rr.results(test, err)
+	results.TestID = cl.Settings.TestID
+	results.Diagnoses = Diagnose(results)
+	return results, err
+}
+
+// RunDownloadWithResults is like RunDownload but also returns the Results.
+// When the test fails, the Results contain the Failure along with all the
+// measurements collected until the failure, so that they are not lost.
+func (cl Client) RunDownloadWithResults(ctx context.Context) (*Results, error) {
+	return cl.runWithResults(ctx, "download", Client.RunDownload)
+}
+
+// RunUploadWithResults is like RunUpload but also returns the Results.
+func (cl Client) RunUploadWithResults(ctx context.Context) (*Results, error) {
+	return cl.runWithResults(ctx, "upload", Client.RunUpload)
+}
@@ -0,0 +1,43 @@
+package nuvolari
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEventMaskDoesNotFilterResults(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Settings.EventMask = EventProgress
+	var summary *SummaryEvent
+	for ev := range cl.Download(context.Background()) {
+		switch ev := ev.(type) {
+		case MeasurementEvent, LogEvent:
+			t.Fatalf("unexpected event %T despite the EventMask", ev)
+		case SummaryEvent:
+			summary = &ev
+		}
+	}
+	if summary == nil || summary.Results == nil {
+		t.Fatal("expected a SummaryEvent with the Results")
+	}
+	if len(summary.ClientMeasurements) <= 0 || summary.NumBytes <= 0 {
+		t.Fatal("expected the Results to contain the measurements")
+	}
+}
+
+func TestResultsHaveClientVersion(t *testing.T) {
+	cl := newTestClient(t)
+	results, err := cl.RunDownloadWithResults(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.ClientVersion != Version() {
+		t.Fatalf("expected %+v, got %+v", Version(), results.ClientVersion)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	all, _ := cl.RunAll(ctx)
+	if all.Download == nil || all.Download.ClientVersion.Version == "" {
+		t.Fatal("expected the Results of a failed test to have the ClientVersion")
+	}
+}
@@ -0,0 +1,96 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RetrySettings contains the settings for retrying to connect when
+// connecting or the WebSocket handshake fails.
+type RetrySettings struct {
+	// MaxAttempts is the maximum number of attempts to connect, cycling
+	// through the candidate servers (see Settings.Servers). Zero means
+	// trying each candidate server once.
+	MaxAttempts int
+
+	// Backoff is the delay before the second attempt, which doubles at
+	// each further attempt, up to one minute. Zero means retrying
+	// immediately.
+	Backoff time.Duration
+}
+
+// maxBackoff is the maximum delay between attempts to connect.
+const maxBackoff = time.Minute
+
+// candidates returns the servers to try: Hostname, if set, followed by
+// Servers. An empty string means discovering the server.
+func (s Settings) candidates() []string {
+	var servers []string
+	if s.Hostname != "" || len(s.Servers) == 0 {
+		servers = append(servers, s.Hostname)
+	}
+	return append(servers, s.Servers...)
+}
+
+// retryable tells whether we should retry to connect after err.
+func retryable(err error) bool {
+	return errors.Is(err, ErrDialFailed) || errors.Is(err, ErrHandshake)
+}
+
+// dial establishes a connection with the server, trying the candidate
+// servers according to Settings.Retry, and returns the connection and
+// the URL we used. On failure, the URL is the one of the last attempt,
+// if any, so that we know which server refused the connection.
+func (cl Client) dial(ctx context.Context, path string) (*websocket.Conn, url.URL, error) {
+	servers := cl.Settings.candidates()
+	attempts := cl.Settings.Retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = len(servers)
+	}
+	backoff := cl.Settings.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		server := servers[(attempt-1)%len(servers)]
+		current := cl
+		current.Settings.Hostname = server
+		if attempts > 1 {
+			name := server
+			if name == "" {
+				name = "auto"
+			}
+			cl.logInfo(LogAttempt, "Attempt "+strconv.Itoa(attempt)+" of "+
+				strconv.Itoa(attempts)+": "+name, "attempt", strconv.Itoa(attempt), "server", name)
+		}
+		wsURL, err := current.serverURL(ctx, path)
+		if err != nil {
+			return nil, url.URL{}, err
+		}
+		conn, err := current.connect(ctx, wsURL)
+		if err == nil {
+			return conn, wsURL, nil
+		}
+		if !retryable(err) || attempt >= attempts || ctx.Err() != nil {
+			return nil, wsURL, err
+		}
+		reason := err.Error()
+		if cl.Settings.Privacy {
+			reason = RedactAddresses(reason)
+		}
+		cl.logInfo(LogAttemptFailed, "Attempt failed: "+reason, "attempt",
+			strconv.Itoa(attempt), "error", reason)
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, wsURL, err
+			}
+			backoff = min(2*backoff, maxBackoff)
+		}
+	}
+}
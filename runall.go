@@ -0,0 +1,124 @@
+package nuvolari
+
+import (
+	"context"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// AllResults summarizes the tests run by RunAll.
+type AllResults struct {
+	// Download summarizes the download.
+	Download *Results `json:"download"`
+
+	// Upload summarizes the upload, or is nil if we did not run it
+	// because the download failed.
+	Upload *Results `json:"upload,omitempty"`
+
+	// CompressibleUpload summarizes the upload using compressible data
+	// (see Settings.CheckCompression), if we ran it. Its Diagnoses contain
+	// the outcome of DiagnoseCompression.
+	CompressibleUpload *Results `json:"compressible_upload,omitempty"`
+}
+
+// compressiblePattern is the Upload.Pattern of the compressible upload.
+var compressiblePattern = []byte{0}
+
+// RunAll runs a ndt7 download followed, after Settings.InterTestGap, by a
+// ndt7 upload, using the same server. With AutoDiscover, we discover the
+// server once. If the download fails, we do not run the upload. With
+// Settings.CheckCompression, we then run another upload. Like
+// RunDownload, it returns an error wrapping ErrInterrupted if ctx is
+// cancelled before the tests are over.
+func (cl Client) RunAll(ctx context.Context) (*AllResults, error) {
+	return cl.runAll(ctx, func(*Results, error) {})
+}
+
+// runAll implements RunAll, calling done when each test is over.
+func (cl Client) runAll(ctx context.Context, done func(*Results, error)) (*AllResults, error) {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	all := &AllResults{}
+	if cl.Settings.Hostname == "" && cl.Settings.AutoDiscover {
+		located, err := cl.locateServer(ctx, spec.DownloadURLPath)
+		if err != nil {
+			err = cl.redactError(err)
+			all.Download = failedResults("download", err)
+			done(all.Download, err)
+			return all, err
+		}
+		cl.located = located
+	}
+	results, err := cl.RunDownloadWithResults(ctx)
+	all.Download = results
+	done(results, err)
+	if err != nil {
+		return all, err
+	}
+	if err := cl.interTestGap(ctx, "upload"); err != nil {
+		err = cl.redactError(err)
+		all.Upload = failedResults("upload", err)
+		done(all.Upload, err)
+		return all, err
+	}
+	return all, cl.runUploads(ctx, all, done)
+}
+
+// RunUploadWithCompressionCheck is like RunUploadWithResults but, with
+// Settings.CheckCompression, it then runs another upload using compressible
+// data, like RunAll does. The returned AllResults contain the Upload and
+// the CompressibleUpload, if we ran it, but not the Download.
+func (cl Client) RunUploadWithCompressionCheck(ctx context.Context) (*AllResults, error) {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	all := &AllResults{}
+	return all, cl.runUploads(ctx, all, func(*Results, error) {})
+}
+
+// runUploads runs the upload and, with Settings.CheckCompression, the
+// compressible upload, saving their Results in all and calling done when
+// each of them is over.
+func (cl Client) runUploads(ctx context.Context, all *AllResults, done func(*Results, error)) error {
+	results, err := cl.RunUploadWithResults(ctx)
+	all.Upload = results
+	done(results, err)
+	if err != nil || !cl.Settings.CheckCompression || len(cl.Settings.Upload.Pattern) > 0 {
+		return err
+	}
+	if err := cl.interTestGap(ctx, "upload"); err != nil {
+		err = cl.redactError(err)
+		all.CompressibleUpload = failedResults("upload", err)
+		done(all.CompressibleUpload, err)
+		return err
+	}
+	compressible := cl
+	compressible.Settings.Upload.Pattern = compressiblePattern
+	results, err = compressible.RunUploadWithResults(ctx)
+	if err == nil {
+		if d := DiagnoseCompression(all.Upload, results); d != nil {
+			results.Diagnoses = append(results.Diagnoses, *d)
+		}
+	}
+	all.CompressibleUpload = results
+	done(results, err)
+	return err
+}
+
+// interTestGap waits for Settings.InterTestGap before running test. It
+// returns an error wrapping ErrInterrupted if ctx is cancelled meanwhile.
+func (cl Client) interTestGap(ctx context.Context, test string) error {
+	gap := cl.Settings.InterTestGap
+	if gap <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(gap)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		cl.logInfo(LogInterrupted, interruptedMessage(test), "test", test)
+		return wrapError(ErrInterrupted, ctx.Err())
+	}
+}
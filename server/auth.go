@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Verifier tells whether a request is authorized.
+type Verifier func(r *http.Request) bool
+
+// RequireAuth wraps h such that requests not authorized by verify
+// fail with 401 Unauthorized before the WebSocket upgrade.
+func RequireAuth(h http.Handler, verify Verifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verify(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// BearerToken returns the bearer token in the Authorization header of
+// r, or an empty string if there is no such token.
+func BearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, prefix) {
+		return ""
+	}
+	return value[len(prefix):]
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// BearerTokenVerifier returns a Verifier that accepts requests carrying
+// the specified bearer token.
+func BearerTokenVerifier(token string) Verifier {
+	return func(r *http.Request) bool {
+		return token != "" && secureCompare(BearerToken(r), token)
+	}
+}
+
+// CookieVerifier returns a Verifier that accepts requests carrying a
+// cookie with the specified name and value.
+func CookieVerifier(name, value string) Verifier {
+	return func(r *http.Request) bool {
+		cookie, err := r.Cookie(name)
+		return err == nil && value != "" && secureCompare(cookie.Value, value)
+	}
+}
@@ -0,0 +1,232 @@
+// Package server implements a minimal ndt7 server. It is meant to run
+// local tests of the client, not to replace the canonical implementation
+// available at https://github.com/m-lab/ndt-cloud.
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/nuvolari/internal/sockopt"
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+const defaultTimeout = 7 * time.Second
+
+func upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if r.Header.Get("Sec-WebSocket-Protocol") != spec.SecWebSocketProtocol {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, websocket.ErrBadHandshake
+	}
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	var upgrader websocket.Upgrader
+	return upgrader.Upgrade(w, r, headers)
+}
+
+func makeBulkMessage(size int) (*websocket.PreparedMessage, error) {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+}
+
+func closeNormally(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(defaultTimeout))
+}
+
+// awaitClose discards the incoming messages until the peer Close frame
+// arrives or the timeout expires, to complete the closing handshake.
+func awaitClose(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(defaultTimeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func connectionInfo(conn *websocket.Conn) *spec.ConnectionInfo {
+	ci := &spec.ConnectionInfo{
+		Client: conn.RemoteAddr().String(),
+		Server: conn.LocalAddr().String(),
+	}
+	if mss, err := sockopt.MSS(conn.UnderlyingConn()); err == nil {
+		ci.MSS = int64(mss)
+	}
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		ci.SetTLSInfo(tlsConn.ConnectionState())
+	}
+	return ci
+}
+
+// readCounterflow reads the measurements that the client may send during
+// the download until the connection is closed. Reading also allows us to
+// process the control messages sent by the client, including the Close
+// frame with which the client completes the closing handshake. We close
+// done when we stop reading.
+func readCounterflow(conn *websocket.Conn, done chan<- struct{}) {
+	defer close(done)
+	conn.SetReadLimit(spec.MinMaxMessageSize)
+	for {
+		mtype, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mtype != websocket.TextMessage {
+			continue
+		}
+		if _, err := spec.ParseMeasurement(data); err != nil {
+			log.Printf("download: invalid client measurement: %s", err.Error())
+			return
+		}
+	}
+}
+
+// HandleDownload handles a ndt7 download request.
+func HandleDownload(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		log.Printf("download: upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	pm, err := makeBulkMessage(spec.BulkMessageSize)
+	if err != nil {
+		log.Printf("download: cannot make message: %s", err.Error())
+		return
+	}
+	readDone := make(chan struct{})
+	go readCounterflow(conn, readDone)
+	duration := spec.ParseDuration(r.URL.Query().Get(spec.DurationParameter))
+	t0 := time.Now()
+	tLast := t0
+	var count int64
+	for {
+		select {
+		case <-readDone:
+			// The client closed the connection (e.g. because the speed
+			// has converged) and we have replied with our Close frame
+			return
+		default:
+		}
+		now := time.Now()
+		elapsed := now.Sub(t0)
+		if elapsed >= duration {
+			break
+		}
+		if now.Sub(tLast) >= spec.MinMeasurementInterval {
+			measurement := spec.Measurement{
+				Origin:   spec.OriginServer,
+				Test:     spec.TestDownload,
+				AppInfo:  spec.NewAppInfo(elapsed, count),
+				Elapsed:  elapsed.Seconds(),
+				NumBytes: count,
+			}
+			if tLast == t0 {
+				measurement.ConnectionInfo = connectionInfo(conn)
+			}
+			data, err := json.Marshal(measurement)
+			if err != nil {
+				log.Printf("download: cannot marshal measurement: %s", err.Error())
+				return
+			}
+			conn.SetWriteDeadline(now.Add(defaultTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("download: write failed: %s", err.Error())
+				return
+			}
+			count += int64(len(data))
+			tLast = now
+		}
+		conn.SetWriteDeadline(now.Add(defaultTimeout))
+		if err := conn.WritePreparedMessage(pm); err != nil {
+			log.Printf("download: write failed: %s", err.Error())
+			return
+		}
+		count += spec.BulkMessageSize
+	}
+	closeNormally(conn)
+	// Wait for the client Close frame before closing the connection
+	select {
+	case <-readDone:
+	case <-time.After(defaultTimeout):
+	}
+}
+
+// HandleUpload handles a ndt7 upload request. The client decides when the
+// upload is over, therefore we keep reading until the client closes the
+// connection, unless the client is running for too much time. Meanwhile,
+// we periodically send the client the measurements of what we received.
+func HandleUpload(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		log.Printf("upload: upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(spec.MinMaxMessageSize)
+	t0 := time.Now()
+	duration := spec.ParseDuration(r.URL.Query().Get(spec.DurationParameter))
+	maxDuration := duration * 3 / 2
+	tLast := t0
+	var count int64
+	for {
+		now := time.Now()
+		elapsed := now.Sub(t0)
+		if elapsed >= maxDuration {
+			break
+		}
+		if now.Sub(tLast) >= spec.MinMeasurementInterval {
+			measurement := spec.Measurement{
+				Origin:   spec.OriginServer,
+				Test:     spec.TestUpload,
+				AppInfo:  spec.NewAppInfo(elapsed, count),
+				Elapsed:  elapsed.Seconds(),
+				NumBytes: count,
+			}
+			if tLast == t0 {
+				measurement.ConnectionInfo = connectionInfo(conn)
+			}
+			data, err := json.Marshal(measurement)
+			if err != nil {
+				log.Printf("upload: cannot marshal measurement: %s", err.Error())
+				return
+			}
+			conn.SetWriteDeadline(now.Add(defaultTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("upload: write failed: %s", err.Error())
+				return
+			}
+			tLast = now
+		}
+		conn.SetReadDeadline(now.Add(defaultTimeout))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure,
+				websocket.CloseAbnormalClosure) {
+				log.Printf("upload: read failed: %s", err.Error())
+			}
+			return
+		}
+		count += int64(len(data))
+	}
+	closeNormally(conn)
+	awaitClose(conn)
+}
+
+// NewServeMux returns a http.ServeMux that routes ndt7 requests.
+func NewServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(spec.DownloadURLPath, HandleDownload)
+	mux.HandleFunc(spec.UploadURLPath, HandleUpload)
+	return mux
+}
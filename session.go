@@ -0,0 +1,30 @@
+package nuvolari
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// NewSessionID returns a new random (version 4) UUID identifying a session,
+// i.e. a set of related tests, such as a download and an upload, so that
+// the results can be correlated downstream.
+func NewSessionID() (string, error) {
+	return newUUID()
+}
+
+// NewTestID returns a new random (version 4) UUID identifying a test (see
+// Settings.TestID).
+func NewTestID() (string, error) {
+	return newUUID()
+}
+
+// newUUID returns a new random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
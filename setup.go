@@ -0,0 +1,122 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+// ConnectionSetup breaks down the time it took to establish a connection,
+// so that slow test starts can be diagnosed independently of the speed.
+// All the times are in milliseconds.
+type ConnectionSetup struct {
+	// DNSTime is the time to resolve the server hostname, or zero if we
+	// did not resolve it (e.g. it's an IP address or we use a proxy).
+	DNSTime float64 `json:"dns_time"`
+
+	// ConnectTime is the time to connect, including the proxy handshake,
+	// if any, after resolving the hostname.
+	ConnectTime float64 `json:"connect_time"`
+
+	// TLSTime is the duration of the TLS handshake, or zero for ws://.
+	TLSTime float64 `json:"tls_time"`
+
+	// UpgradeTime is the duration of the WebSocket upgrade.
+	UpgradeTime float64 `json:"upgrade_time"`
+
+	// TotalTime is the time to establish the connection.
+	TotalTime float64 `json:"total_time"`
+}
+
+// setupTrace records when each step of the connection setup happens. We
+// use it from a single goroutine, since the websocket Dialer and the net
+// package invoke the hooks we use from the goroutine dialing.
+type setupTrace struct {
+	start, dnsStart, dnsDone, connected, tlsStart, tlsDone time.Time
+	tlsInfo                                                *TLSInfo
+}
+
+func newSetupTrace() *setupTrace {
+	return &setupTrace{start: time.Now()}
+}
+
+// clientTrace returns the hooks recording the steps.
+func (st *setupTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			if st.dnsStart.IsZero() {
+				st.dnsStart = time.Now()
+			}
+		},
+		DNSDone:           func(httptrace.DNSDoneInfo) { st.dnsDone = time.Now() },
+		GotConn:           func(httptrace.GotConnInfo) { st.connected = time.Now() },
+		TLSHandshakeStart: func() { st.tlsStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			st.tlsDone = time.Now()
+			if err == nil {
+				st.tlsInfo = newTLSInfo(state, st.tlsDone.Sub(st.tlsStart))
+			}
+		},
+	}
+}
+
+// setup returns the ConnectionSetup of a connection established at end.
+func (st *setupTrace) setup(end time.Time) *ConnectionSetup {
+	cs := &ConnectionSetup{TotalTime: milliseconds(end.Sub(st.start))}
+	connectStart := st.start
+	if !st.dnsDone.IsZero() {
+		cs.DNSTime = milliseconds(st.dnsDone.Sub(st.dnsStart))
+		connectStart = st.dnsDone
+	}
+	cs.ConnectTime = milliseconds(st.connected.Sub(connectStart))
+	upgradeStart := st.connected
+	if !st.tlsDone.IsZero() {
+		cs.TLSTime = milliseconds(st.tlsDone.Sub(st.tlsStart))
+		upgradeStart = st.tlsDone
+	}
+	cs.UpgradeTime = milliseconds(end.Sub(upgradeStart))
+	return cs
+}
+
+// milliseconds converts d to milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// formatMilliseconds formats v, which is in milliseconds, for the params.
+func formatMilliseconds(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// logConnectionSetup emits LogConnectionSetup with the fields of cs.
+func (cl Client) logConnectionSetup(cs *ConnectionSetup) {
+	cl.logInfo(LogConnectionSetup, fmt.Sprintf(
+		"Connection setup: dns=%.1f ms connect=%.1f ms tls=%.1f ms upgrade=%.1f ms",
+		cs.DNSTime, cs.ConnectTime, cs.TLSTime, cs.UpgradeTime),
+		"dns_time", formatMilliseconds(cs.DNSTime),
+		"connect_time", formatMilliseconds(cs.ConnectTime),
+		"tls_time", formatMilliseconds(cs.TLSTime),
+		"upgrade_time", formatMilliseconds(cs.UpgradeTime),
+		"total_time", formatMilliseconds(cs.TotalTime))
+}
+
+// ConnectionSetupOf returns the ConnectionSetup carried by m, if m is a
+// LogConnectionSetup message, or nil otherwise.
+func ConnectionSetupOf(m LogMessage) *ConnectionSetup {
+	if m.Code != LogConnectionSetup {
+		return nil
+	}
+	parse := func(name string) float64 {
+		v, _ := strconv.ParseFloat(m.Params[name], 64)
+		return v
+	}
+	return &ConnectionSetup{
+		DNSTime:     parse("dns_time"),
+		ConnectTime: parse("connect_time"),
+		TLSTime:     parse("tls_time"),
+		UpgradeTime: parse("upgrade_time"),
+		TotalTime:   parse("total_time"),
+	}
+}
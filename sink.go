@@ -0,0 +1,259 @@
+package nuvolari
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SinkRecord is a line written by the Handler returned by HandlerFromWriter.
+// Type is one of "log", "measurement", "finding" and "progress", and the
+// field with the same name contains the event.
+type SinkRecord struct {
+	// Type is the type of the event.
+	Type string `json:"type"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// Log is the message of log events.
+	Log *LogMessage `json:"log,omitempty"`
+
+	// Measurement is the measurement of measurement events, whose Origin
+	// and Test fields tell which measurement it is.
+	Measurement *Measurement `json:"measurement,omitempty"`
+
+	// Finding is the finding of finding events.
+	Finding *Finding `json:"finding,omitempty"`
+
+	// Progress is the progress of progress events.
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// writerHandler is a Handler serializing the events as SinkRecords and
+// passing each line to emit.
+type writerHandler struct {
+	emit func(line []byte)
+}
+
+// HandlerFromWriter returns a Handler that serializes each event as a
+// SinkRecord on a line of w (i.e. NDJSON), as it happens, so that one can
+// pipe the raw events to a file or a socket. We write each line with a
+// single call, from the goroutine delivering the event, hence w must be
+// safe for concurrent use if it is shared. Unlike Client.Sink, a slow w
+// slows down the test. After the first error writing, we stop writing.
+func HandlerFromWriter(w io.Writer) Handler {
+	lw := &lockedWriter{w: w}
+	return &writerHandler{emit: lw.write}
+}
+
+func (wh *writerHandler) write(record SinkRecord) {
+	record.Time = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	wh.emit(append(data, '\n'))
+}
+
+// lockedWriter writes lines on w until the first error.
+type lockedWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (lw *lockedWriter) write(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.err == nil {
+		_, lw.err = lw.w.Write(line)
+	}
+}
+
+func (wh *writerHandler) OnLogInfo(m LogMessage) {
+	wh.write(SinkRecord{Type: "log", Log: &m})
+}
+
+func (wh *writerHandler) OnServerDownloadMeasurement(m Measurement) {
+	wh.write(SinkRecord{Type: "measurement", Measurement: &m})
+}
+
+func (wh *writerHandler) OnClientDownloadMeasurement(m Measurement) {
+	wh.write(SinkRecord{Type: "measurement", Measurement: &m})
+}
+
+func (wh *writerHandler) OnServerUploadMeasurement(m Measurement) {
+	wh.write(SinkRecord{Type: "measurement", Measurement: &m})
+}
+
+func (wh *writerHandler) OnClientUploadMeasurement(m Measurement) {
+	wh.write(SinkRecord{Type: "measurement", Measurement: &m})
+}
+
+func (wh *writerHandler) OnFinding(f Finding) {
+	wh.write(SinkRecord{Type: "finding", Finding: &f})
+}
+
+func (wh *writerHandler) OnProgress(p Progress) {
+	wh.write(SinkRecord{Type: "progress", Progress: &p})
+}
+
+// withSink returns a copy of cl whose Handler also writes the events on
+// cl.Sink, if any, and a function to call when the test is over, which
+// waits for the events to be written. We clear Sink in the copy, so that
+// the tests that call other tests do not write the events twice.
+func (cl Client) withSink() (Client, func()) {
+	if cl.Sink == nil {
+		return cl, func() {}
+	}
+	sw := acquireSinkWriter(cl.Sink)
+	cl.Handler = MultiHandler(cl.Handler, &writerHandler{emit: sw.push})
+	cl.Sink = nil
+	return cl, sw.release
+}
+
+// sinks contains the sinkWriter of each Sink in use, so that concurrent
+// tests sharing the same Sink share the same sinkWriter.
+var sinks = struct {
+	sync.Mutex
+	m map[io.Writer]*sinkWriter
+}{m: make(map[io.Writer]*sinkWriter)}
+
+// maxSinkLines is the maximum number of lines that a sinkWriter queues. When
+// the Sink is so slow that the queue is full, we drop the new lines rather
+// than using more and more memory.
+const maxSinkLines = 4096
+
+// sinkFlushTimeout is the maximum time for which a test waits for its lines
+// to be written, so that a stuck Sink does not prevent it from returning.
+const sinkFlushTimeout = 5 * time.Second
+
+// unkeyedSinkMu serializes the writes on the Sinks that cannot be keys of
+// sinks, since we cannot tell whether two of them are the same Sink.
+var unkeyedSinkMu sync.Mutex
+
+// sinkWriter writes the lines of the tests using the same Sink from a
+// background goroutine, so that a slow Sink does not stall the I/O of the
+// tests, and so that the Sink does not need to be safe for concurrent
+// use. After the first error writing, we stop writing.
+type sinkWriter struct {
+	w      io.Writer
+	shared bool // whether sinks contains the sinkWriter
+	refs   int  // guarded by sinks
+
+	mu              sync.Mutex
+	cond            *sync.Cond
+	lines           [][]byte
+	queued, written int
+	stopped         bool
+	err             error
+}
+
+// acquireSinkWriter returns the sinkWriter of w, starting it if needed.
+// We can only share the sinkWriter if w is comparable (e.g. a pointer),
+// otherwise each test writes on w using its own sinkWriter, and all the
+// sinkWriters of such Sinks serialize their writes using unkeyedSinkMu.
+func acquireSinkWriter(w io.Writer) *sinkWriter {
+	shared := reflect.TypeOf(w).Comparable()
+	sinks.Lock()
+	defer sinks.Unlock()
+	var sw *sinkWriter
+	if shared {
+		sw = sinks.m[w]
+	}
+	if sw == nil {
+		sw = &sinkWriter{w: w, shared: shared}
+		sw.cond = sync.NewCond(&sw.mu)
+		go sw.loop()
+		if shared {
+			sinks.m[w] = sw
+		}
+	}
+	sw.refs++
+	return sw
+}
+
+// release waits for the lines queued so far to be written and stops the
+// sinkWriter if no other test is using it.
+func (sw *sinkWriter) release() {
+	sw.flush()
+	sinks.Lock()
+	sw.refs--
+	last := sw.refs <= 0
+	if last && sw.shared {
+		delete(sinks.m, sw.w)
+	}
+	sinks.Unlock()
+	if last {
+		sw.mu.Lock()
+		sw.stopped = true
+		sw.cond.Broadcast()
+		sw.mu.Unlock()
+	}
+}
+
+// push queues line without blocking, or drops it if the queue is full.
+func (sw *sinkWriter) push(line []byte) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err == nil && len(sw.lines) < maxSinkLines {
+		sw.lines = append(sw.lines, line)
+		sw.queued++
+		sw.cond.Broadcast()
+	}
+}
+
+// flush waits until the lines queued so far have been written, or for
+// sinkFlushTimeout, whichever comes first.
+func (sw *sinkWriter) flush() {
+	expired := false
+	timer := time.AfterFunc(sinkFlushTimeout, func() {
+		sw.mu.Lock()
+		defer sw.mu.Unlock()
+		expired = true
+		sw.cond.Broadcast()
+	})
+	defer timer.Stop()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for target := sw.queued; sw.written < target && !expired; {
+		sw.cond.Wait()
+	}
+}
+
+// loop writes the queued lines until the sinkWriter is stopped.
+func (sw *sinkWriter) loop() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for {
+		for len(sw.lines) <= 0 && !sw.stopped {
+			sw.cond.Wait()
+		}
+		if len(sw.lines) <= 0 {
+			return
+		}
+		lines, err := sw.lines, sw.err
+		sw.lines = nil
+		sw.mu.Unlock()
+		if !sw.shared {
+			unkeyedSinkMu.Lock()
+		}
+		for _, line := range lines {
+			if err == nil {
+				_, err = sw.w.Write(line)
+			}
+		}
+		if !sw.shared {
+			unkeyedSinkMu.Unlock()
+		}
+		sw.mu.Lock()
+		if sw.err == nil {
+			sw.err = err
+		}
+		sw.written += len(lines)
+		sw.cond.Broadcast()
+	}
+}
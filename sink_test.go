@@ -0,0 +1,138 @@
+package nuvolari
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentTestsShareSink(t *testing.T) {
+	cl := newTestClient(t)
+	var buf bytes.Buffer
+	cl.Sink = &buf
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- cl.RunDownload(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- cl.RunUpload(context.Background())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := make(map[string]bool)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record SinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("cannot parse %q: %s", scanner.Text(), err)
+		}
+		if m := record.Measurement; m != nil && m.Origin == OriginClient {
+			tests[m.TestID] = true
+		}
+	}
+	if len(tests) != 6 {
+		t.Fatalf("expected client measurements of 6 tests, got %d", len(tests))
+	}
+}
+
+// nonComparableWriter is an io.Writer that cannot be a map key.
+type nonComparableWriter struct {
+	write func([]byte) (int, error)
+}
+
+func (w nonComparableWriter) Write(data []byte) (int, error) {
+	return w.write(data)
+}
+
+func TestSinkWithNonComparableWriter(t *testing.T) {
+	cl := newTestClient(t)
+	var lines int
+	cl.Sink = nonComparableWriter{write: func(data []byte) (int, error) {
+		lines++
+		return len(data), nil
+	}}
+	if err := cl.RunDownload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines <= 0 {
+		t.Fatal("expected the Sink to receive the events")
+	}
+}
+
+func TestConcurrentTestsSerializeNonComparableSink(t *testing.T) {
+	cl := newTestClient(t)
+	var active, overlaps int32
+	cl.Sink = nonComparableWriter{write: func(data []byte) (int, error) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return len(data), nil
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cl.RunDownload(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps > 0 {
+		t.Fatalf("the Sink received %d concurrent writes", overlaps)
+	}
+}
+
+// stuckWriter is an io.Writer whose Write blocks until unblock is closed.
+type stuckWriter struct {
+	unblock chan struct{}
+}
+
+func (w *stuckWriter) Write(data []byte) (int, error) {
+	<-w.unblock
+	return len(data), nil
+}
+
+func TestStuckSinkIsBounded(t *testing.T) {
+	w := &stuckWriter{unblock: make(chan struct{})}
+	defer close(w.unblock)
+	sw := acquireSinkWriter(w)
+	for i := 0; i < 2*maxSinkLines; i++ {
+		sw.push([]byte("{}\n"))
+	}
+	sw.mu.Lock()
+	queued := len(sw.lines)
+	sw.mu.Unlock()
+	if queued > maxSinkLines {
+		t.Fatalf("expected at most %d queued lines, got %d", maxSinkLines, queued)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sw.release()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * sinkFlushTimeout):
+		t.Fatal("release is waiting for the stuck Sink")
+	}
+}
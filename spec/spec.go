@@ -0,0 +1,496 @@
+// Package spec contains the constants and the types defined by the ndt7
+// specification, which is available at
+// https://github.com/m-lab/ndt-cloud/blob/master/spec/ndt7.md. Both the
+// client and the server use this package as their single source of truth.
+package spec
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// DownloadURLPath is the URL path of the download test.
+const DownloadURLPath = "/ndt/v7/download"
+
+// UploadURLPath is the URL path of the upload test.
+const UploadURLPath = "/ndt/v7/upload"
+
+// SecWebSocketProtocol is the WebSocket subprotocol used by ndt7.
+const SecWebSocketProtocol = "net.measurementlab.ndt.v7"
+
+// DefaultDuration is the expected duration of a test.
+const DefaultDuration = 10 * time.Second
+
+// MaxDuration is the maximum duration of a test a client may ask for.
+const MaxDuration = 60 * time.Second
+
+// DurationParameter is the optional query string parameter with which a
+// client asks for a test duration other than DefaultDuration, expressed
+// in milliseconds (e.g. "2500").
+const DurationParameter = "duration"
+
+// TestIDParameter is the optional query string parameter with which a
+// client sends the identifier it assigned to the test, as metadata that
+// the server may archive along with its measurements.
+const TestIDParameter = "client_test_id"
+
+// AccessTokenParameter is the query string parameter with which a client
+// sends the access token that servers may require. The URLs returned by
+// the M-Lab Locate API already include it.
+const AccessTokenParameter = "access_token"
+
+// Query string parameters with which clients describe themselves, so that
+// the server archives can attribute the measurements to the client.
+const (
+	ClientNameParameter           = "client_name"
+	ClientVersionParameter        = "client_version"
+	ClientLibraryNameParameter    = "client_library_name"
+	ClientLibraryVersionParameter = "client_library_version"
+	ClientOSParameter             = "client_os"
+	ClientArchParameter           = "client_arch"
+)
+
+// ParseDuration parses the value of DurationParameter. It returns the
+// DefaultDuration if value is empty or invalid, and it never returns a
+// duration longer than MaxDuration.
+func ParseDuration(value string) time.Duration {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return DefaultDuration
+	}
+	if ms > int64(MaxDuration/time.Millisecond) {
+		return MaxDuration
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// MinMeasurementInterval is the minimum interval between measurements.
+const MinMeasurementInterval = 250 * time.Millisecond
+
+// MinMaxMessageSize is the minimum value of the maximum message size that
+// an implementation should be prepared to receive.
+const MinMaxMessageSize = 1 << 17
+
+// MaxMessageSize is the maximum size of the messages, which servers that
+// scale the size of the messages to the speed of the path may send.
+const MaxMessageSize = 1 << 24
+
+// BulkMessageSize is the size of the binary messages used to fill the pipe.
+const BulkMessageSize = 1 << 13
+
+// Values of the Origin field of measurements.
+const (
+	OriginClient = "client"
+	OriginServer = "server"
+)
+
+// Values of the Test field of measurements.
+const (
+	TestDownload = "download"
+	TestUpload   = "upload"
+)
+
+// AppInfo contains application-level information.
+type AppInfo struct {
+	// ElapsedTime is the number of microseconds elapsed since the beginning.
+	ElapsedTime int64 `json:"ElapsedTime"`
+
+	// NumBytes is the number of bytes transferred since the beginning at
+	// the application level.
+	NumBytes int64 `json:"NumBytes"`
+}
+
+// NewAppInfo returns the AppInfo of transferring numBytes in elapsed time.
+func NewAppInfo(elapsed time.Duration, numBytes int64) *AppInfo {
+	return &AppInfo{
+		ElapsedTime: int64(elapsed / time.Microsecond),
+		NumBytes:    numBytes,
+	}
+}
+
+// BBRInfo contains BBR information.
+type BBRInfo struct {
+	// MaxBandwidth is the bandwidth measured in bits per second.
+	MaxBandwidth float64 `json:"max_bandwidth"`
+
+	// MinRTT is the round-trip time measured in milliseconds.
+	MinRTT float64 `json:"min_rtt"`
+}
+
+// ConnectionInfo contains information about the connection.
+type ConnectionInfo struct {
+	// Client is the client endpoint (e.g. "192.168.1.1:54321").
+	Client string `json:"client"`
+
+	// Server is the server endpoint (e.g. "1.2.3.4:443").
+	Server string `json:"server"`
+
+	// UUID is the identifier that the server assigned to the connection,
+	// if any, which allows to find the test in the server archives.
+	UUID string `json:"uuid,omitempty"`
+
+	// MSS is the TCP maximum segment size, in bytes, of the socket of the
+	// sender of the measurement, if available.
+	MSS int64 `json:"mss,omitempty"`
+
+	// SendBufferSize is the effective SO_SNDBUF, in bytes, of the socket
+	// of the sender of the measurement, if available.
+	SendBufferSize int64 `json:"sndbuf,omitempty"`
+
+	// ReceiveBufferSize is the effective SO_RCVBUF, in bytes, of the socket
+	// of the sender of the measurement, if available.
+	ReceiveBufferSize int64 `json:"rcvbuf,omitempty"`
+
+	// CongestionControl is the TCP congestion control algorithm (e.g.
+	// "cubic" or "bbr") of the socket of the sender of the measurement,
+	// if available.
+	CongestionControl string `json:"congestion_control,omitempty"`
+
+	// TLSVersion is the negotiated TLS version (e.g. "TLS 1.3").
+	TLSVersion string `json:"tls_version,omitempty"`
+
+	// CipherSuite is the negotiated TLS cipher suite.
+	CipherSuite string `json:"cipher_suite,omitempty"`
+
+	// ALPN is the protocol negotiated using ALPN, if any.
+	ALPN string `json:"alpn,omitempty"`
+
+	// TLSResumed tells whether the TLS session was resumed.
+	TLSResumed bool `json:"tls_resumed,omitempty"`
+}
+
+// SetTLSInfo sets the TLS fields of ci from the state of a TLS connection.
+func (ci *ConnectionInfo) SetTLSInfo(state tls.ConnectionState) {
+	ci.TLSVersion = tls.VersionName(state.Version)
+	ci.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	ci.ALPN = state.NegotiatedProtocol
+	ci.TLSResumed = state.DidResume
+}
+
+// ECNInfo contains information about Explicit Congestion Notification.
+type ECNInfo struct {
+	// Negotiated tells whether ECN was negotiated during the TCP handshake.
+	Negotiated bool `json:"negotiated"`
+
+	// ECTSeen tells whether we received ECN-capable segments.
+	ECTSeen bool `json:"ect_seen"`
+
+	// DeliveredCE is the number of segments delivered with the Congestion
+	// Experienced mark, meaning that a router signalled congestion.
+	DeliveredCE int64 `json:"delivered_ce"`
+}
+
+// TCPInfo contains information from the TCP_INFO of the socket of the
+// sender of the measurement. The field names follow struct tcp_info.
+type TCPInfo struct {
+	// NotsentBytes is the number of bytes in the send queue that have
+	// not been sent yet.
+	NotsentBytes int64 `json:"notsent_bytes"`
+
+	// BytesAcked is the number of bytes acknowledged by the peer, i.e. the
+	// bytes actually delivered, including TLS and WebSocket overhead.
+	BytesAcked int64 `json:"bytes_acked"`
+
+	// RTT is the smoothed round-trip time in microseconds.
+	RTT int64 `json:"rtt"`
+
+	// RTTVar is the variance of RTT in microseconds.
+	RTTVar int64 `json:"rtt_var"`
+
+	// TotalRetrans is the number of retransmitted segments.
+	TotalRetrans int64 `json:"total_retrans"`
+
+	// DeliveryRate is the most recent delivery rate estimate in bytes
+	// per second, which mostly matters for the sender.
+	DeliveryRate int64 `json:"delivery_rate"`
+
+	// RcvRTT is the round-trip time estimated by the receiver of data, in
+	// microseconds, which is useful when we are mostly receiving.
+	RcvRTT int64 `json:"rcv_rtt"`
+
+	// RcvWnd is the receive window we are advertising, in bytes. It is
+	// only available with recent kernels.
+	RcvWnd int64 `json:"rcv_wnd"`
+
+	// MinRTT is the minimum round-trip time in microseconds.
+	MinRTT int64 `json:"min_rtt,omitempty"`
+
+	// BytesSent is the number of bytes sent, including retransmissions.
+	BytesSent int64 `json:"bytes_sent,omitempty"`
+
+	// BytesReceived is the number of bytes received.
+	BytesReceived int64 `json:"bytes_received,omitempty"`
+
+	// BytesRetrans is the number of bytes retransmitted.
+	BytesRetrans int64 `json:"bytes_retrans,omitempty"`
+
+	// DataSegsOut is the number of segments carrying data we sent,
+	// including retransmissions.
+	DataSegsOut int64 `json:"data_segs_out,omitempty"`
+
+	// BusyTime is the number of microseconds spent sending data.
+	BusyTime int64 `json:"busy_time,omitempty"`
+
+	// RWndLimited is the number of microseconds during which sending was
+	// limited by the receive window of the peer.
+	RWndLimited int64 `json:"rwnd_limited,omitempty"`
+
+	// SndBufLimited is the number of microseconds during which sending
+	// was limited by the send buffer.
+	SndBufLimited int64 `json:"sndbuf_limited,omitempty"`
+}
+
+// Measurement is a performance measurement. The current version of the
+// specification uses the AppInfo, ConnectionInfo, TCPInfo and BBRInfo
+// objects, with different names and units; when parsing measurements,
+// we convert them into the fields below, so that either format works.
+type Measurement struct {
+	// Origin is either OriginClient or OriginServer, if set.
+	Origin string `json:"Origin,omitempty"`
+
+	// Test is either TestDownload or TestUpload, if set.
+	Test string `json:"Test,omitempty"`
+
+	// TestID is the identifier that the client assigned to the test. The
+	// client sets it in the measurements it emits, including those of
+	// the server, if it has one.
+	TestID string `json:"test_id,omitempty"`
+
+	// AppInfo is the application-level information in the format of the
+	// current specification, if set. Elapsed and NumBytes are the same
+	// information in the original format.
+	AppInfo *AppInfo `json:"AppInfo,omitempty"`
+
+	// Elapsed is the number of seconds elapsed since the beginning.
+	Elapsed float64 `json:"elapsed"`
+
+	// NumBytes is the number of bytes transferred since the beginning at
+	// the application level, i.e. the size of the messages. Clients always
+	// set this field; servers may set it to the bytes sent so far.
+	NumBytes int64 `json:"num_bytes,omitempty"`
+
+	// BBRInfo is optional BBR information included when possible.
+	BBRInfo *BBRInfo `json:"bbr_info,omitempty"`
+
+	// ConnectionInfo is optional information about the connection, which
+	// is typically only included in the first measurement.
+	ConnectionInfo *ConnectionInfo `json:"connection_info,omitempty"`
+
+	// ECNInfo is optional ECN information included when possible.
+	ECNInfo *ECNInfo `json:"ecn_info,omitempty"`
+
+	// TCPInfo is optional TCP_INFO information included when possible.
+	TCPInfo *TCPInfo `json:"tcp_info,omitempty"`
+
+	// RwndLimited tells whether, in the interval ending with this
+	// measurement, the throughput was limited by the receive window of
+	// the receiver. Clients set this field during the download.
+	RwndLimited bool `json:"rwnd_limited,omitempty"`
+
+	// Throughput is the mean application-level throughput since the
+	// beginning, in bits per second, i.e. NumBytes*8/Elapsed. Clients
+	// set this field; servers may also set it.
+	Throughput float64 `json:"throughput,omitempty"`
+
+	// InstantThroughput is the application-level throughput, in bits per
+	// second, in the interval since the previous measurement. Clients set
+	// this field, such that consumers do not need to compute it.
+	InstantThroughput float64 `json:"instant_throughput,omitempty"`
+
+	// IntervalBytes is the number of bytes transferred at the application
+	// level since the previous measurement. Clients set this field when
+	// configured to report deltas.
+	IntervalBytes int64 `json:"interval_bytes,omitempty"`
+
+	// IntervalElapsed is the number of seconds elapsed since the previous
+	// measurement. Clients set it along with IntervalBytes.
+	IntervalElapsed float64 `json:"interval_elapsed,omitempty"`
+
+	// Stream is the 1-based number of the connection of a multi-stream
+	// test to which the measurement refers. It is zero in single-stream
+	// tests and in the client measurements that aggregate all streams.
+	Stream int `json:"stream,omitempty"`
+
+	// Gap is the number of seconds that the client spent reconnecting,
+	// after a transient failure, before the connection to which this
+	// measurement refers. It is only set in the first client measurement
+	// of the new connection.
+	Gap float64 `json:"gap,omitempty"`
+
+	// AppRTT contains the application-level RTT samples, in milliseconds,
+	// collected since the previous measurement using WebSocket pings. This
+	// is useful where TCPInfo and BBRInfo are not available.
+	AppRTT []float64 `json:"app_rtt,omitempty"`
+
+	// LoadedRTT is the RTT, in milliseconds, measured in the interval
+	// ending with this measurement, while the test loads the link. Clients
+	// set this field when they have RTT samples.
+	LoadedRTT float64 `json:"loaded_rtt,omitempty"`
+
+	// RTTInflation is LoadedRTT divided by the minimum RTT observed so
+	// far, which approximates the RTT of the idle link. High values mean
+	// that the test fills large buffers (i.e. bufferbloat).
+	RTTInflation float64 `json:"rtt_inflation,omitempty"`
+
+	// Jitter is the variability of the RTT, in milliseconds, in the
+	// interval ending with this measurement. Clients set this field when
+	// they have RTT samples.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// ArrivalJitter is the standard deviation, in milliseconds, of the
+	// time between the arrival of consecutive messages in the interval
+	// ending with this measurement. Clients set this field during the
+	// download.
+	ArrivalJitter float64 `json:"arrival_jitter,omitempty"`
+
+	// Retransmissions is the number of segments that the sender of the
+	// data, i.e. the server during the download and the client during
+	// the upload, retransmitted since the beginning, according to its
+	// TCP_INFO. Clients set this field when TCP_INFO is available.
+	Retransmissions int64 `json:"retransmissions,omitempty"`
+
+	// LossRate estimates the fraction of the segments lost since the
+	// beginning, as the fraction of the data segments that the sender
+	// retransmitted. Clients set it along with Retransmissions.
+	LossRate float64 `json:"loss_rate,omitempty"`
+}
+
+// specConnectionInfo is ConnectionInfo in the current specification.
+type specConnectionInfo struct {
+	Client string
+	Server string
+	UUID   string
+}
+
+// specBBRInfo is BBRInfo in the current specification, where BW is in
+// bytes per second and times are in microseconds.
+type specBBRInfo struct {
+	BW          int64
+	MinRTT      int64
+	ElapsedTime int64
+}
+
+// specTCPInfo contains the fields of TCPInfo in the current specification
+// that we use. It is struct tcp_info, where times are in microseconds.
+type specTCPInfo struct {
+	NotsentBytes  int64
+	BytesAcked    int64
+	BytesReceived int64
+	BytesSent     int64
+	BytesRetrans  int64
+	DataSegsOut   int64
+	RTT           int64
+	RTTVar        int64
+	MinRTT        int64
+	RcvRTT        int64
+	TotalRetrans  int64
+	DeliveryRate  int64
+	BusyTime      int64
+	RWndLimited   int64
+	SndBufLimited int64
+	ElapsedTime   int64
+}
+
+// UnmarshalJSON parses a measurement in either format.
+func (m *Measurement) UnmarshalJSON(data []byte) error {
+	type measurement Measurement // Avoids calling UnmarshalJSON recursively
+	aux := struct {
+		*measurement
+		SpecConnectionInfo *specConnectionInfo `json:"ConnectionInfo"`
+		SpecBBRInfo        *specBBRInfo        `json:"BBRInfo"`
+		SpecTCPInfo        *specTCPInfo        `json:"TCPInfo"`
+	}{measurement: (*measurement)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var elapsedTime int64
+	if ci := aux.SpecConnectionInfo; ci != nil && m.ConnectionInfo == nil {
+		m.ConnectionInfo = &ConnectionInfo{Client: ci.Client, Server: ci.Server, UUID: ci.UUID}
+	}
+	if bi := aux.SpecBBRInfo; bi != nil && m.BBRInfo == nil {
+		m.BBRInfo = &BBRInfo{
+			MaxBandwidth: float64(bi.BW) * 8,
+			MinRTT:       float64(bi.MinRTT) / 1000,
+		}
+		elapsedTime = bi.ElapsedTime
+	}
+	if ti := aux.SpecTCPInfo; ti != nil && m.TCPInfo == nil {
+		m.TCPInfo = &TCPInfo{
+			NotsentBytes:  ti.NotsentBytes,
+			BytesAcked:    ti.BytesAcked,
+			RTT:           ti.RTT,
+			RTTVar:        ti.RTTVar,
+			TotalRetrans:  ti.TotalRetrans,
+			DeliveryRate:  ti.DeliveryRate,
+			RcvRTT:        ti.RcvRTT,
+			MinRTT:        ti.MinRTT,
+			BytesSent:     ti.BytesSent,
+			BytesReceived: ti.BytesReceived,
+			BytesRetrans:  ti.BytesRetrans,
+			DataSegsOut:   ti.DataSegsOut,
+			BusyTime:      ti.BusyTime,
+			RWndLimited:   ti.RWndLimited,
+			SndBufLimited: ti.SndBufLimited,
+		}
+		elapsedTime = ti.ElapsedTime
+	}
+	if ai := m.AppInfo; ai != nil {
+		elapsedTime = ai.ElapsedTime
+		if m.NumBytes == 0 {
+			m.NumBytes = ai.NumBytes
+		}
+	}
+	if m.Elapsed == 0 {
+		m.Elapsed = float64(elapsedTime) / 1e06
+	}
+	return nil
+}
+
+// ErrInvalidMeasurement is returned when a measurement is not valid.
+var ErrInvalidMeasurement = errors.New("Measurement is invalid")
+
+// ParseMeasurement parses a measurement received from the network. Since
+// data is untrusted, besides parsing we also check whether the values are
+// within their valid ranges, returning ErrInvalidMeasurement if not.
+func ParseMeasurement(data []byte) (Measurement, error) {
+	var m Measurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Measurement{}, err
+	}
+	if m.Elapsed < 0 || m.NumBytes < 0 || m.Throughput < 0 || m.InstantThroughput < 0 ||
+		m.IntervalBytes < 0 || m.IntervalElapsed < 0 || m.Stream < 0 ||
+		m.LoadedRTT < 0 || m.RTTInflation < 0 || m.Jitter < 0 || m.ArrivalJitter < 0 ||
+		m.Retransmissions < 0 || m.LossRate < 0 {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	if m.BBRInfo != nil && (m.BBRInfo.MaxBandwidth < 0 || m.BBRInfo.MinRTT < 0) {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	if m.TCPInfo != nil && (m.TCPInfo.NotsentBytes < 0 || m.TCPInfo.BytesAcked < 0 ||
+		m.TCPInfo.RTT < 0 || m.TCPInfo.RTTVar < 0 || m.TCPInfo.TotalRetrans < 0 ||
+		m.TCPInfo.DeliveryRate < 0 || m.TCPInfo.RcvRTT < 0 || m.TCPInfo.RcvWnd < 0 ||
+		m.TCPInfo.MinRTT < 0 || m.TCPInfo.BytesSent < 0 || m.TCPInfo.BytesReceived < 0 ||
+		m.TCPInfo.BytesRetrans < 0 || m.TCPInfo.BusyTime < 0 || m.TCPInfo.RWndLimited < 0 ||
+		m.TCPInfo.SndBufLimited < 0 || m.TCPInfo.DataSegsOut < 0) {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	if m.AppInfo != nil && (m.AppInfo.ElapsedTime < 0 || m.AppInfo.NumBytes < 0) {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	if (m.Origin != "" && m.Origin != OriginClient && m.Origin != OriginServer) ||
+		(m.Test != "" && m.Test != TestDownload && m.Test != TestUpload) {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	if m.ECNInfo != nil && m.ECNInfo.DeliveredCE < 0 {
+		return Measurement{}, ErrInvalidMeasurement
+	}
+	for _, rtt := range m.AppRTT {
+		if rtt < 0 {
+			return Measurement{}, ErrInvalidMeasurement
+		}
+	}
+	return m, nil
+}
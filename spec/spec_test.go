@@ -0,0 +1,45 @@
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func FuzzParseMeasurement(f *testing.F) {
+	// Measurement in the format of the original ndt7 draft
+	f.Add([]byte(`{"elapsed":1.25,"num_bytes":1048576,"tcp_info":{"rtt_var":1000,` +
+		`"rtt":10000,"rcv_rtt":9000,"min_rtt":8000},` +
+		`"bbr_info":{"max_bandwidth":1e+07,"min_rtt":8}}`))
+	// Measurement in the format of the current specification
+	f.Add([]byte(`{"AppInfo":{"ElapsedTime":1250000,"NumBytes":1048576},` +
+		`"ConnectionInfo":{"Client":"127.0.0.1:1234","Server":"127.0.0.1:443",` +
+		`"UUID":"abc"},"BBRInfo":{"BW":1250000,"MinRTT":8000,"ElapsedTime":1250000},` +
+		`"TCPInfo":{"RTT":10000,"RTTVar":1000,"MinRTT":8000,"BytesAcked":1048576,` +
+		`"ElapsedTime":1250000},"Origin":"server","Test":"download"}`))
+	f.Add([]byte(`{"elapsed":0.5,"app_rtt":[10.5,11],"stream":1}`))
+	f.Add([]byte(`{"elapsed":-1}`))
+	f.Add([]byte(`{"Origin":"elsewhere"}`))
+	f.Add([]byte(`[]`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMeasurement(data)
+		if err != nil {
+			return
+		}
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ParseMeasurement(encoded)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %s", encoded, err)
+		}
+		reencoded, err := json.Marshal(again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("round trip changed %s into %s", encoded, reencoded)
+		}
+	})
+}
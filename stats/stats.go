@@ -0,0 +1,128 @@
+// Package stats contains the statistics used to summarize measurements,
+// such as throughput and RTT samples, so that all the consumers compute
+// them in the same way.
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+// Mean returns the arithmetic mean of v, or zero if v is empty.
+func Mean(v []float64) float64 {
+	if len(v) <= 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
+
+// StdDev returns the population standard deviation of v, or zero if v
+// is empty.
+func StdDev(v []float64) float64 {
+	if len(v) <= 0 {
+		return 0
+	}
+	mean := Mean(v)
+	var sum float64
+	for _, x := range v {
+		sum += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(sum / float64(len(v)))
+}
+
+// Min returns the minimum of v, or zero if v is empty.
+func Min(v []float64) float64 {
+	if len(v) <= 0 {
+		return 0
+	}
+	min := v[0]
+	for _, x := range v[1:] {
+		min = math.Min(min, x)
+	}
+	return min
+}
+
+// Max returns the maximum of v, or zero if v is empty.
+func Max(v []float64) float64 {
+	if len(v) <= 0 {
+		return 0
+	}
+	max := v[0]
+	for _, x := range v[1:] {
+		max = math.Max(max, x)
+	}
+	return max
+}
+
+// Percentile returns the p-th percentile of v, with p between 0 and 100,
+// interpolating linearly between the closest ranks. It returns zero if v
+// is empty. It does not modify v, which does not need to be sorted.
+func Percentile(v []float64, p float64) float64 {
+	if len(v) <= 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), v...)
+	sort.Float64s(sorted)
+	p = math.Max(0, math.Min(100, p))
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// Median returns the median of v, or zero if v is empty.
+func Median(v []float64) float64 {
+	return Percentile(v, 50)
+}
+
+// EWMA is an exponentially weighted moving average. The zero value is
+// not usable; construct using NewEWMA.
+type EWMA struct {
+	alpha       float64
+	value       float64
+	initialized bool
+}
+
+// NewEWMA returns a new EWMA where alpha, between 0 and 1, is the weight
+// of each new sample. The first sample initializes the average.
+func NewEWMA(alpha float64) *EWMA {
+	return &EWMA{alpha: alpha}
+}
+
+// Add adds a sample to the average.
+func (e *EWMA) Add(x float64) {
+	if !e.initialized {
+		e.value, e.initialized = x, true
+		return
+	}
+	e.value = e.alpha*x + (1-e.alpha)*e.value
+}
+
+// Value returns the current value of the average.
+func (e *EWMA) Value() float64 {
+	return e.value
+}
+
+// Converged tells whether the last window samples of v are all within
+// tolerance, relative to their mean, of their mean. For example, with a
+// tolerance of 0.05 all the samples must be within 5% of the mean.
+func Converged(v []float64, window int, tolerance float64) bool {
+	if window <= 0 || len(v) < window {
+		return false
+	}
+	last := v[len(v)-window:]
+	mean := Mean(last)
+	if mean == 0 {
+		return false
+	}
+	for _, x := range last {
+		if math.Abs(x-mean)/math.Abs(mean) > tolerance {
+			return false
+		}
+	}
+	return true
+}
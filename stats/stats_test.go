@@ -0,0 +1,144 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+// approx tells whether a and b are equal, except for rounding errors.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-09
+}
+
+func TestPercentile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    []float64
+		p    float64
+		want float64
+	}{
+		{"empty", nil, 50, 0},
+		{"single element", []float64{7}, 95, 7},
+		{"minimum", []float64{3, 1, 2}, 0, 1},
+		{"maximum", []float64{3, 1, 2}, 100, 3},
+		{"exact rank", []float64{4, 1, 3, 2, 5}, 25, 2},
+		{"interpolation", []float64{10, 20}, 25, 12.5},
+		{"even length", []float64{4, 1, 3, 2}, 50, 2.5},
+		{"p below range", []float64{1, 2}, -10, 1},
+		{"p above range", []float64{1, 2}, 200, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Percentile(tc.v, tc.p); !approx(got, tc.want) {
+				t.Fatalf("Percentile(%v, %v) = %v, want %v", tc.v, tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPercentileDoesNotModifyInput(t *testing.T) {
+	v := []float64{3, 1, 2}
+	Percentile(v, 50)
+	if v[0] != 3 || v[1] != 1 || v[2] != 2 {
+		t.Fatalf("Percentile modified its input: %v", v)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single element", []float64{42}, 42},
+		{"odd length", []float64{5, 1, 3}, 3},
+		{"even length", []float64{8, 2, 6, 4}, 5},
+		{"duplicates", []float64{1, 1, 1, 9}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Median(tc.v); !approx(got, tc.want) {
+				t.Fatalf("Median(%v) = %v, want %v", tc.v, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStdDev(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single element", []float64{3}, 0},
+		{"constant", []float64{2, 2, 2, 2}, 0},
+		{"even length", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 2},
+		{"odd length", []float64{1, 2, 3}, math.Sqrt(2.0 / 3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := StdDev(tc.v); !approx(got, tc.want) {
+				t.Fatalf("StdDev(%v) = %v, want %v", tc.v, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMeanMinMax(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		v              []float64
+		mean, min, max float64
+	}{
+		{"empty", nil, 0, 0, 0},
+		{"single element", []float64{-1}, -1, -1, -1},
+		{"even length", []float64{4, -2, 8, 2}, 3, -2, 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Mean(tc.v); !approx(got, tc.mean) {
+				t.Fatalf("Mean(%v) = %v, want %v", tc.v, got, tc.mean)
+			}
+			if got := Min(tc.v); got != tc.min {
+				t.Fatalf("Min(%v) = %v, want %v", tc.v, got, tc.min)
+			}
+			if got := Max(tc.v); got != tc.max {
+				t.Fatalf("Max(%v) = %v, want %v", tc.v, got, tc.max)
+			}
+		})
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	e := NewEWMA(0.5)
+	e.Add(10)
+	if e.Value() != 10 {
+		t.Fatalf("the first sample should initialize the average, got %v", e.Value())
+	}
+	e.Add(20)
+	if e.Value() != 15 {
+		t.Fatalf("expected 15, got %v", e.Value())
+	}
+}
+
+func TestConverged(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		v         []float64
+		window    int
+		tolerance float64
+		want      bool
+	}{
+		{"empty", nil, 3, 0.05, false},
+		{"too short", []float64{10, 10}, 3, 0.05, false},
+		{"zero window", []float64{10}, 0, 0.05, false},
+		{"converged", []float64{1, 100, 101, 99}, 3, 0.05, true},
+		{"not converged", []float64{100, 101, 120}, 3, 0.05, false},
+		{"zero mean", []float64{0, 0, 0}, 3, 0.05, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Converged(tc.v, tc.window, tc.tolerance); got != tc.want {
+				t.Fatalf("Converged(%v, %d, %v) = %v, want %v",
+					tc.v, tc.window, tc.tolerance, got, tc.want)
+			}
+		})
+	}
+}
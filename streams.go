@@ -0,0 +1,215 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+// maxStreams is the maximum value of Settings.Streams.
+const maxStreams = 16
+
+// ErrInvalidStreams is returned when Settings.Streams is out of range.
+var ErrInvalidStreams = errors.New("Number of streams is invalid")
+
+// streamEvent is an event of a stream of a multi-stream test.
+type streamEvent struct {
+	// stream is the 1-based number of the stream.
+	stream int
+
+	// client is the client measurement, if this is one.
+	client *Measurement
+
+	// deliver delivers the event using the Client running the test.
+	deliver func(Client)
+}
+
+// streamHandler is the Handler of a stream of a multi-stream test. It
+// posts the events to the goroutine running the test, which aggregates
+// them and delivers them to the Handler of the Client, so that also in
+// this case the Handler does not need to be safe for concurrent use.
+type streamHandler struct {
+	stream int
+	events chan<- streamEvent
+	done   <-chan struct{}
+}
+
+func (sh streamHandler) post(ev streamEvent) {
+	ev.stream = sh.stream
+	select {
+	case sh.events <- ev:
+	case <-sh.done:
+	}
+}
+
+func (sh streamHandler) OnLogInfo(m LogMessage) {
+	if m.Code == LogInterrupted {
+		return // The goroutine running the test logs this once
+	}
+	params := map[string]string{"stream": strconv.Itoa(sh.stream)}
+	for key, value := range m.Params {
+		params[key] = value
+	}
+	m.Params = params
+	sh.post(streamEvent{deliver: func(cl Client) {
+		if cl.wants(EventLog) {
+			cl.Handler.OnLogInfo(m)
+		}
+	}})
+}
+
+func (sh streamHandler) OnServerDownloadMeasurement(m Measurement) {
+	m.Stream = sh.stream
+	sh.post(streamEvent{deliver: func(cl Client) { cl.serverDownloadMeasurement(m) }})
+}
+
+func (sh streamHandler) OnClientDownloadMeasurement(m Measurement) {
+	m.Stream = sh.stream
+	sh.post(streamEvent{client: &m, deliver: func(cl Client) { cl.clientDownloadMeasurement(m) }})
+}
+
+func (sh streamHandler) OnServerUploadMeasurement(m Measurement) {
+	m.Stream = sh.stream
+	sh.post(streamEvent{deliver: func(cl Client) { cl.serverUploadMeasurement(m) }})
+}
+
+func (sh streamHandler) OnClientUploadMeasurement(m Measurement) {
+	m.Stream = sh.stream
+	sh.post(streamEvent{client: &m, deliver: func(cl Client) { cl.clientUploadMeasurement(m) }})
+}
+
+func (sh streamHandler) OnFinding(f Finding) {
+	sh.post(streamEvent{deliver: func(cl Client) { cl.finding(f) }})
+}
+
+// OnProgress ignores the progress of the stream, since the goroutine
+// running the test emits the progress of the whole test.
+func (sh streamHandler) OnProgress(Progress) {}
+
+// uniqueFindings is a Handler delivering each distinct finding once, since
+// all the streams usually find the same (e.g. an unverified certificate).
+type uniqueFindings struct {
+	Handler
+	seen map[Finding]bool
+}
+
+func (uf uniqueFindings) OnFinding(f Finding) {
+	key := Finding{Code: f.Code, Detail: f.Detail}
+	if !uf.seen[key] {
+		uf.seen[key] = true
+		uf.Handler.OnFinding(f)
+	}
+}
+
+// interruptedMessage returns the message logged when test is interrupted.
+func interruptedMessage(test string) string {
+	return strings.ToUpper(test[:1]) + test[1:] + " interrupted by user"
+}
+
+// runStreams runs a multi-stream test using Settings.Streams connections
+// to the same server. Each stream runs the test using run, and we emit
+// the aggregate client measurements, where Stream is zero, using emit.
+func (cl Client) runStreams(ctx context.Context, path, test, phase string,
+	run func(Client, context.Context, *websocket.Conn) error,
+	emit func(Client, Measurement)) error {
+	n := cl.Settings.Streams
+	if n > maxStreams {
+		return ErrInvalidStreams
+	}
+	if cl.Handler != nil {
+		cl.Handler = uniqueFindings{Handler: cl.Handler, seen: make(map[Finding]bool)}
+	}
+	var conns []*websocket.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	// The first connection chooses the server, which the others reuse
+	var wsURL url.URL
+	for len(conns) < n {
+		var conn *websocket.Conn
+		var err error
+		if len(conns) == 0 {
+			conn, wsURL, err = cl.dial(ctx, path)
+		} else {
+			conn, err = cl.connect(ctx, wsURL)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				cl.logInfo(LogInterrupted, interruptedMessage(test), "test", test)
+				return wrapError(ErrInterrupted, ctx.Err())
+			}
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := make(chan streamEvent)
+	errs := make(chan error, n)
+	for idx, conn := range conns {
+		stream := cl
+		// We apply the EventMask when delivering the events
+		stream.Settings.EventMask = EventAll
+		stream.Handler = streamHandler{stream: idx + 1, events: events, done: streamCtx.Done()}
+		go func(conn *websocket.Conn) {
+			errs <- run(stream, streamCtx, conn)
+		}(conn)
+	}
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	numBytes := make([]int64, n)
+	t0 := time.Now()
+	tLast := t0
+	var countLast int64
+	aggregate := func(now time.Time) {
+		var count int64
+		for _, v := range numBytes {
+			count += v
+		}
+		elapsed := now.Sub(t0)
+		emit(cl, cl.clientMeasurement(test, elapsed, count, now.Sub(tLast), count-countLast))
+		tLast, countLast = now, count
+	}
+	var firstErr error
+	for running := n; running > 0; {
+		select {
+		case ev := <-events:
+			if ev.client != nil {
+				numBytes[ev.stream-1] = ev.client.NumBytes
+			}
+			ev.deliver(cl)
+		case err := <-errs:
+			running--
+			if err != nil && firstErr == nil {
+				// Stop the other streams, which would otherwise measure
+				// a path that is not loaded as requested anymore
+				firstErr = err
+				cancel()
+			}
+		case now := <-ticker.C:
+			elapsed := now.Sub(t0)
+			cl.progress(phase, elapsed)
+			if now.Sub(tLast) >= spec.MinMeasurementInterval {
+				aggregate(now)
+			}
+		}
+	}
+	aggregate(time.Now())
+	if ctx.Err() != nil {
+		cl.logInfo(LogInterrupted, interruptedMessage(test), "test", test)
+		return wrapError(ErrInterrupted, ctx.Err())
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	cl.progress(PhaseFinalizing, cl.Settings.duration())
+	return nil
+}
@@ -0,0 +1,82 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// streamsHandler is a Handler, safe for concurrent use, that records the
+// Stream of the client measurements.
+type streamsHandler struct {
+	Handler
+	mu      sync.Mutex
+	streams map[int]int
+}
+
+func (sh *streamsHandler) record(m Measurement) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.streams[m.Stream]++
+}
+
+func (sh *streamsHandler) OnClientDownloadMeasurement(m Measurement) {
+	sh.record(m)
+}
+
+func (sh *streamsHandler) OnClientUploadMeasurement(m Measurement) {
+	sh.record(m)
+}
+
+func TestMultiStream(t *testing.T) {
+	const streams = 3
+	for _, test := range []struct {
+		name string
+		run  func(Client, context.Context) (*Results, error)
+	}{
+		{"download", Client.RunDownloadWithResults},
+		{"upload", Client.RunUploadWithResults},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cl := newTestClient(t)
+			cl.Settings.Streams = streams
+			handler := &streamsHandler{Handler: MultiHandler(), streams: make(map[int]int)}
+			cl.Handler = handler
+			results, err := test.run(cl, context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Stream zero is the aggregate of all the connections
+			for stream := 0; stream <= streams; stream++ {
+				if handler.streams[stream] <= 0 {
+					t.Fatalf("no client measurements for stream %d", stream)
+				}
+			}
+			if len(handler.streams) != streams+1 {
+				t.Fatalf("expected %d streams, got %v", streams, handler.streams)
+			}
+			if len(results.Streams) != streams {
+				t.Fatalf("expected the results of %d streams, got %d", streams, len(results.Streams))
+			}
+			var sum int64
+			for idx, sr := range results.Streams {
+				if sr.Stream != idx+1 || sr.NumBytes <= 0 || sr.MeanThroughput <= 0 {
+					t.Fatalf("unexpected results of stream %d: %+v", idx+1, sr)
+				}
+				sum += sr.NumBytes
+			}
+			if results.NumBytes != sum {
+				t.Fatalf("expected the aggregate to transfer %d bytes, got %d", sum, results.NumBytes)
+			}
+		})
+	}
+}
+
+func TestTooManyStreams(t *testing.T) {
+	cl := newTestClient(t)
+	cl.Settings.Streams = maxStreams + 1
+	if err := cl.RunDownload(context.Background()); !errors.Is(err, ErrInvalidStreams) {
+		t.Fatalf("expected ErrInvalidStreams, got %v", err)
+	}
+}
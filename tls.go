@@ -0,0 +1,112 @@
+package nuvolari
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSSettings contains the settings to use servers with a private PKI.
+type TLSSettings struct {
+	// CAFile is the optional path of a PEM file containing the CAs to use
+	// for verifying the server certificate instead of the system ones.
+	CAFile string
+
+	// CAPEM optionally contains PEM encoded CAs to use for verifying the
+	// server certificate. They are added to the ones in CAFile, if any.
+	CAPEM []byte
+
+	// CertFile and KeyFile are the optional paths of the PEM files with
+	// the client certificate and key, for servers requiring mutual TLS.
+	CertFile, KeyFile string
+
+	// MinVersion is the optional minimum TLS version (e.g. tls.VersionTLS13).
+	MinVersion uint16
+
+	// CipherSuites is the optional list of cipher suites to use for TLS
+	// 1.2 and below. TLS 1.3 cipher suites are not configurable.
+	CipherSuites []uint16
+
+	// PinnedCertSHA256 optionally contains the base64 encoded SHA-256
+	// hashes of the SubjectPublicKeyInfo of the server certificates we
+	// accept, so that devices can pin the server public key rather than
+	// shipping a CA bundle. When set, we do not verify the certificate
+	// chain and we fail with ErrPinMismatch unless the public key of the
+	// server certificate matches one of the pins. Multiple pins allow to
+	// rotate the server keys.
+	PinnedCertSHA256 []string
+}
+
+// ErrInvalidCABundle is returned when the CAs are not valid PEM certificates.
+var ErrInvalidCABundle = errors.New("No valid certificates in the CA bundle")
+
+// ErrInvalidPin is returned when a pin is not a base64 encoded SHA-256 hash.
+var ErrInvalidPin = errors.New("Pinned certificate hash is invalid")
+
+// ErrPinMismatch is returned when the public key of the server certificate
+// does not match any of the pins (see TLSSettings.PinnedCertSHA256).
+var ErrPinMismatch = errors.New("Server public key does not match the pinned ones")
+
+// empty indicates whether s does not change the TLS configuration.
+func (s TLSSettings) empty() bool {
+	return s.CAFile == "" && len(s.CAPEM) <= 0 && s.CertFile == "" &&
+		s.KeyFile == "" && s.MinVersion == 0 && len(s.CipherSuites) <= 0 &&
+		len(s.PinnedCertSHA256) <= 0
+}
+
+// apply applies s to config, which must not be shared with others.
+func (s TLSSettings) apply(config *tls.Config) error {
+	if s.CAFile != "" || len(s.CAPEM) > 0 {
+		pem := append([]byte{}, s.CAPEM...)
+		if s.CAFile != "" {
+			data, err := ioutil.ReadFile(s.CAFile)
+			if err != nil {
+				return err
+			}
+			pem = append(append(pem, '\n'), data...)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrInvalidCABundle
+		}
+		config.RootCAs = pool
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if s.MinVersion != 0 {
+		config.MinVersion = s.MinVersion
+	}
+	if len(s.CipherSuites) > 0 {
+		config.CipherSuites = append([]uint16{}, s.CipherSuites...)
+	}
+	if len(s.PinnedCertSHA256) > 0 {
+		pins := make(map[[sha256.Size]byte]bool)
+		for _, pin := range s.PinnedCertSHA256 {
+			data, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(data) != sha256.Size {
+				return ErrInvalidPin
+			}
+			pins[[sha256.Size]byte(data)] = true
+		}
+		// The pin replaces the chain verification. Since the handshake
+		// proves that the server owns the key of the leaf certificate,
+		// we only check the leaf certificate.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) <= 0 ||
+				!pins[sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)] {
+				return ErrPinMismatch
+			}
+			return nil
+		}
+	}
+	return nil
+}
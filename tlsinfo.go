@@ -0,0 +1,68 @@
+package nuvolari
+
+import (
+	"crypto/tls"
+	"strconv"
+	"time"
+)
+
+// TLSInfo describes the TLS connection with the server.
+type TLSInfo struct {
+	// Version is the negotiated TLS version (e.g. "TLS 1.3").
+	Version string `json:"version"`
+
+	// CipherSuite is the negotiated cipher suite.
+	CipherSuite string `json:"cipher_suite"`
+
+	// ALPN is the protocol negotiated using ALPN, if any.
+	ALPN string `json:"alpn,omitempty"`
+
+	// Subject is the subject of the server certificate.
+	Subject string `json:"subject,omitempty"`
+
+	// Issuer is the issuer of the server certificate.
+	Issuer string `json:"issuer,omitempty"`
+
+	// HandshakeTime is the duration of the handshake in milliseconds.
+	HandshakeTime float64 `json:"handshake_time"`
+}
+
+// newTLSInfo returns the TLSInfo of a handshake that lasted elapsed.
+func newTLSInfo(state tls.ConnectionState, elapsed time.Duration) *TLSInfo {
+	info := &TLSInfo{
+		Version:       tls.VersionName(state.Version),
+		CipherSuite:   tls.CipherSuiteName(state.CipherSuite),
+		ALPN:          state.NegotiatedProtocol,
+		HandshakeTime: milliseconds(elapsed),
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.Subject = state.PeerCertificates[0].Subject.String()
+		info.Issuer = state.PeerCertificates[0].Issuer.String()
+	}
+	return info
+}
+
+// logTLSInfo emits LogTLSHandshake with the fields of info as params.
+func (cl Client) logTLSInfo(info *TLSInfo) {
+	cl.logInfo(LogTLSHandshake, "TLS handshake: "+info.Version+" "+info.CipherSuite,
+		"version", info.Version, "cipher_suite", info.CipherSuite, "alpn", info.ALPN,
+		"subject", info.Subject, "issuer", info.Issuer,
+		"handshake_time", formatMilliseconds(info.HandshakeTime))
+}
+
+// TLSInfoOf returns the TLSInfo carried by m, if m is a LogTLSHandshake
+// message, or nil otherwise.
+func TLSInfoOf(m LogMessage) *TLSInfo {
+	if m.Code != LogTLSHandshake {
+		return nil
+	}
+	elapsed, _ := strconv.ParseFloat(m.Params["handshake_time"], 64)
+	return &TLSInfo{
+		Version:       m.Params["version"],
+		CipherSuite:   m.Params["cipher_suite"],
+		ALPN:          m.Params["alpn"],
+		Subject:       m.Params["subject"],
+		Issuer:        m.Params["issuer"],
+		HandshakeTime: elapsed,
+	}
+}
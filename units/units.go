@@ -0,0 +1,79 @@
+// Package units formats and parses bit-rates and byte counts, such that
+// they are rendered consistently (e.g. "125 Mbit/s") everywhere.
+package units
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var prefixes = []string{"", "k", "M", "G", "T"}
+
+// format scales value using SI prefixes and appends unit.
+func format(value float64, unit string) string {
+	idx := 0
+	for value >= 1000 && idx < len(prefixes)-1 {
+		value /= 1000
+		idx++
+	}
+	// Use three significant digits, without trailing zeroes
+	decimals := 2
+	switch {
+	case value >= 100 || idx == 0:
+		decimals = 0
+	case value >= 10:
+		decimals = 1
+	}
+	s := strconv.FormatFloat(value, 'f', decimals, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return fmt.Sprintf("%s %s%s", s, prefixes[idx], unit)
+}
+
+// FormatBitrate formats a bit-rate expressed in bit/s (e.g. 125000000
+// is formatted as "125 Mbit/s").
+func FormatBitrate(bps float64) string {
+	return format(bps, "bit/s")
+}
+
+// FormatBytes formats a number of bytes (e.g. 1500000 is formatted as
+// "1.5 MB").
+func FormatBytes(count int64) string {
+	return format(float64(count), "B")
+}
+
+// ErrInvalidBitrate is returned when a bit-rate cannot be parsed.
+var ErrInvalidBitrate = errors.New("Bit-rate is invalid")
+
+// ParseBitrate parses a bit-rate and returns it in bit/s. It accepts an
+// optional SI prefix (k, M, G, T) followed by an optional unit among bit,
+// bit/s, bps and b/s. For example "50Mbit", "50 Mbit/s", "50M" and
+// "50000000" are all parsed as 50000000 bit/s.
+func ParseBitrate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	for _, unit := range []string{"bit/s", "bps", "b/s", "bit"} {
+		if strings.HasSuffix(strings.ToLower(s), unit) {
+			s = strings.TrimSpace(s[:len(s)-len(unit)])
+			break
+		}
+	}
+	multiplier := 1.0
+	for idx := len(prefixes) - 1; idx > 0; idx-- {
+		if strings.HasSuffix(s, prefixes[idx]) || (idx == 1 && strings.HasSuffix(s, "K")) {
+			s = strings.TrimSpace(s[:len(s)-1])
+			for i := 0; i < idx; i++ {
+				multiplier *= 1000
+			}
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, ErrInvalidBitrate
+	}
+	return value * multiplier, nil
+}
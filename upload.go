@@ -0,0 +1,318 @@
+package nuvolari
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/bassosimone/nuvolari/internal/sockopt"
+	"github.com/bassosimone/nuvolari/spec"
+	"github.com/gorilla/websocket"
+)
+
+func makeRandomData(size int, intn func(int) int) []byte {
+	data := make([]byte, size)
+	// This is not the fastest algorithm to generate a random string, yet it
+	// is most likely good enough for our purposes. See [1] for a comprehensive
+	// discussion regarding how to generate a random string in Golang.
+	//
+	// .. [1] https://stackoverflow.com/a/31832326/4354461
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	for i := range data {
+		data[i] = letterBytes[intn(len(letterBytes))]
+	}
+	return data
+}
+
+// makeData returns the content of the upload messages of the given size,
+// according to the Pattern and the Seed.
+func (us UploadSettings) makeData(size int) []byte {
+	if len(us.Pattern) > 0 {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = us.Pattern[i%len(us.Pattern)]
+		}
+		return data
+	}
+	if us.Seed != 0 {
+		return makeRandomData(size, rand.New(rand.NewSource(us.Seed)).Intn)
+	}
+	return makeRandomData(size, rand.Intn)
+}
+
+// makeWriter returns a function that writes the next upload message and
+// returns its size. By default we use a prepared message, which caches the
+// encoded frame; in LowMemory mode we write a smaller message without any
+// caching.
+func (cl Client) makeWriter(conn *websocket.Conn) (func() (int, error), error) {
+	if cl.Settings.LowMemory {
+		data := cl.Settings.Upload.makeData(lowMemoryMessageSize)
+		return func() (int, error) {
+			return len(data), conn.WriteMessage(websocket.BinaryMessage, data)
+		}, nil
+	}
+	data := cl.Settings.Upload.makeData(spec.BulkMessageSize)
+	pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return nil, err
+	}
+	return func() (int, error) {
+		return spec.BulkMessageSize, conn.WritePreparedMessage(pm)
+	}, nil
+}
+
+// tuneUploadSocket applies the upload socket options. We ignore errors
+// setting TCP_NOTSENT_LOWAT unless the user explicitly asked for it.
+func (cl Client) tuneUploadSocket(conn *websocket.Conn) error {
+	if cc := cl.Settings.Upload.CongestionControl; cc != "" {
+		err := sockopt.SetCongestionControl(conn.UnderlyingConn(), cc)
+		if err != nil {
+			return err
+		}
+		cl.logInfo(LogCongestionControl, "Using congestion control: "+cc, "algorithm", cc)
+	}
+	lowat := cl.Settings.Upload.NotSentLowat
+	if lowat < 0 {
+		return nil
+	}
+	if lowat == 0 {
+		lowat = defaultNotSentLowat
+	}
+	err := sockopt.SetNotSentLowat(conn.UnderlyingConn(), lowat)
+	if err != nil && cl.Settings.Upload.NotSentLowat != 0 {
+		return err
+	}
+	return nil
+}
+
+// RunUpload runs a ndt7 upload test. Like RunDownload, it returns an error
+// wrapping ErrInterrupted if ctx is cancelled before the test is over.
+func (cl Client) RunUpload(ctx context.Context) error {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	cl.Settings = cl.Settings.clone()
+	if err := cl.Settings.ensureTestID(); err != nil {
+		return err
+	}
+	if cl.Settings.Streams > 1 {
+		return cl.runStreams(ctx, spec.UploadURLPath, "upload", PhaseUpload,
+			Client.RunUploadConn, Client.clientUploadMeasurement)
+	}
+	conn, wsURL, err := cl.dial(ctx, spec.UploadURLPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			cl.logInfo(LogInterrupted, "Upload interrupted by user", "test", "upload")
+			return wrapError(ErrInterrupted, ctx.Err())
+		}
+		if cl.shouldFallBack(err, wsURL) {
+			return cl.runNDT5(ctx, "upload", wsURL.Hostname())
+		}
+		return err
+	}
+	return cl.runReconnecting(ctx, conn, wsURL, "upload", Client.RunUploadConn)
+}
+
+// throughput returns the throughput in bits per second of transferring
+// count bytes in elapsed time.
+func throughput(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) * 8 / elapsed.Seconds()
+}
+
+// clientMeasurement returns the client measurement of test after we
+// transferred count bytes in elapsed time, of which delta bytes in the
+// interval since the previous measurement.
+func (cl Client) clientMeasurement(test string, elapsed time.Duration, count int64,
+	interval time.Duration, delta int64) Measurement {
+	m := Measurement{
+		Origin:            spec.OriginClient,
+		Test:              test,
+		AppInfo:           spec.NewAppInfo(elapsed, count),
+		Elapsed:           elapsed.Seconds(),
+		NumBytes:          count,
+		Throughput:        throughput(count, elapsed),
+		InstantThroughput: throughput(delta, interval),
+	}
+	if cl.Settings.Deltas {
+		m.IntervalBytes, m.IntervalElapsed = delta, interval.Seconds()
+	}
+	return m
+}
+
+// readServerMeasurements reads the measurements that the server sends
+// during the upload and posts them on out until reading fails or done is
+// closed. It posts on errs the error that caused it to stop reading, which
+// is a *websocket.CloseError when the server closes the connection.
+func readServerMeasurements(conn *websocket.Conn, out chan<- Measurement,
+	errs chan<- error, done <-chan struct{}) {
+	for {
+		mtype, mdata, err := conn.ReadMessage()
+		if err != nil {
+			errs <- readError(err)
+			return
+		}
+		if mtype != websocket.TextMessage {
+			continue
+		}
+		measurement, err := spec.ParseMeasurement(mdata)
+		if err != nil {
+			errs <- wrapError(ErrProtocolViolation, err)
+			return
+		}
+		select {
+		case out <- measurement:
+		case <-done:
+			return
+		}
+	}
+}
+
+// RunUploadConn is like RunDownloadConn but runs a ndt7 upload test. We
+// read the server measurements in a background goroutine, which returns
+// when the caller closes conn.
+func (cl Client) RunUploadConn(ctx context.Context, conn *websocket.Conn) (err error) {
+	cl, closeSink := cl.withSink()
+	defer closeSink()
+	if err := cl.tuneUploadSocket(conn); err != nil {
+		return err
+	}
+	write, err := cl.makeWriter(conn)
+	if err != nil {
+		return err
+	}
+	defer cl.Settings.tuneGC()()
+	conn.SetReadLimit(cl.Settings.readLimit())
+	measurements := make(chan Measurement)
+	readErrs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	pinger := newPinger(conn, cl.Settings.PingInterval, timeout(cl.Settings.WriteTimeout))
+	go readServerMeasurements(conn, measurements, readErrs, done)
+	var count, countLast int64
+	var lat latencyTracker
+	t0 := time.Now()
+	tLast := t0
+	tProgress := t0
+	duration := cl.Settings.duration()
+	pacing := newPacer(ctx, cl.Settings.MaxUploadRate, duration)
+	defer func() {
+		if err != nil && count > countLast {
+			cl.clientUploadMeasurement(cl.finalMeasurement(spec.TestUpload, conn, t0, tLast, count, countLast))
+		}
+	}()
+	for {
+		now := time.Now()
+		elapsed := now.Sub(t0)
+		if elapsed >= duration {
+			break
+		}
+		// Check whether the user interrupted us
+		select {
+		case <-ctx.Done():
+			cl.logInfo(LogInterrupted, "Upload interrupted by user", "test", "upload")
+			cl.closeNormally(conn)
+			return wrapError(ErrInterrupted, ctx.Err())
+		default:
+			break
+		}
+		// Deliver the server measurements, if any, from this goroutine so
+		// that the Handler does not need to be safe for concurrent use
+		select {
+		case measurement := <-measurements:
+			lat.addServer(measurement)
+			cl.serverUploadMeasurement(measurement)
+		case err := <-readErrs:
+			if err := closeError(err); err != nil {
+				return err
+			}
+			// The server closed normally and completed the handshake
+			cl.progress(PhaseFinalizing, duration)
+			return nil
+		default:
+		}
+		// Check whether it's time to emit the next progress event
+		if now.Sub(tProgress) >= progressInterval {
+			cl.progress(PhaseUpload, elapsed)
+			tProgress = now
+		}
+		// Check whether it's time to run the next client-side measurement
+		if now.Sub(tLast) >= spec.MinMeasurementInterval {
+			measurement := cl.clientMeasurement(spec.TestUpload, elapsed, count,
+				now.Sub(tLast), count-countLast)
+			measurement.TCPInfo = tcpInfo(conn)
+			measurement.AppRTT = pinger.takeSamples()
+			lat.measure(&measurement)
+			setLoss(&measurement, measurement.TCPInfo)
+			if tLast == t0 {
+				measurement.ConnectionInfo = connectionInfo(conn)
+			}
+			cl.clientUploadMeasurement(measurement)
+			tLast, countLast = now, count
+		}
+		pinger.maybePing(conn, now)
+		conn.SetWriteDeadline(time.Now().Add(timeout(cl.Settings.WriteTimeout)))
+		n, err := write()
+		if err != nil {
+			return writeError(err, readErrs)
+		}
+		count += int64(n)
+		pacing.wait(n)
+	}
+	cl.progress(PhaseFinalizing, duration)
+	return cl.closeUpload(conn, measurements, readErrs)
+}
+
+// writeError returns the error explaining why writing failed. When the
+// server closes the connection with an error status, or violates the
+// protocol, writing typically fails with a less useful error, hence we
+// prefer the former.
+func writeError(err error, readErrs <-chan error) error {
+	select {
+	case rerr := <-readErrs:
+		if cerr, ok := closeError(rerr).(*CloseError); ok {
+			return cerr
+		}
+		if errors.Is(rerr, ErrProtocolViolation) {
+			return rerr
+		}
+	case <-time.After(closeErrorWait):
+	}
+	return err
+}
+
+// closeErrorWait is the time writeError waits for the reader.
+const closeErrorWait = 250 * time.Millisecond
+
+// closeUpload runs the closing handshake at the end of the upload. We send
+// a Close frame and wait for the server Close frame, while still delivering
+// the server measurements. If the server does not reply in time, we do not
+// fail, since the test is over anyway.
+func (cl Client) closeUpload(conn *websocket.Conn, measurements <-chan Measurement,
+	readErrs <-chan error) error {
+	if err := cl.closeNormally(conn); err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout(cl.Settings.CloseTimeout))
+	defer timer.Stop()
+	for {
+		select {
+		case measurement := <-measurements:
+			cl.serverUploadMeasurement(measurement)
+		case err := <-readErrs:
+			// Only fail if the server reports an error, since the test
+			// is over and the server may just tear down the connection
+			if cerr, ok := closeError(err).(*CloseError); ok {
+				return cerr
+			}
+			if errors.Is(err, ErrProtocolViolation) {
+				return err
+			}
+			return nil
+		case <-timer.C:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nuvolari
+
+import (
+	"runtime/debug"
+
+	"github.com/bassosimone/nuvolari/spec"
+)
+
+// version is the version of nuvolari. Release builds may override it
+// using `-ldflags "-X github.com/bassosimone/nuvolari.version=v1.2.3"`.
+var version = ""
+
+// VersionInfo identifies the client that produced a result.
+type VersionInfo struct {
+	// Version is the version of nuvolari (e.g. "v0.1.0"), or "devel" when
+	// the version is not known, e.g. because we're building from a checkout.
+	Version string `json:"version"`
+
+	// Commit is the git commit we were built from, if known.
+	Commit string `json:"commit,omitempty"`
+
+	// Spec is the version of the ndt7 protocol that we implement.
+	Spec string `json:"spec"`
+}
+
+// String returns a compact representation of the version.
+func (vi VersionInfo) String() string {
+	s := vi.Version
+	if vi.Commit != "" {
+		s += " (" + vi.Commit + ")"
+	}
+	return s
+}
+
+// modulePath is the path of the nuvolari module.
+const modulePath = "github.com/bassosimone/nuvolari"
+
+// Version returns information about the version of nuvolari.
+func Version() VersionInfo {
+	info, _ := debug.ReadBuildInfo()
+	return versionFromBuildInfo(info)
+}
+
+// versionFromBuildInfo returns the VersionInfo according to info, which
+// may be nil. When nuvolari is a dependency, its version is the one of
+// the dependency, not the one of the program using it, and we do not
+// know the commit, since the VCS settings describe the program.
+func versionFromBuildInfo(info *debug.BuildInfo) VersionInfo {
+	vi := VersionInfo{Version: version, Spec: spec.SecWebSocketProtocol}
+	if info != nil {
+		module := findModule(info)
+		if vi.Version == "" && module != nil && module.Version != "(devel)" {
+			vi.Version = module.Version
+		}
+		if module == &info.Main {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					vi.Commit = setting.Value
+				}
+			}
+		}
+	}
+	if vi.Version == "" {
+		vi.Version = "devel"
+	}
+	return vi
+}
+
+// findModule returns the nuvolari module in info, or nil.
+func findModule(info *debug.BuildInfo) *debug.Module {
+	if info.Main.Path == modulePath {
+		return &info.Main
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				return dep.Replace
+			}
+			return dep
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package nuvolari
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestVersionFromBuildInfo(t *testing.T) {
+	revision := []debug.BuildSetting{{Key: "vcs.revision", Value: "abcdef"}}
+	tests := []struct {
+		name    string
+		info    *debug.BuildInfo
+		version string
+		commit  string
+	}{{
+		name:    "no build info",
+		version: "devel",
+	}, {
+		name: "main module",
+		info: &debug.BuildInfo{
+			Main:     debug.Module{Path: modulePath, Version: "v0.2.0"},
+			Settings: revision,
+		},
+		version: "v0.2.0",
+		commit:  "abcdef",
+	}, {
+		name: "main module built from a checkout",
+		info: &debug.BuildInfo{
+			Main:     debug.Module{Path: modulePath, Version: "(devel)"},
+			Settings: revision,
+		},
+		version: "devel",
+		commit:  "abcdef",
+	}, {
+		name: "dependency",
+		info: &debug.BuildInfo{
+			Main: debug.Module{Path: "example.com/app", Version: "v3.0.0"},
+			Deps: []*debug.Module{
+				{Path: "github.com/gorilla/websocket", Version: "v1.5.0"},
+				{Path: modulePath, Version: "v0.1.0"},
+			},
+			Settings: revision,
+		},
+		version: "v0.1.0",
+	}, {
+		name: "replaced dependency",
+		info: &debug.BuildInfo{
+			Main: debug.Module{Path: "example.com/app", Version: "v3.0.0"},
+			Deps: []*debug.Module{{
+				Path:    modulePath,
+				Version: "v0.1.0",
+				Replace: &debug.Module{Path: "example.com/fork", Version: "v0.1.1"},
+			}},
+		},
+		version: "v0.1.1",
+	}, {
+		name: "not in the build",
+		info: &debug.BuildInfo{
+			Main:     debug.Module{Path: "example.com/app", Version: "v3.0.0"},
+			Settings: revision,
+		},
+		version: "devel",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vi := versionFromBuildInfo(tt.info)
+			if vi.Version != tt.version || vi.Commit != tt.commit {
+				t.Fatalf("expected %q (%q), got %q (%q)",
+					tt.version, tt.commit, vi.Version, vi.Commit)
+			}
+		})
+	}
+}